@@ -0,0 +1,577 @@
+/*
+Implementation of a TLS 1.2 client with anonymous Diffie-Hellman key exchange,
+as offered by Vino and by the TLS sub-types of VeNCrypt, and which crypto/tls
+does not implement. Anonymous TLS encrypts the session but does not
+authenticate the server, so it does not protect against an active attacker.
+https://tools.ietf.org/html/rfc5246
+*/
+package vnc
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+)
+
+const (
+	tlsVersion12 = 0x0303
+
+	// Record content types.
+	tlsChangeCipherSpec = 20
+	tlsAlert            = 21
+	tlsHandshake        = 22
+	tlsApplicationData  = 23
+
+	// Handshake message types.
+	tlsClientHello       = 1
+	tlsServerHello       = 2
+	tlsServerKeyExchange = 12
+	tlsServerHelloDone   = 14
+	tlsClientKeyExchange = 16
+	tlsFinished          = 20
+
+	// Alert levels and descriptions.
+	tlsAlertLevelWarning     = 1
+	tlsAlertLevelFatal       = 2
+	tlsAlertCloseNotify      = 0
+	tlsAlertHandshakeFailure = 40
+
+	tlsRenegotiationInfo      = 0xff01 // extension_type
+	tlsFinishedLength         = 12
+	tlsMasterSecretLength     = 48
+	tlsGCMFixedNonceLength    = 4
+	tlsGCMExplicitNonceLength = 8
+	tlsMaxPlaintext           = 1 << 14
+	tlsMaxRecord              = tlsMaxPlaintext + 2048
+	tlsMaxHandshake           = 1 << 16
+
+	// The range of Diffie-Hellman prime lengths accepted from the server, in
+	// bits.
+	anonDHMinBits = 1024
+	anonDHMaxBits = 8192
+)
+
+// anonTLSSuite is a cipher suite with anonymous Diffie-Hellman key exchange.
+type anonTLSSuite struct {
+	id      uint16
+	keyLen  int
+	mac     func() hash.Hash // The MAC of CBC suites, or nil for GCM.
+	prfHash func() hash.Hash
+}
+
+// anonTLSSuites are the cipher suites offered, in order of preference.
+var anonTLSSuites = []anonTLSSuite{
+	{0x00a6, 16, nil, sha256.New},        // TLS_DH_anon_WITH_AES_128_GCM_SHA256
+	{0x00a7, 32, nil, sha512.New384},     // TLS_DH_anon_WITH_AES_256_GCM_SHA384
+	{0x006c, 16, sha256.New, sha256.New}, // TLS_DH_anon_WITH_AES_128_CBC_SHA256
+	{0x006d, 32, sha256.New, sha256.New}, // TLS_DH_anon_WITH_AES_256_CBC_SHA256
+	{0x0034, 16, sha1.New, sha256.New},   // TLS_DH_anon_WITH_AES_128_CBC_SHA
+	{0x003a, 32, sha1.New, sha256.New},   // TLS_DH_anon_WITH_AES_256_CBC_SHA
+}
+
+// anonTLSConn is a connection encrypted by anonymous TLS.
+type anonTLSConn struct {
+	net.Conn
+	in, out *tlsHalfConn // The record protection, nil until activated.
+	input   []byte       // Application data yet to be read.
+	hs      []byte       // Handshake data yet to be parsed.
+
+	// Serializes writes, so that sequence numbers match the record order.
+	writeMu sync.Mutex
+}
+
+// anonTLSClient performs an anonymous TLS handshake over conn, and returns
+// the encrypted connection.
+func anonTLSClient(conn net.Conn) (*anonTLSConn, error) {
+	c := &anonTLSConn{Conn: conn}
+	if err := c.clientHandshake(); err != nil {
+		c.writeRecord(tlsAlert, []byte{tlsAlertLevelFatal, tlsAlertHandshakeFailure})
+		return nil, err
+	}
+	return c, nil
+}
+
+// clientHandshake performs the client side of the handshake.
+func (c *anonTLSConn) clientHandshake() error {
+	var transcript bytes.Buffer
+
+	// ClientHello.
+	clientRandom := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, clientRandom); err != nil {
+		return err
+	}
+	hello := []byte{tlsVersion12 >> 8, tlsVersion12 & 0xff}
+	hello = append(hello, clientRandom...)
+	hello = append(hello, 0) // session_id
+	hello = appendUint16(hello, uint16(2*len(anonTLSSuites)))
+	for _, s := range anonTLSSuites {
+		hello = appendUint16(hello, s.id)
+	}
+	hello = append(hello, 1, 0) // The null compression method.
+	// An empty renegotiation_info extension, as renegotiation is refused.
+	hello = appendUint16(hello, 5)
+	hello = appendUint16(hello, tlsRenegotiationInfo)
+	hello = appendUint16(hello, 1)
+	hello = append(hello, 0)
+	if err := c.writeHandshake(&transcript, tlsClientHello, hello); err != nil {
+		return err
+	}
+
+	// ServerHello.
+	msg, err := c.readHandshake(&transcript, tlsServerHello)
+	if err != nil {
+		return err
+	}
+	r := tlsReader(msg)
+	version := r.uint16()
+	serverRandom := r.bytes(32)
+	r.bytes(int(r.uint8())) // session_id
+	suiteID := r.uint16()
+	compression := r.uint8()
+	if r.err != nil {
+		return errors.New("invalid ServerHello")
+	}
+	if version != tlsVersion12 {
+		return fmt.Errorf("unsupported TLS version %#04x", version)
+	}
+	if compression != 0 {
+		return fmt.Errorf("unsupported compression method %d", compression)
+	}
+	var suite *anonTLSSuite
+	for i := range anonTLSSuites {
+		if anonTLSSuites[i].id == suiteID {
+			suite = &anonTLSSuites[i]
+		}
+	}
+	if suite == nil {
+		return fmt.Errorf("server chose cipher suite %#04x, which was not offered", suiteID)
+	}
+
+	// ServerKeyExchange and ServerHelloDone.
+	if msg, err = c.readHandshake(&transcript, tlsServerKeyExchange); err != nil {
+		return err
+	}
+	r = tlsReader(msg)
+	p := new(big.Int).SetBytes(r.bytes(int(r.uint16())))
+	g := new(big.Int).SetBytes(r.bytes(int(r.uint16())))
+	ys := new(big.Int).SetBytes(r.bytes(int(r.uint16())))
+	if r.err != nil {
+		return errors.New("invalid ServerKeyExchange")
+	}
+	if p.BitLen() < anonDHMinBits || p.BitLen() > anonDHMaxBits || p.Bit(0) == 0 {
+		return fmt.Errorf("invalid Diffie-Hellman prime of %d bits", p.BitLen())
+	}
+	pMinus1 := new(big.Int).Sub(p, big.NewInt(1))
+	one := big.NewInt(1)
+	if g.Cmp(one) <= 0 || g.Cmp(pMinus1) >= 0 || ys.Cmp(one) <= 0 || ys.Cmp(pMinus1) >= 0 {
+		return errors.New("invalid Diffie-Hellman parameters")
+	}
+	if _, err := c.readHandshake(&transcript, tlsServerHelloDone); err != nil {
+		return err
+	}
+
+	// ClientKeyExchange.
+	x, err := rand.Int(rand.Reader, new(big.Int).Sub(p, big.NewInt(3)))
+	if err != nil {
+		return err
+	}
+	x.Add(x, big.NewInt(2))
+	yc := new(big.Int).Exp(g, x, p).Bytes()
+	preMasterSecret := new(big.Int).Exp(ys, x, p).Bytes()
+	if err := c.writeHandshake(&transcript, tlsClientKeyExchange, appendUint16(nil, uint16(len(yc)), yc...)); err != nil {
+		return err
+	}
+
+	// Change to the negotiated keys.
+	masterSecret := tlsPRF(suite.prfHash, preMasterSecret, "master secret", concat(clientRandom, serverRandom), tlsMasterSecretLength)
+	clientKeys, serverKeys, err := suite.keys(masterSecret, clientRandom, serverRandom)
+	if err != nil {
+		return err
+	}
+	if err := c.writeRecord(tlsChangeCipherSpec, []byte{1}); err != nil {
+		return err
+	}
+	c.out = clientKeys
+	verify := tlsPRF(suite.prfHash, masterSecret, "client finished", digest(suite.prfHash, transcript.Bytes()), tlsFinishedLength)
+	if err := c.writeHandshake(&transcript, tlsFinished, verify); err != nil {
+		return err
+	}
+
+	// The server changes to the negotiated keys, and proves it knows them.
+	typ, data, err := c.readRecord()
+	if err != nil {
+		return err
+	}
+	if typ == tlsAlert {
+		return tlsAlertError(data)
+	}
+	if typ != tlsChangeCipherSpec || !bytes.Equal(data, []byte{1}) || len(c.hs) > 0 {
+		return fmt.Errorf("unexpected record of type %d; expected ChangeCipherSpec", typ)
+	}
+	c.in = serverKeys
+	want := tlsPRF(suite.prfHash, masterSecret, "server finished", digest(suite.prfHash, transcript.Bytes()), tlsFinishedLength)
+	if msg, err = c.readHandshake(&transcript, tlsFinished); err != nil {
+		return err
+	}
+	if !hmac.Equal(msg, want) {
+		return errors.New("incorrect server Finished message")
+	}
+	return nil
+}
+
+// keys returns the record protection of the client and server.
+func (s *anonTLSSuite) keys(masterSecret, clientRandom, serverRandom []byte) (client, server *tlsHalfConn, err error) {
+	macLen, ivLen := 0, tlsGCMFixedNonceLength
+	if s.mac != nil {
+		macLen, ivLen = s.mac().Size(), 0
+	}
+	b := tlsPRF(s.prfHash, masterSecret, "key expansion", concat(serverRandom, clientRandom), 2*(macLen+s.keyLen+ivLen))
+	next := func(n int) []byte {
+		v := b[:n]
+		b = b[n:]
+		return v
+	}
+	clientMAC, serverMAC := next(macLen), next(macLen)
+	clientKey, serverKey := next(s.keyLen), next(s.keyLen)
+	clientIV, serverIV := next(ivLen), next(ivLen)
+	if client, err = newTLSHalfConn(s, clientKey, clientMAC, clientIV); err != nil {
+		return nil, nil, err
+	}
+	if server, err = newTLSHalfConn(s, serverKey, serverMAC, serverIV); err != nil {
+		return nil, nil, err
+	}
+	return client, server, nil
+}
+
+// Read implements the io.Reader interface.
+func (c *anonTLSConn) Read(p []byte) (int, error) {
+	for len(c.input) == 0 {
+		typ, data, err := c.readRecord()
+		if err != nil {
+			return 0, err
+		}
+		switch typ {
+		case tlsApplicationData:
+			c.input = data
+		case tlsAlert:
+			if len(data) == 2 && data[1] == tlsAlertCloseNotify {
+				return 0, io.EOF
+			}
+			if len(data) == 2 && data[0] == tlsAlertLevelWarning {
+				continue
+			}
+			return 0, tlsAlertError(data)
+		case tlsHandshake:
+			// Renegotiation is refused by ignoring the request.
+		default:
+			return 0, fmt.Errorf("unexpected TLS record of type %d", typ)
+		}
+	}
+	n := copy(p, c.input)
+	c.input = c.input[n:]
+	return n, nil
+}
+
+// Write implements the io.Writer interface.
+func (c *anonTLSConn) Write(p []byte) (int, error) {
+	if err := c.writeRecord(tlsApplicationData, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close implements the net.Conn interface, notifying the server first.
+func (c *anonTLSConn) Close() error {
+	c.writeRecord(tlsAlert, []byte{tlsAlertLevelWarning, tlsAlertCloseNotify})
+	return c.Conn.Close()
+}
+
+// readRecord reads a record, and removes its protection.
+func (c *anonTLSConn) readRecord() (uint8, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(c.Conn, header); err != nil {
+		return 0, nil, err
+	}
+	typ, length := header[0], int(binary.BigEndian.Uint16(header[3:]))
+	if header[1] != 3 || length > tlsMaxRecord {
+		return 0, nil, errors.New("invalid TLS record header")
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(c.Conn, data); err != nil {
+		return 0, nil, err
+	}
+	if c.in == nil {
+		return typ, data, nil
+	}
+	data, err := c.in.open(typ, data)
+	return typ, data, err
+}
+
+// writeRecord protects data and writes it in as many records as needed.
+func (c *anonTLSConn) writeRecord(typ uint8, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	for len(data) > 0 {
+		fragment := data
+		if len(fragment) > tlsMaxPlaintext {
+			fragment = fragment[:tlsMaxPlaintext]
+		}
+		data = data[len(fragment):]
+		if c.out != nil {
+			fragment = c.out.seal(typ, fragment)
+		}
+		record := append([]byte{typ, tlsVersion12 >> 8, tlsVersion12 & 0xff}, appendUint16(nil, uint16(len(fragment)), fragment...)...)
+		if _, err := c.Conn.Write(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readHandshake reads a handshake message of type typ, returning its body.
+// The message is added to the transcript.
+func (c *anonTLSConn) readHandshake(transcript *bytes.Buffer, typ uint8) ([]byte, error) {
+	for {
+		if len(c.hs) >= 4 {
+			n := int(c.hs[1])<<16 | int(c.hs[2])<<8 | int(c.hs[3])
+			if n > tlsMaxHandshake {
+				return nil, fmt.Errorf("TLS handshake message of %d bytes is too long", n)
+			}
+			if len(c.hs) >= 4+n {
+				msg := c.hs[:4+n]
+				c.hs = c.hs[4+n:]
+				if msg[0] != typ {
+					return nil, fmt.Errorf("unexpected TLS handshake message of type %d; expected %d", msg[0], typ)
+				}
+				transcript.Write(msg)
+				return msg[4:], nil
+			}
+		}
+		recordType, data, err := c.readRecord()
+		if err != nil {
+			return nil, err
+		}
+		switch recordType {
+		case tlsHandshake:
+			c.hs = append(c.hs, data...)
+		case tlsAlert:
+			return nil, tlsAlertError(data)
+		default:
+			return nil, fmt.Errorf("unexpected TLS record of type %d during handshake", recordType)
+		}
+	}
+}
+
+// writeHandshake writes a handshake message, and adds it to the transcript.
+func (c *anonTLSConn) writeHandshake(transcript *bytes.Buffer, typ uint8, body []byte) error {
+	msg := append([]byte{typ, uint8(len(body) >> 16), uint8(len(body) >> 8), uint8(len(body))}, body...)
+	transcript.Write(msg)
+	return c.writeRecord(tlsHandshake, msg)
+}
+
+// tlsAlertError returns the error reported by an alert from the peer.
+func tlsAlertError(data []byte) error {
+	if len(data) != 2 {
+		return errors.New("invalid TLS alert")
+	}
+	if data[1] == tlsAlertHandshakeFailure {
+		return errors.New("remote error: TLS handshake failure")
+	}
+	return fmt.Errorf("remote error: TLS alert %d", data[1])
+}
+
+// tlsHalfConn protects the records sent in one direction.
+type tlsHalfConn struct {
+	seq uint64
+
+	// AES-GCM.
+	aead    cipher.AEAD
+	fixedIV []byte
+
+	// AES-CBC with HMAC.
+	block cipher.Block
+	mac   hash.Hash
+}
+
+// newTLSHalfConn returns the record protection of a suite.
+func newTLSHalfConn(s *anonTLSSuite, key, macKey, iv []byte) (*tlsHalfConn, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if s.mac != nil {
+		return &tlsHalfConn{block: block, mac: hmac.New(s.mac, macKey)}, nil
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &tlsHalfConn{aead: aead, fixedIV: iv}, nil
+}
+
+// additionalData returns the data authenticated with a record of length n.
+func (h *tlsHalfConn) additionalData(typ uint8, n int) []byte {
+	ad := make([]byte, 13)
+	binary.BigEndian.PutUint64(ad, h.seq)
+	ad[8], ad[9], ad[10] = typ, tlsVersion12>>8, tlsVersion12&0xff
+	binary.BigEndian.PutUint16(ad[11:], uint16(n))
+	return ad
+}
+
+// seal returns the protected fragment of a record.
+func (h *tlsHalfConn) seal(typ uint8, fragment []byte) []byte {
+	ad := h.additionalData(typ, len(fragment))
+	h.seq++
+
+	if h.aead != nil {
+		explicit := ad[:tlsGCMExplicitNonceLength]
+		nonce := concat(h.fixedIV, explicit)
+		return h.aead.Seal(append([]byte{}, explicit...), nonce, fragment, ad)
+	}
+
+	h.mac.Reset()
+	h.mac.Write(ad)
+	h.mac.Write(fragment)
+	data := h.mac.Sum(append([]byte{}, fragment...))
+	bs := h.block.BlockSize()
+	pad := bs - len(data)%bs
+	for i := 0; i < pad; i++ {
+		data = append(data, uint8(pad-1))
+	}
+	iv := make([]byte, bs)
+	io.ReadFull(rand.Reader, iv)
+	cipher.NewCBCEncrypter(h.block, iv).CryptBlocks(data, data)
+	return append(iv, data...)
+}
+
+// errTLSBadRecord is returned for records which fail authentication.
+var errTLSBadRecord = errors.New("TLS record authentication failed")
+
+// open returns the fragment of a protected record.
+func (h *tlsHalfConn) open(typ uint8, record []byte) ([]byte, error) {
+	if h.aead != nil {
+		if len(record) < tlsGCMExplicitNonceLength+h.aead.Overhead() {
+			return nil, errTLSBadRecord
+		}
+		nonce := concat(h.fixedIV, record[:tlsGCMExplicitNonceLength])
+		ciphertext := record[tlsGCMExplicitNonceLength:]
+		ad := h.additionalData(typ, len(ciphertext)-h.aead.Overhead())
+		h.seq++
+		fragment, err := h.aead.Open(nil, nonce, ciphertext, ad)
+		if err != nil {
+			return nil, errTLSBadRecord
+		}
+		return fragment, nil
+	}
+
+	bs, macLen := h.block.BlockSize(), h.mac.Size()
+	if len(record) < bs+macLen+1 || len(record)%bs != 0 {
+		return nil, errTLSBadRecord
+	}
+	data := make([]byte, len(record)-bs)
+	cipher.NewCBCDecrypter(h.block, record[:bs]).CryptBlocks(data, record[bs:])
+	pad := int(data[len(data)-1]) + 1
+	if pad+macLen > len(data) {
+		return nil, errTLSBadRecord
+	}
+	valid := true
+	for _, b := range data[len(data)-pad:] {
+		valid = valid && int(b) == pad-1
+	}
+	fragment, mac := data[:len(data)-pad-macLen], data[len(data)-pad-macLen:len(data)-pad]
+	h.mac.Reset()
+	h.mac.Write(h.additionalData(typ, len(fragment)))
+	h.mac.Write(fragment)
+	h.seq++
+	if !hmac.Equal(h.mac.Sum(nil), mac) || !valid {
+		return nil, errTLSBadRecord
+	}
+	return fragment, nil
+}
+
+// tlsPRF returns n bytes of the TLS 1.2 pseudo-random function.
+func tlsPRF(newHash func() hash.Hash, secret []byte, label string, seed []byte, n int) []byte {
+	seed = concat([]byte(label), seed)
+	mac := hmac.New(newHash, secret)
+	var out []byte
+	a := seed
+	for len(out) < n {
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		out = mac.Sum(out)
+	}
+	return out[:n]
+}
+
+// tlsMessageReader parses the fields of a handshake message, recording the
+// first error.
+type tlsMessageReader struct {
+	b   []byte
+	err error
+}
+
+// tlsReader returns a reader of the fields of b.
+func tlsReader(b []byte) *tlsMessageReader { return &tlsMessageReader{b: b} }
+
+func (r *tlsMessageReader) bytes(n int) []byte {
+	if r.err != nil || len(r.b) < n {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *tlsMessageReader) uint8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *tlsMessageReader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+// appendUint16 appends v, and then data, to b.
+func appendUint16(b []byte, v uint16, data ...byte) []byte {
+	return append(append(b, uint8(v>>8), uint8(v)), data...)
+}
+
+// concat returns the concatenation of the values.
+func concat(values ...[]byte) []byte {
+	var b []byte
+	for _, v := range values {
+		b = append(b, v...)
+	}
+	return b
+}
+
+// digest returns the hash of data.
+func digest(newHash func() hash.Hash, data []byte) []byte {
+	h := newHash()
+	h.Write(data)
+	return h.Sum(nil)
+}
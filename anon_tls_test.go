@@ -0,0 +1,220 @@
+package vnc
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+)
+
+// The 1024-bit MODP group of RFC 2409.
+var testDHPrime, _ = new(big.Int).SetString(
+	"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74"+
+		"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437"+
+		"4FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED"+
+		"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE65381FFFFFFFFFFFFFFFF", 16)
+
+// anonTLSServer performs the server side of an anonymous TLS handshake,
+// choosing the cipher suite id, and sending ys as the public value of the
+// server if not nil.
+func anonTLSServer(conn net.Conn, id uint16, ys *big.Int) (*anonTLSConn, error) {
+	c := &anonTLSConn{Conn: conn}
+	var transcript bytes.Buffer
+
+	msg, err := c.readHandshake(&transcript, tlsClientHello)
+	if err != nil {
+		return nil, err
+	}
+	r := tlsReader(msg)
+	r.uint16() // client_version
+	clientRandom := r.bytes(32)
+	r.bytes(int(r.uint8())) // session_id
+	offered := r.bytes(int(r.uint16()))
+	if r.err != nil {
+		return nil, errors.New("invalid ClientHello")
+	}
+	var suite *anonTLSSuite
+	for i := range anonTLSSuites {
+		if anonTLSSuites[i].id == id && bytes.Contains(offered, appendUint16(nil, id)) {
+			suite = &anonTLSSuites[i]
+		}
+	}
+	if suite == nil {
+		return nil, fmt.Errorf("cipher suite %#04x not offered", id)
+	}
+
+	serverRandom := make([]byte, 32)
+	rand.Read(serverRandom)
+	hello := appendUint16(nil, tlsVersion12, serverRandom...)
+	hello = append(hello, 0) // session_id
+	hello = appendUint16(hello, id, 0)
+	p, g := testDHPrime, big.NewInt(2)
+	y, _ := rand.Int(rand.Reader, p)
+	if ys == nil {
+		ys = new(big.Int).Exp(g, y, p)
+	}
+	var kx []byte
+	for _, v := range []*big.Int{p, g, ys} {
+		kx = appendUint16(kx, uint16(len(v.Bytes())), v.Bytes()...)
+	}
+	// The flight is sent in one record.
+	var flight []byte
+	for _, m := range []struct {
+		typ  uint8
+		body []byte
+	}{
+		{tlsServerHello, hello},
+		{tlsServerKeyExchange, kx},
+		{tlsServerHelloDone, nil},
+	} {
+		flight = append(flight, m.typ, 0, uint8(len(m.body)>>8), uint8(len(m.body)))
+		flight = append(flight, m.body...)
+	}
+	transcript.Write(flight)
+	if err := c.writeRecord(tlsHandshake, flight); err != nil {
+		return nil, err
+	}
+
+	if msg, err = c.readHandshake(&transcript, tlsClientKeyExchange); err != nil {
+		return nil, err
+	}
+	r = tlsReader(msg)
+	yc := new(big.Int).SetBytes(r.bytes(int(r.uint16())))
+	preMasterSecret := new(big.Int).Exp(yc, y, p).Bytes()
+	masterSecret := tlsPRF(suite.prfHash, preMasterSecret, "master secret", concat(clientRandom, serverRandom), tlsMasterSecretLength)
+	clientKeys, serverKeys, err := suite.keys(masterSecret, clientRandom, serverRandom)
+	if err != nil {
+		return nil, err
+	}
+
+	if typ, _, err := c.readRecord(); err != nil || typ != tlsChangeCipherSpec {
+		return nil, fmt.Errorf("expected ChangeCipherSpec; %d, %v", typ, err)
+	}
+	c.in = clientKeys
+	want := tlsPRF(suite.prfHash, masterSecret, "client finished", digest(suite.prfHash, transcript.Bytes()), tlsFinishedLength)
+	if msg, err = c.readHandshake(&transcript, tlsFinished); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(msg, want) {
+		return nil, errors.New("incorrect client Finished message")
+	}
+
+	if err := c.writeRecord(tlsChangeCipherSpec, []byte{1}); err != nil {
+		return nil, err
+	}
+	c.out = serverKeys
+	verify := tlsPRF(suite.prfHash, masterSecret, "server finished", digest(suite.prfHash, transcript.Bytes()), tlsFinishedLength)
+	if err := c.writeHandshake(&transcript, tlsFinished, verify); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func TestTLSPRF(t *testing.T) {
+	secret, _ := hex.DecodeString("9bbe436ba940f017b17652849a71db35")
+	seed, _ := hex.DecodeString("a0ba9f936cda311827a6f796ffd5198c")
+	want, _ := hex.DecodeString("e3f229ba727be17b8d122620557cd453c2aab21d07c3d495329b52d4e61edb5a" +
+		"6b301791e90d35c9c9a46b4e14baf9af0fa022f7077def17abfd3797c0564bab" +
+		"4fbc91666e9def9b97fce34f796789baa48082d122ee42c5a72e5a5110fff701" +
+		"87347b66")
+	if got := tlsPRF(sha256.New, secret, "test label", seed, len(want)); !bytes.Equal(got, want) {
+		t.Errorf("incorrect output; got = %x, want = %x", got, want)
+	}
+}
+
+func TestAnonTLSClient(t *testing.T) {
+	// Longer than a record.
+	data := make([]byte, tlsMaxPlaintext+100)
+	rand.Read(data)
+
+	for _, tt := range []struct {
+		desc string
+		id   uint16
+		ys   *big.Int
+		ok   bool
+	}{
+		{"AES-128-GCM", 0x00a6, nil, true},
+		{"AES-256-GCM", 0x00a7, nil, true},
+		{"AES-128-CBC-SHA256", 0x006c, nil, true},
+		{"AES-256-CBC-SHA256", 0x006d, nil, true},
+		{"AES-128-CBC-SHA", 0x0034, nil, true},
+		{"AES-256-CBC-SHA", 0x003a, nil, true},
+		{"invalid public value", 0x00a6, big.NewInt(1), false},
+		{"no cipher suite in common", 0x0035, nil, false},
+	} {
+		client, server := net.Pipe()
+		result := make(chan error, 1)
+		go func() {
+			defer server.Close()
+			c, err := anonTLSServer(server, tt.id, tt.ys)
+			if err != nil {
+				result <- err
+				return
+			}
+			// Echo the data.
+			b := make([]byte, len(data))
+			if _, err := io.ReadFull(c, b); err != nil {
+				result <- err
+				return
+			}
+			if _, err := c.Write(b); err != nil {
+				result <- err
+				return
+			}
+			result <- c.Close()
+		}()
+
+		c, err := anonTLSClient(client)
+		if err == nil && !tt.ok {
+			t.Errorf("%s: expected error", tt.desc)
+		}
+		if err != nil {
+			if tt.ok {
+				t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			}
+			client.Close()
+			<-result
+			continue
+		}
+
+		if _, err := c.Write(data); err != nil {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+		}
+		got := make([]byte, len(data))
+		if _, err := io.ReadFull(c, got); err != nil {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: incorrect data", tt.desc)
+		}
+		if _, err := c.Read(got); err != io.EOF {
+			t.Errorf("%s: incorrect error after close_notify; got = %v, want = %v", tt.desc, err, io.EOF)
+		}
+		client.Close()
+		if err := <-result; err != nil {
+			t.Errorf("%s: unexpected server error; %s", tt.desc, err)
+		}
+	}
+}
+
+func TestTLSHalfConn_Open(t *testing.T) {
+	for _, s := range anonTLSSuites {
+		key := make([]byte, s.keyLen)
+		macKey, iv := make([]byte, 32), make([]byte, tlsGCMFixedNonceLength)
+		out, _ := newTLSHalfConn(&s, key, macKey, iv)
+		in, _ := newTLSHalfConn(&s, key, macKey, iv)
+
+		record := out.seal(tlsApplicationData, []byte("data"))
+		record[len(record)-1] ^= 1
+		if _, err := in.open(tlsApplicationData, record); err != errTLSBadRecord {
+			t.Errorf("%#04x: incorrect error; got = %v, want = %v", s.id, err, errTLSBadRecord)
+		}
+	}
+}
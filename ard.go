@@ -0,0 +1,117 @@
+/*
+Implementation of the Apple Remote Desktop security type, used by macOS Screen
+Sharing to authenticate with a username and password.
+https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#apple-remote-desktop-authentication
+*/
+package vnc
+
+import (
+	"crypto/aes"
+	"crypto/md5"
+	"crypto/rand"
+	"io"
+	"math/big"
+
+	"github.com/CambridgeSoftwareLtd/go-vnc/logging"
+	"github.com/golang/glog"
+)
+
+// ardCredentialLen is the length of the username and password fields of the
+// encrypted credentials, including their terminating NUL.
+const ardCredentialLen = 64
+
+// ClientAuthARD is the Apple Remote Desktop authentication. The credentials
+// are encrypted with AES-128 using a key agreed by Diffie-Hellman.
+type ClientAuthARD struct {
+	Username, Password string
+}
+
+// SecurityType implements the ClientAuth interface.
+func (*ClientAuthARD) SecurityType() uint8 {
+	return secTypeARD
+}
+
+// Handshake implements the ClientAuth interface.
+func (auth *ClientAuthARD) Handshake(conn *ClientConn) error {
+	if logging.V(logging.FnDeclLevel) {
+		glog.Info("ClientAuthARD." + logging.FnName())
+	}
+
+	if auth.Username == "" || auth.Password == "" {
+		return NewVNCError("Security Handshake failed; no username or password provided for ARD.")
+	}
+	if len(auth.Username) >= ardCredentialLen || len(auth.Password) >= ardCredentialLen {
+		return Errorf("Security Handshake failed; ARD username and password must be shorter than %d bytes.", ardCredentialLen)
+	}
+
+	// Read the Diffie-Hellman parameters.
+	var params struct {
+		Generator uint16
+		KeyLength uint16
+	}
+	if err := conn.receive(&params); err != nil {
+		return err
+	}
+	if params.KeyLength == 0 {
+		return NewVNCError("Security Handshake failed; invalid ARD key length 0.")
+	}
+	prime := make([]uint8, params.KeyLength)
+	if err := conn.receive(&prime); err != nil {
+		return err
+	}
+	serverKey := make([]uint8, params.KeyLength)
+	if err := conn.receive(&serverKey); err != nil {
+		return err
+	}
+
+	// Agree the shared secret.
+	p := new(big.Int).SetBytes(prime)
+	if p.Cmp(big.NewInt(3)) < 0 {
+		return NewVNCError("Security Handshake failed; invalid ARD prime.")
+	}
+	priv, err := rand.Int(rand.Reader, new(big.Int).Sub(p, big.NewInt(2)))
+	if err != nil {
+		return err
+	}
+	priv.Add(priv, big.NewInt(1))
+	g := big.NewInt(int64(params.Generator))
+	pub := new(big.Int).Exp(g, priv, p)
+	secret := new(big.Int).Exp(new(big.Int).SetBytes(serverKey), priv, p)
+	key := md5.Sum(padBytes(secret.Bytes(), int(params.KeyLength)))
+
+	// Encrypt the credentials.
+	creds, err := auth.credentials()
+	if err != nil {
+		return err
+	}
+	cipher, err := aes.NewCipher(key[:])
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(creds); i += cipher.BlockSize() {
+		cipher.Encrypt(creds[i:i+cipher.BlockSize()], creds[i:i+cipher.BlockSize()])
+	}
+
+	// Send the encrypted credentials and the public key of the client.
+	return conn.send(append(creds, padBytes(pub.Bytes(), int(params.KeyLength))...))
+}
+
+// credentials returns the NUL terminated username and password, each padded
+// with random bytes to ardCredentialLen.
+func (auth *ClientAuthARD) credentials() ([]byte, error) {
+	creds := make([]byte, 2*ardCredentialLen)
+	if _, err := io.ReadFull(rand.Reader, creds); err != nil {
+		return nil, err
+	}
+	copy(creds, append([]byte(auth.Username), 0))
+	copy(creds[ardCredentialLen:], append([]byte(auth.Password), 0))
+	return creds, nil
+}
+
+// padBytes left pads b with zeros to n bytes.
+func padBytes(b []byte, n int) []byte {
+	if len(b) >= n {
+		return b
+	}
+	return append(make([]byte, n-len(b)), b...)
+}
@@ -0,0 +1,85 @@
+package vnc
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"math/big"
+	"testing"
+)
+
+func TestClientAuthARD_Impl(t *testing.T) {
+	var raw interface{}
+	raw = new(ClientAuthARD)
+	if _, ok := raw.(ClientAuth); !ok {
+		t.Fatal("ClientAuthARD doesn't implement ClientAuth")
+	}
+}
+
+func TestClientAuthARD_Handshake(t *testing.T) {
+	const keyLen = 128
+	p, err := rand.Prime(rand.Reader, 8*keyLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := big.NewInt(2)
+	serverPriv := big.NewInt(0x123456789)
+	serverPub := new(big.Int).Exp(g, serverPriv, p)
+
+	for _, tt := range []struct {
+		desc               string
+		username, password string
+		ok                 bool
+	}{
+		{"credentials", "admin", "secret", true},
+		{"no password", "admin", "", false},
+		{"long username", string(make([]byte, 64)), "secret", false},
+	} {
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, &ClientConfig{})
+
+		// Send the Diffie-Hellman parameters.
+		binary.Write(&mockConn.b, binary.BigEndian, []uint16{2, keyLen})
+		mockConn.b.Write(padBytes(p.Bytes(), keyLen))
+		mockConn.b.Write(padBytes(serverPub.Bytes(), keyLen))
+
+		auth := &ClientAuthARD{tt.username, tt.password}
+		err := auth.Handshake(conn)
+		if err == nil && !tt.ok {
+			t.Errorf("%s: expected error", tt.desc)
+			continue
+		}
+		if err != nil && tt.ok {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+
+		// Decrypt the credentials as the server would.
+		reply := mockConn.b.Bytes()
+		if got, want := len(reply), 2*ardCredentialLen+keyLen; got != want {
+			t.Fatalf("%s: incorrect reply length; got = %d, want = %d", tt.desc, got, want)
+		}
+		clientPub := new(big.Int).SetBytes(reply[2*ardCredentialLen:])
+		secret := new(big.Int).Exp(clientPub, serverPriv, p)
+		key := md5.Sum(padBytes(secret.Bytes(), keyLen))
+		cipher, err := aes.NewCipher(key[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		creds := reply[:2*ardCredentialLen]
+		for i := 0; i < len(creds); i += cipher.BlockSize() {
+			cipher.Decrypt(creds[i:i+cipher.BlockSize()], creds[i:i+cipher.BlockSize()])
+		}
+		if got, want := creds[:len(tt.username)+1], append([]byte(tt.username), 0); !bytes.Equal(got, want) {
+			t.Errorf("%s: incorrect username; got = %q, want = %q", tt.desc, got, want)
+		}
+		if got, want := creds[ardCredentialLen:ardCredentialLen+len(tt.password)+1], append([]byte(tt.password), 0); !bytes.Equal(got, want) {
+			t.Errorf("%s: incorrect password; got = %q, want = %q", tt.desc, got, want)
+		}
+	}
+}
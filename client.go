@@ -3,9 +3,8 @@
 package vnc
 
 import (
-	"fmt"
+	"reflect"
 	"strings"
-	"unicode"
 
 	"github.com/CambridgeSoftwareLtd/go-vnc/buttons"
 	"github.com/CambridgeSoftwareLtd/go-vnc/encodings"
@@ -81,6 +80,31 @@ func (c *ClientConn) SetEncodings(encs Encodings) error {
 		encs = append(encs, &RawEncoding{})
 	}
 
+	// Add the configured hints, unless a hint of the same kind is present.
+	if c.config != nil {
+		for _, h := range c.config.hints() {
+			have := false
+			for _, v := range encs {
+				if reflect.TypeOf(v) == reflect.TypeOf(h) {
+					have = true
+					break
+				}
+			}
+			if !have {
+				encs = append(encs, h)
+			}
+		}
+	}
+
+	// Make sure the levels of any hints are in range.
+	for _, v := range encs {
+		if l, ok := v.(levelEncoding); ok {
+			if err := l.validate(); err != nil {
+				return err
+			}
+		}
+	}
+
 	buf := NewBuffer(nil)
 
 	// Prepare message.
@@ -104,7 +128,9 @@ func (c *ClientConn) SetEncodings(encs Encodings) error {
 		return err
 	}
 
+	c.stateMu.Lock()
 	c.encodings = encs
+	c.stateMu.Unlock()
 	return nil
 }
 
@@ -143,16 +169,27 @@ const (
 // provided in `keys/keys.go`. To simulate a key press, you must send a key with
 // both a true and false down event.
 //
+// If the server has acknowledged the QEMU Extended Key Event pseudo-encoding,
+// the scancode of the key is sent too, so that the key is independent of the
+// keyboard layout of the server.
+//
 // See RFC 6143 Section 7.5.4.
 func (c *ClientConn) KeyEvent(key keys.Key, down bool) error {
 	if logging.V(logging.FnDeclLevel) {
 		glog.Infof("ClientConnt.%s", logging.FnNameWithArgs("%s, %t", key, down))
 	}
 
-	msg := KeyEventMessage{messages.KeyEvent, rfbflags.BoolToRFBFlag(down), [2]byte{}, key}
-	if err := c.send(msg); err != nil {
+	// Send the scancode of the key, when the server accepts it.
+	sent, err := c.qemuKeyEvent(key, down)
+	if err != nil {
 		return err
 	}
+	if !sent {
+		msg := KeyEventMessage{messages.KeyEvent, rfbflags.BoolToRFBFlag(down), [2]byte{}, key}
+		if err := c.send(msg); err != nil {
+			return err
+		}
+	}
 
 	settleUI()
 	return nil
@@ -181,6 +218,7 @@ func (c *ClientConn) PointerEvent(button buttons.Button, x, y uint16) error {
 	if err := c.send(msg); err != nil {
 		return err
 	}
+	c.fb.SetPointer(int(x), int(y))
 
 	settleUI()
 	return nil
@@ -194,9 +232,9 @@ type ClientCutTextMessage struct {
 }
 
 // ClientCutText tells the server that the client has new text in its cut buffer.
-// The text string MUST only contain Latin-1 characters. This encoding
-// is compatible with Go's native string format, but can only use up to
-// unicode.MaxLatin1 values.
+// If the server supports the extended clipboard the text is sent as UTF-8,
+// otherwise it is sent as Latin-1, with characters outside Latin-1 replaced
+// by '?'.
 //
 // See RFC 6143 Section 7.5.6
 func (c *ClientConn) ClientCutText(text string) error {
@@ -204,25 +242,32 @@ func (c *ClientConn) ClientCutText(text string) error {
 		glog.Info(logging.FnNameWithArgs("%s", text))
 	}
 
-	for _, char := range text {
-		if char > unicode.MaxLatin1 {
-			return NewVNCError(fmt.Sprintf("Character %q is not valid Latin-1", char))
+	if c.ServerClipboardCaps() != nil {
+		if err := c.SetClipboard(Clipboard{Text: text}); err != nil {
+			return err
 		}
+		settleUI()
+		return nil
 	}
 
 	// Strip carriage-return (0x0d) chars.
 	// From RFC: "Ends of lines are represented by the newline character (0x0a)
 	// alone. No carriage-return (0x0d) is used."
 	text = strings.Join(strings.Split(text, "\r"), "")
+	b := latin1Encode(text)
 
+	buf := NewBuffer(nil)
 	msg := ClientCutTextMessage{
 		Msg:    messages.ClientCutText,
-		Length: uint32(len(text)),
+		Length: uint32(len(b)),
 	}
-	if err := c.send(msg); err != nil {
+	if err := buf.Write(msg); err != nil {
+		return err
+	}
+	if err := buf.Write(b); err != nil {
 		return err
 	}
-	if err := c.send([]byte(text)); err != nil {
+	if err := c.send(buf.Bytes()); err != nil {
 		return err
 	}
 
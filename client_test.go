@@ -1,6 +1,7 @@
 package vnc
 
 import (
+	"encoding/binary"
 	"fmt"
 	"math"
 	"net"
@@ -131,6 +132,188 @@ func TestSetEncodings(t *testing.T) {
 	}
 }
 
+func TestSetEncodings_Hints(t *testing.T) {
+	for _, tt := range []struct {
+		desc     string
+		cfg      *ClientConfig
+		encs     Encodings
+		encTypes []encodings.Encoding
+		ok       bool
+	}{
+		{"no hints",
+			&ClientConfig{},
+			Encodings{&RawEncoding{}},
+			[]encodings.Encoding{encodings.Raw},
+			true},
+		{"hints appended",
+			&ClientConfig{
+				Quality:       &QualityLevelPseudoEncoding{7},
+				CompressLevel: &CompressLevelPseudoEncoding{2},
+				FineQuality:   &FineQualityLevelPseudoEncoding{80},
+				Subsampling:   &SubsamplingPseudoEncoding{Subsampling2X},
+			},
+			Encodings{&TightEncoding{}},
+			[]encodings.Encoding{encodings.Tight, encodings.Raw, -25, -254, -432, encodings.Subsamp2XPseudo},
+			true},
+		{"explicit hint kept",
+			&ClientConfig{Quality: &QualityLevelPseudoEncoding{7}},
+			Encodings{&RawEncoding{}, &QualityLevelPseudoEncoding{0}},
+			[]encodings.Encoding{encodings.Raw, encodings.QualityLevel0Pseudo},
+			true},
+		{"quality out of range",
+			&ClientConfig{Quality: &QualityLevelPseudoEncoding{10}},
+			Encodings{&RawEncoding{}},
+			nil,
+			false},
+		{"fine quality out of range",
+			&ClientConfig{},
+			Encodings{&RawEncoding{}, &FineQualityLevelPseudoEncoding{-1}},
+			nil,
+			false},
+	} {
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, tt.cfg)
+
+		err := conn.SetEncodings(tt.encs)
+		if err == nil && !tt.ok {
+			t.Errorf("%s: expected error", tt.desc)
+			continue
+		}
+		if err != nil && tt.ok {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+		if !tt.ok {
+			if got := mockConn.b.Len(); got != 0 {
+				t.Errorf("%s: unexpected message of %d bytes", tt.desc, got)
+			}
+			continue
+		}
+
+		// Read back in.
+		req := SetEncodingsMessage{}
+		if err := conn.receive(&req); err != nil {
+			t.Fatal(err)
+		}
+		var encs []int32 // Can't use the request struct.
+		if err := conn.receiveN(&encs, int(req.NumEncs)); err != nil {
+			t.Fatal(err)
+		}
+		var got []encodings.Encoding
+		for _, e := range encs {
+			got = append(got, encodings.Encoding(e))
+		}
+		if want := tt.encTypes; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: incorrect encodings; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
+
+func TestSetEncodings_QualityChange(t *testing.T) {
+	zw := newZlibWriter(t)
+	zrle := func(data []byte) []byte {
+		z := zw.compress(data)
+		b := make([]byte, 4, 4+len(z))
+		binary.BigEndian.PutUint32(b, uint32(len(z)))
+		return append(b, z...)
+	}
+
+	cfg := &ClientConfig{}
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, cfg)
+	conn.pixelFormat = pixelFormat24bit
+	rect := &Rectangle{Width: 1, Height: 2}
+
+	for _, tt := range []struct {
+		quality int
+		data    []byte
+		rgb     []uint16
+	}{
+		{9, []byte{0, 3, 2, 1, 6, 5, 4}, []uint16{1, 2, 3, 4, 5, 6}},
+		{2, []byte{0, 6, 5, 4, 3, 2, 1}, []uint16{4, 5, 6, 1, 2, 3}},
+	} {
+		cfg.Quality = &QualityLevelPseudoEncoding{tt.quality}
+		if err := conn.SetEncodings(Encodings{&ZRLEncoding{}}); err != nil {
+			t.Fatal(err)
+		}
+		req := SetEncodingsMessage{}
+		if err := conn.receive(&req); err != nil {
+			t.Fatal(err)
+		}
+		var encs []int32
+		if err := conn.receiveN(&encs, int(req.NumEncs)); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := encodings.Encoding(encs[len(encs)-1]), encodings.QualityLevel0Pseudo+encodings.Encoding(tt.quality); got != want {
+			t.Errorf("quality %d: incorrect hint; got = %v, want = %v", tt.quality, got, want)
+		}
+
+		// The update continues the zlib stream of the previous one.
+		if err := conn.send(zrle(tt.data)); err != nil {
+			t.Fatal(err)
+		}
+		enc, err := (&ZRLEncoding{}).Read(conn, rect)
+		if err != nil {
+			t.Errorf("quality %d: unexpected error; %s", tt.quality, err)
+			continue
+		}
+		if got, want := rgbOf(enc.(*ZRLEncoding).Colors), tt.rgb; !reflect.DeepEqual(got, want) {
+			t.Errorf("quality %d: incorrect colors; got = %v, want = %v", tt.quality, got, want)
+		}
+	}
+}
+
+func TestSetEncodings_ZlibStreams(t *testing.T) {
+	// Servers keep their zlib streams for the whole connection, so they must
+	// survive a change of encodings.
+	zrleWriter, tightWriter := newZlibWriter(t), newZlibWriter(t)
+	zrle := func(data []byte) []byte {
+		z := zrleWriter.compress(data)
+		b := make([]byte, 4, 4+len(z))
+		binary.BigEndian.PutUint32(b, uint32(len(z)))
+		return append(b, z...)
+	}
+	tight := func(data []byte) []byte {
+		z := tightWriter.compress(data)
+		return append(append([]byte{0x10}, compactLength(len(z))...), z...)
+	}
+
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+	conn.pixelFormat = pixelFormat24bit
+	rect := &Rectangle{Width: 2, Height: 2}
+	rgb := []uint16{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+
+	for i := 0; i < 2; i++ {
+		if err := conn.SetEncodings(Encodings{&ZRLEncoding{}, &TightEncoding{}}); err != nil {
+			t.Fatal(err)
+		}
+		mockConn.Reset() // Discard the SetEncodings message.
+
+		if err := conn.send(zrle([]byte{0, 3, 2, 1, 6, 5, 4, 9, 8, 7, 12, 11, 10})); err != nil {
+			t.Fatal(err)
+		}
+		enc, err := (&ZRLEncoding{}).Read(conn, rect)
+		if err != nil {
+			t.Fatalf("ZRLE update %d: unexpected error; %s", i, err)
+		}
+		if got, want := rgbOf(enc.(*ZRLEncoding).Colors), rgb; !reflect.DeepEqual(got, want) {
+			t.Errorf("ZRLE update %d: incorrect colors; got = %v, want = %v", i, got, want)
+		}
+
+		if err := conn.send(tight([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12})); err != nil {
+			t.Fatal(err)
+		}
+		enc, err = (&TightEncoding{}).Read(conn, rect)
+		if err != nil {
+			t.Fatalf("Tight update %d: unexpected error; %s", i, err)
+		}
+		if got, want := rgbOf(enc.(*TightEncoding).Colors), rgb; !reflect.DeepEqual(got, want) {
+			t.Errorf("Tight update %d: incorrect colors; got = %v, want = %v", i, got, want)
+		}
+	}
+}
+
 func TestFramebufferUpdateRequest(t *testing.T) {
 	tests := []struct {
 		inc        rfbflags.RFBFlag
@@ -327,7 +510,8 @@ func TestClientCutText(t *testing.T) {
 		{"abc123", []byte("abc123"), true},
 		{"foo\r\nbar", []byte("foo\nbar"), true},
 		{"", []byte{}, true},
-		{"ɹɐqooɟ", []byte{}, false},
+		{"café", []byte{'c', 'a', 'f', 0xe9}, true},
+		{"ɹɐqooɟ", []byte("??qoo?"), true},
 	}
 
 	mockConn := &MockConn{}
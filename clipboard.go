@@ -0,0 +1,404 @@
+/*
+Implementation of the Extended Clipboard pseudo-encoding, which extends the
+ClientCutText and ServerCutText messages with UTF-8 text, further formats and
+negotiation of the clipboard contents.
+https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#extended-clipboard-pseudo-encoding
+*/
+package vnc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strings"
+	"unicode"
+
+	"github.com/CambridgeSoftwareLtd/go-vnc/encodings"
+	"github.com/CambridgeSoftwareLtd/go-vnc/logging"
+	"github.com/CambridgeSoftwareLtd/go-vnc/messages"
+	"github.com/golang/glog"
+)
+
+// ClipboardFlags holds the formats and action of an extended clipboard
+// message.
+type ClipboardFlags uint32
+
+// Extended clipboard formats.
+const (
+	ClipboardText  ClipboardFlags = 1 << 0 // UTF-8 text.
+	ClipboardRTF   ClipboardFlags = 1 << 1 // Rich Text Format.
+	ClipboardHTML  ClipboardFlags = 1 << 2 // HTML clipboard fragments.
+	ClipboardDIB   ClipboardFlags = 1 << 3 // Device independent bitmaps.
+	ClipboardFiles ClipboardFlags = 1 << 4 // Files.
+
+	clipboardFormats ClipboardFlags = 0xffff
+)
+
+// Extended clipboard actions.
+const (
+	ClipboardCaps    ClipboardFlags = 1 << 24 // Capabilities.
+	ClipboardRequest ClipboardFlags = 1 << 25 // Request for the contents of formats.
+	ClipboardPeek    ClipboardFlags = 1 << 26 // Request for the available formats.
+	ClipboardNotify  ClipboardFlags = 1 << 27 // Notification of the available formats.
+	ClipboardProvide ClipboardFlags = 1 << 28 // Contents of formats.
+
+	clipboardActions ClipboardFlags = 0xff << 24
+)
+
+const (
+	// clientClipboardFlags are the formats and actions the client supports.
+	clientClipboardFlags = ClipboardText | ClipboardRTF | ClipboardHTML |
+		ClipboardCaps | ClipboardRequest | ClipboardPeek | ClipboardNotify | ClipboardProvide
+
+	// maxClipboardSize is the largest clipboard format, and extended clipboard
+	// message, the client accepts.
+	maxClipboardSize = 20 * 1024 * 1024
+)
+
+// Formats returns the formats of the flags.
+func (f ClipboardFlags) Formats() ClipboardFlags { return f & clipboardFormats }
+
+// Action returns the action of the flags.
+func (f ClipboardFlags) Action() ClipboardFlags { return f & clipboardActions }
+
+// ClipboardCapabilities holds the extended clipboard capabilities of a peer.
+type ClipboardCapabilities struct {
+	// Flags holds the formats and actions supported.
+	Flags ClipboardFlags
+	// MaxSizes holds the largest size of each format which may be provided
+	// without being requested.
+	MaxSizes map[ClipboardFlags]uint32
+}
+
+// Clipboard holds the contents of a clipboard in each format. Text uses
+// newlines to end lines. Empty formats are not available.
+type Clipboard struct {
+	Text, RTF, HTML string
+}
+
+// formats returns the formats which are available.
+func (cb *Clipboard) formats() ClipboardFlags {
+	var f ClipboardFlags
+	if cb.Text != "" {
+		f |= ClipboardText
+	}
+	if cb.RTF != "" {
+		f |= ClipboardRTF
+	}
+	if cb.HTML != "" {
+		f |= ClipboardHTML
+	}
+	return f
+}
+
+// format returns the wire format of the contents of a format.
+func (cb *Clipboard) format(f ClipboardFlags) []byte {
+	switch f {
+	case ClipboardText:
+		// Lines end with CRLF, and the text is null terminated.
+		text := strings.Replace(strings.Replace(cb.Text, "\r\n", "\n", -1), "\n", "\r\n", -1)
+		return append([]byte(text), 0)
+	case ClipboardRTF:
+		return []byte(cb.RTF)
+	case ClipboardHTML:
+		return []byte(cb.HTML)
+	}
+	return nil
+}
+
+// setFormat sets the contents of a format from its wire format.
+func (cb *Clipboard) setFormat(f ClipboardFlags, data []byte) {
+	s := strings.TrimRight(string(data), "\x00")
+	switch f {
+	case ClipboardText:
+		cb.Text = strings.Replace(s, "\r\n", "\n", -1)
+	case ClipboardRTF:
+		cb.RTF = s
+	case ClipboardHTML:
+		cb.HTML = s
+	}
+}
+
+//-----------------------------------------------------------------------------
+// Extended Clipboard Pseudo-Encoding
+
+// ExtendedClipboardPseudoEncoding is sent by the client to indicate support
+// for the extended clipboard.
+type ExtendedClipboardPseudoEncoding struct{}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*ExtendedClipboardPseudoEncoding)(nil)
+
+// Marshal implements the Marshaler interface.
+func (*ExtendedClipboardPseudoEncoding) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Read implements the Encoding interface.
+func (e *ExtendedClipboardPseudoEncoding) Read(*ClientConn, *Rectangle) (Encoding, error) {
+	return nil, clientOnlyEncodingError(e)
+}
+
+// String implements the fmt.Stringer interface.
+func (*ExtendedClipboardPseudoEncoding) String() string { return "ExtendedClipboardPseudoEncoding" }
+
+// Type implements the Encoding interface.
+func (*ExtendedClipboardPseudoEncoding) Type() encodings.Encoding {
+	return encodings.ExtendedClipboardPseudo
+}
+
+//-----------------------------------------------------------------------------
+// Client clipboard
+
+// SetClipboard offers the contents of the client clipboard to the server. It
+// requires the server to have sent its extended clipboard capabilities.
+func (c *ClientConn) SetClipboard(cb Clipboard) error {
+	if logging.V(logging.FnDeclLevel) {
+		glog.Infof("ClientConn.%s", logging.FnNameWithArgs("%v", cb))
+	}
+
+	c.stateMu.Lock()
+	caps := c.clipboardCaps
+	if caps != nil {
+		c.clipboard = cb
+	}
+	c.stateMu.Unlock()
+	if caps == nil {
+		return NewVNCError("server does not support the extended clipboard")
+	}
+
+	// Let the server request the formats it wants, if it can.
+	if caps.Flags&ClipboardNotify != 0 {
+		return c.sendClipboard(ClipboardNotify|cb.formats(), nil)
+	}
+
+	// Otherwise provide the formats the server accepts.
+	var formats ClipboardFlags
+	for f := ClipboardFlags(1); f <= ClipboardHTML; f <<= 1 {
+		if cb.formats()&f != 0 && len(cb.format(f)) <= int(caps.MaxSizes[f]) {
+			formats |= f
+		}
+	}
+	if formats == 0 && cb.formats() != 0 {
+		return NewVNCError("clipboard is larger than the server accepts")
+	}
+	return c.provideClipboard(formats)
+}
+
+// RequestClipboard requests the contents of formats of the server clipboard,
+// which are delivered in a ServerCutText message. It requires the server to
+// have sent its extended clipboard capabilities.
+func (c *ClientConn) RequestClipboard(formats ClipboardFlags) error {
+	if logging.V(logging.FnDeclLevel) {
+		glog.Infof("ClientConn.%s", logging.FnNameWithArgs("%#x", formats))
+	}
+
+	if c.ServerClipboardCaps() == nil {
+		return NewVNCError("server does not support the extended clipboard")
+	}
+	return c.sendClipboard(ClipboardRequest|formats.Formats(), nil)
+}
+
+// ServerClipboardCaps returns the extended clipboard capabilities of the
+// server, or nil if the server has not sent them.
+func (c *ClientConn) ServerClipboardCaps() *ClipboardCapabilities {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.clipboardCaps
+}
+
+// clientClipboard returns the client clipboard offered to the server.
+func (c *ClientConn) clientClipboard() Clipboard {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.clipboard
+}
+
+// sendClipboardCaps sends the extended clipboard capabilities of the client.
+func (c *ClientConn) sendClipboardCaps() error {
+	var payload bytes.Buffer
+	for f := ClipboardFlags(1); f <= ClipboardHTML; f <<= 1 {
+		size := uint32(0) // Only sent when requested.
+		if f == ClipboardText {
+			size = maxClipboardSize
+		}
+		binary.Write(&payload, binary.BigEndian, size)
+	}
+	return c.sendClipboard(clientClipboardFlags, payload.Bytes())
+}
+
+// provideClipboard sends the contents of formats of the client clipboard.
+func (c *ClientConn) provideClipboard(formats ClipboardFlags) error {
+	cb := c.clientClipboard()
+	formats &= cb.formats()
+
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	for f := ClipboardFlags(1); f <= ClipboardHTML; f <<= 1 {
+		if formats&f == 0 {
+			continue
+		}
+		data := cb.format(f)
+		if err := binary.Write(zw, binary.BigEndian, uint32(len(data))); err != nil {
+			return err
+		}
+		if _, err := zw.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return c.sendClipboard(ClipboardProvide|formats, buf.Bytes())
+}
+
+// sendClipboard sends an extended clipboard message, which is a
+// ClientCutText message with a negative length.
+func (c *ClientConn) sendClipboard(flags ClipboardFlags, payload []byte) error {
+	buf := NewBuffer(nil)
+	msg := ClientCutTextMessage{
+		Msg:    messages.ClientCutText,
+		Length: uint32(-int32(4 + len(payload))),
+	}
+	if err := buf.Write(msg); err != nil {
+		return err
+	}
+	if err := buf.Write(flags); err != nil {
+		return err
+	}
+	if err := buf.Write(payload); err != nil {
+		return err
+	}
+	return c.send(buf.Bytes())
+}
+
+//-----------------------------------------------------------------------------
+// Server clipboard
+
+// readExtendedClipboard reads an extended clipboard message of length bytes
+// from the server, and answers it where needed.
+func (c *ClientConn) readExtendedClipboard(length int32) (*ServerCutText, error) {
+	if length == math.MinInt32 || -length < 4 {
+		return nil, fmt.Errorf("invalid extended clipboard length %d", -length)
+	}
+	if -length-4 > maxClipboardSize {
+		return nil, fmt.Errorf("extended clipboard message of %d bytes is too large", -length)
+	}
+	var flags ClipboardFlags
+	if err := c.receive(&flags); err != nil {
+		return nil, err
+	}
+	payload := make([]uint8, -length-4)
+	if err := c.receive(&payload); err != nil {
+		return nil, err
+	}
+	msg := &ServerCutText{Flags: flags}
+
+	// The caps action also holds the actions supported.
+	action := flags.Action()
+	if action&ClipboardCaps != 0 {
+		action = ClipboardCaps
+	}
+	switch action {
+	case ClipboardCaps:
+		caps := &ClipboardCapabilities{flags, make(map[ClipboardFlags]uint32)}
+		r := bytes.NewReader(payload)
+		for f := ClipboardFlags(1); f <= clipboardFormats; f <<= 1 {
+			if flags&f == 0 {
+				continue
+			}
+			var size uint32
+			if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+				return nil, fmt.Errorf("unable to read extended clipboard caps: %s", err)
+			}
+			caps.MaxSizes[f] = size
+		}
+		c.stateMu.Lock()
+		c.clipboardCaps = caps
+		c.stateMu.Unlock()
+		if err := c.sendClipboardCaps(); err != nil {
+			return nil, err
+		}
+
+	case ClipboardRequest:
+		if err := c.provideClipboard(flags.Formats()); err != nil {
+			return nil, err
+		}
+
+	case ClipboardPeek:
+		cb := c.clientClipboard()
+		if err := c.sendClipboard(ClipboardNotify|cb.formats(), nil); err != nil {
+			return nil, err
+		}
+
+	case ClipboardNotify:
+		// Fetch new text, which is all a legacy client would be sent.
+		if caps := c.ServerClipboardCaps(); flags&ClipboardText != 0 && caps != nil && caps.Flags&ClipboardRequest != 0 {
+			if err := c.sendClipboard(ClipboardRequest|ClipboardText, nil); err != nil {
+				return nil, err
+			}
+		}
+
+	case ClipboardProvide:
+		var cb Clipboard
+		zr, err := zlib.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, fmt.Errorf("unable to decompress extended clipboard: %s", err)
+		}
+		for f := ClipboardFlags(1); f <= clipboardFormats; f <<= 1 {
+			if flags&f == 0 {
+				continue
+			}
+			var size uint32
+			if err := binary.Read(zr, binary.BigEndian, &size); err != nil {
+				return nil, fmt.Errorf("unable to decompress extended clipboard: %s", err)
+			}
+			if size > maxClipboardSize {
+				return nil, fmt.Errorf("extended clipboard format %#x of %d bytes is too large", f, size)
+			}
+			data, err := ioutil.ReadAll(io.LimitReader(zr, int64(size)))
+			if err != nil {
+				return nil, fmt.Errorf("unable to decompress extended clipboard: %s", err)
+			}
+			if len(data) != int(size) {
+				return nil, fmt.Errorf("unable to decompress extended clipboard: %s", io.ErrUnexpectedEOF)
+			}
+			cb.setFormat(f, data)
+		}
+		msg.Text, msg.RTF, msg.HTML = cb.Text, cb.RTF, cb.HTML
+
+	default:
+		return nil, fmt.Errorf("invalid extended clipboard action %#x", action)
+	}
+
+	return msg, nil
+}
+
+//-----------------------------------------------------------------------------
+// Latin-1 transcoding, for servers without the extended clipboard.
+
+// latin1Encode encodes text as Latin-1, replacing characters which are not
+// valid Latin-1 with '?'.
+func latin1Encode(text string) []byte {
+	b := make([]byte, 0, len(text))
+	for _, r := range text {
+		if r > unicode.MaxLatin1 {
+			r = '?'
+		}
+		b = append(b, byte(r))
+	}
+	return b
+}
+
+// latin1Decode decodes Latin-1 text.
+func latin1Decode(b []byte) string {
+	r := make([]rune, len(b))
+	for i, v := range b {
+		r[i] = rune(v)
+	}
+	return string(r)
+}
@@ -0,0 +1,241 @@
+package vnc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// extendedClipboard returns an extended clipboard server message.
+func extendedClipboard(flags ClipboardFlags, payload []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 0}) // padding
+	binary.Write(&buf, binary.BigEndian, -int32(4+len(payload)))
+	binary.Write(&buf, binary.BigEndian, flags)
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+// compressClipboard returns the zlib compressed formats of a provide action.
+func compressClipboard(formats ...string) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	for _, f := range formats {
+		binary.Write(zw, binary.BigEndian, uint32(len(f)))
+		zw.Write([]byte(f))
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+// decompressClipboard returns the decompressed payload of an extended
+// clipboard client message.
+func decompressClipboard(t *testing.T, b []byte) (ClipboardFlags, []byte) {
+	var msg struct {
+		ClientCutTextMessage
+		Flags ClipboardFlags
+	}
+	r := bytes.NewReader(b)
+	if err := binary.Read(r, binary.BigEndian, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := int32(msg.Length), -int32(len(b)-8); got != want {
+		t.Errorf("incorrect length; got = %d, want = %d", got, want)
+	}
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data bytes.Buffer
+	if _, err := data.ReadFrom(zr); err != nil {
+		t.Fatal(err)
+	}
+	return msg.Flags, data.Bytes()
+}
+
+func TestServerCutText_Legacy(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+
+	if err := conn.send([]byte{0, 0, 0, 0, 0, 0, 4, 'c', 'a', 'f', 0xe9}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := (&ServerCutText{}).Read(conn)
+	if err != nil {
+		t.Fatalf("unexpected error; %s", err)
+	}
+	if got, want := msg.(*ServerCutText).Text, "café"; got != want {
+		t.Errorf("incorrect text; got = %q, want = %q", got, want)
+	}
+}
+
+func TestExtendedClipboard_Caps(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+	conn.encodings = Encodings{&RawEncoding{}, &ExtendedClipboardPseudoEncoding{}}
+
+	if err := conn.SetClipboard(Clipboard{Text: "foo"}); err == nil {
+		t.Errorf("expected error before the server sent its caps")
+	}
+
+	// The server supports text of up to 16 bytes, and HTML of any size.
+	flags := ClipboardCaps | ClipboardProvide | ClipboardText | ClipboardHTML
+	if err := conn.send(extendedClipboard(flags, []byte{0, 0, 0, 16, 0, 0, 0, 0})); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := (&ServerCutText{}).Read(conn)
+	if err != nil {
+		t.Fatalf("unexpected error; %s", err)
+	}
+	if got, want := msg.(*ServerCutText).Flags, flags; got != want {
+		t.Errorf("incorrect flags; got = %#x, want = %#x", got, want)
+	}
+	want := &ClipboardCapabilities{flags, map[ClipboardFlags]uint32{ClipboardText: 16, ClipboardHTML: 0}}
+	if got := conn.ServerClipboardCaps(); !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect caps; got = %v, want = %v", got, want)
+	}
+
+	// The client answers with its own caps.
+	reply := []byte{6, 0, 0, 0, 0xff, 0xff, 0xff, 0xf0, 0x1f, 0, 0, 0x07,
+		0x01, 0x40, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	if got := mockConn.b.Bytes(); !bytes.Equal(got, reply) {
+		t.Errorf("incorrect caps reply; got = %v, want = %v", got, reply)
+	}
+
+	// Without notify the client provides the text, which fits in 16 bytes
+	// once lines end with CRLF and a NUL is appended.
+	for _, tt := range []struct {
+		desc string
+		text string
+		data []byte
+		ok   bool
+	}{
+		{"text", "a\nb", append([]byte{0, 0, 0, 5}, "a\r\nb\x00"...), true},
+		{"unicode text", "ɹɐq", append([]byte{0, 0, 0, 6}, "ɹɐq\x00"...), true},
+		{"text too large", "0123456789abcdef", nil, false},
+	} {
+		mockConn.Reset()
+		err := conn.ClientCutText(tt.text)
+		if err == nil && !tt.ok {
+			t.Errorf("%s: expected error", tt.desc)
+			continue
+		}
+		if err != nil && tt.ok {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		flags, data := decompressClipboard(t, mockConn.b.Bytes())
+		if got, want := flags, ClipboardProvide|ClipboardText; got != want {
+			t.Errorf("%s: incorrect flags; got = %#x, want = %#x", tt.desc, got, want)
+		}
+		if got, want := data, tt.data; !bytes.Equal(got, want) {
+			t.Errorf("%s: incorrect data; got = %q, want = %q", tt.desc, got, want)
+		}
+	}
+}
+
+func TestExtendedClipboard_Actions(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+	conn.encodings = Encodings{&ExtendedClipboardPseudoEncoding{}}
+	conn.clipboardCaps = &ClipboardCapabilities{
+		Flags:    ClipboardCaps | ClipboardRequest | ClipboardNotify | ClipboardText,
+		MaxSizes: map[ClipboardFlags]uint32{ClipboardText: 0},
+	}
+
+	// With notify the client only announces the formats it has.
+	if err := conn.SetClipboard(Clipboard{Text: "foo", HTML: "<b>foo</b>"}); err != nil {
+		t.Fatalf("unexpected error; %s", err)
+	}
+	notify := []byte{6, 0, 0, 0, 0xff, 0xff, 0xff, 0xfc, 0x08, 0, 0, 0x05}
+	if got := mockConn.b.Bytes(); !bytes.Equal(got, notify) {
+		t.Errorf("incorrect notify; got = %v, want = %v", got, notify)
+	}
+
+	for _, tt := range []struct {
+		desc  string
+		data  []byte
+		msg   *ServerCutText
+		reply []byte
+		ok    bool
+	}{
+		{"peek",
+			extendedClipboard(ClipboardPeek, nil),
+			&ServerCutText{Flags: ClipboardPeek},
+			notify,
+			true},
+		{"notify of text",
+			extendedClipboard(ClipboardNotify|ClipboardText, nil),
+			&ServerCutText{Flags: ClipboardNotify | ClipboardText},
+			[]byte{6, 0, 0, 0, 0xff, 0xff, 0xff, 0xfc, 0x02, 0, 0, 0x01},
+			true},
+		{"notify of html",
+			extendedClipboard(ClipboardNotify|ClipboardHTML, nil),
+			&ServerCutText{Flags: ClipboardNotify | ClipboardHTML},
+			[]byte{},
+			true},
+		{"provide",
+			extendedClipboard(ClipboardProvide|ClipboardText|ClipboardRTF,
+				compressClipboard("ɹɐq\r\nfoo\x00", "{\\rtf1 foo}")),
+			&ServerCutText{Text: "ɹɐq\nfoo", Flags: ClipboardProvide | ClipboardText | ClipboardRTF, RTF: "{\\rtf1 foo}"},
+			[]byte{},
+			true},
+		{"provide of truncated data",
+			extendedClipboard(ClipboardProvide|ClipboardText, compressClipboard("foo")[:4]),
+			nil, nil, false},
+		{"unknown action",
+			extendedClipboard(1<<29, nil),
+			nil, nil, false},
+		{"invalid length",
+			[]byte{0, 0, 0, 0xff, 0xff, 0xff, 0xfe},
+			nil, nil, false},
+		{"too large",
+			[]byte{0, 0, 0, 0x80, 0, 0, 0x01},
+			nil, nil, false},
+	} {
+		mockConn.Reset()
+		if err := conn.send(tt.data); err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := (&ServerCutText{}).Read(conn)
+		if err == nil && !tt.ok {
+			t.Errorf("%s: expected error", tt.desc)
+			continue
+		}
+		if err != nil && tt.ok {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if got, want := msg, tt.msg; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: incorrect message; got = %v, want = %v", tt.desc, got, want)
+		}
+		if got, want := mockConn.b.Bytes(), tt.reply; !bytes.Equal(got, want) {
+			t.Errorf("%s: incorrect reply; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+
+	// A request is answered with the requested formats which are available.
+	mockConn.Reset()
+	if err := conn.send(extendedClipboard(ClipboardRequest|ClipboardText|ClipboardRTF|ClipboardHTML, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&ServerCutText{}).Read(conn); err != nil {
+		t.Fatalf("unexpected error; %s", err)
+	}
+	flags, data := decompressClipboard(t, mockConn.b.Bytes())
+	if got, want := flags, ClipboardProvide|ClipboardText|ClipboardHTML; got != want {
+		t.Errorf("incorrect flags; got = %#x, want = %#x", got, want)
+	}
+	if got, want := data, []byte("\x00\x00\x00\x04foo\x00\x00\x00\x00\x0a<b>foo</b>"); !bytes.Equal(got, want) {
+		t.Errorf("incorrect data; got = %q, want = %q", got, want)
+	}
+}
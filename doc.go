@@ -47,5 +47,14 @@ A basic VNC client can be created like this:
 This example will connect to a VNC server running on the localhost. It will
 periodically request updates from the server, and listen for and handle
 incoming FramebufferUpdate messages coming from the server.
+
+Servers supporting the ContinuousUpdates extension can instead stream updates
+without being polled. Include ContinuousUpdatesPseudoEncoding in the encodings
+given to SetEncodings, and once the server has answered with an
+EndOfContinuousUpdates message, replace the polling loop with:
+
+    if err := vc.EnableContinuousUpdates(true, 0, 0, w, h); err != nil {
+      log.Printf("error enabling continuous updates: %v", err)
+    }
 */
 package vnc
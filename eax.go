@@ -0,0 +1,120 @@
+// Implementation of the EAX authenticated encryption mode, as used by the
+// RSA-AES security types.
+// http://web.cs.ucdavis.edu/~rogaway/papers/eax.pdf
+
+package vnc
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+)
+
+// eax implements the cipher.AEAD interface for EAX mode, with nonces and
+// tags of the size of a block.
+type eax struct {
+	block  cipher.Block
+	k1, k2 []byte // The CMAC subkeys.
+}
+
+// Verify that interfaces are honored.
+var _ cipher.AEAD = (*eax)(nil)
+
+// newEAX returns EAX mode wrapping a block cipher with 128-bit blocks.
+func newEAX(block cipher.Block) (cipher.AEAD, error) {
+	if block.BlockSize() != 16 {
+		return nil, errors.New("EAX requires a block size of 16 bytes")
+	}
+	e := &eax{block: block}
+	l := make([]byte, 16)
+	block.Encrypt(l, l)
+	e.k1 = cmacDouble(l)
+	e.k2 = cmacDouble(e.k1)
+	return e, nil
+}
+
+// cmacDouble returns b doubled in GF(2^128).
+func cmacDouble(b []byte) []byte {
+	d := make([]byte, len(b))
+	var carry byte
+	for i := len(b) - 1; i >= 0; i-- {
+		d[i] = b[i]<<1 | carry
+		carry = b[i] >> 7
+	}
+	if carry != 0 {
+		d[len(d)-1] ^= 0x87
+	}
+	return d
+}
+
+// omac returns the CMAC of data tweaked by t.
+func (e *eax) omac(t byte, data []byte) []byte {
+	bs := e.block.BlockSize()
+	msg := make([]byte, bs, bs+len(data)+bs)
+	msg[bs-1] = t
+	msg = append(msg, data...)
+
+	// The last block is padded if incomplete, and masked with a subkey.
+	k := e.k1
+	if len(msg)%bs != 0 {
+		k = e.k2
+		msg = append(msg, 0x80)
+		for len(msg)%bs != 0 {
+			msg = append(msg, 0)
+		}
+	}
+	last := msg[len(msg)-bs:]
+	for i := range last {
+		last[i] ^= k[i]
+	}
+
+	mac := make([]byte, bs)
+	for i := 0; i < len(msg); i += bs {
+		for j := 0; j < bs; j++ {
+			mac[j] ^= msg[i+j]
+		}
+		e.block.Encrypt(mac, mac)
+	}
+	return mac
+}
+
+// tag returns the tag of the ciphertext, and the counter of the nonce.
+func (e *eax) tag(nonce, ciphertext, additionalData []byte) (tag, ctr []byte) {
+	n := e.omac(0, nonce)
+	h := e.omac(1, additionalData)
+	c := e.omac(2, ciphertext)
+	tag = make([]byte, len(n))
+	for i := range tag {
+		tag[i] = n[i] ^ h[i] ^ c[i]
+	}
+	return tag, n
+}
+
+// NonceSize implements the cipher.AEAD interface.
+func (e *eax) NonceSize() int { return e.block.BlockSize() }
+
+// Overhead implements the cipher.AEAD interface.
+func (e *eax) Overhead() int { return e.block.BlockSize() }
+
+// Seal implements the cipher.AEAD interface.
+func (e *eax) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCTR(e.block, e.omac(0, nonce)).XORKeyStream(ciphertext, plaintext)
+	tag, _ := e.tag(nonce, ciphertext, additionalData)
+	return append(append(dst, ciphertext...), tag...)
+}
+
+// Open implements the cipher.AEAD interface.
+func (e *eax) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < e.Overhead() {
+		return nil, errors.New("EAX message authentication failed")
+	}
+	split := len(ciphertext) - e.Overhead()
+	tag, ctr := e.tag(nonce, ciphertext[:split], additionalData)
+	if subtle.ConstantTimeCompare(tag, ciphertext[split:]) != 1 {
+		return nil, errors.New("EAX message authentication failed")
+	}
+	plaintext := make([]byte, split)
+	cipher.NewCTR(e.block, ctr).XORKeyStream(plaintext, ciphertext[:split])
+	return append(dst, plaintext...), nil
+}
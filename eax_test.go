@@ -0,0 +1,56 @@
+package vnc
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestEAX(t *testing.T) {
+	// Test vectors from the EAX paper.
+	for _, tt := range []struct {
+		key, nonce, header, msg, cipher string
+	}{
+		{"233952DEE4D5ED5F9B9C6D6FF80FF478", "62EC67F9C3A4A407FCB2A8C49031A8B3", "6BFB914FD07EAE6B",
+			"", "E037830E8389F27B025A2D6527E79D01"},
+		{"91945D3F4DCBEE0BF45EF52255F095A4", "BECAF043B0A23D843194BA972C66DEBD", "FA3BFD4806EB53FA",
+			"F7FB", "19DD5C4C9331049D0BDAB0277408F67967E5"},
+		{"01F74AD64077F2E704C0F60ADA3DD523", "70C3DB4F0D26368400A10ED05D2BFF5E", "234A3463C1264AC6",
+			"1A47CB4933", "D851D5BAE03A59F238A23E39199DC9266626C40F80"},
+	} {
+		decode := func(s string) []byte {
+			b, err := hex.DecodeString(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return b
+		}
+		block, err := aes.NewCipher(decode(tt.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		aead, err := newEAX(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce, header, msg := decode(tt.nonce), decode(tt.header), decode(tt.msg)
+
+		got := aead.Seal(nil, nonce, msg, header)
+		if want := decode(tt.cipher); !bytes.Equal(got, want) {
+			t.Errorf("%s: incorrect ciphertext; got = %X, want = %X", tt.key, got, want)
+		}
+		plaintext, err := aead.Open(nil, nonce, got, header)
+		if err != nil {
+			t.Errorf("%s: unexpected error; %s", tt.key, err)
+		}
+		if !bytes.Equal(plaintext, msg) {
+			t.Errorf("%s: incorrect plaintext; got = %X, want = %X", tt.key, plaintext, msg)
+		}
+
+		got[0] ^= 1
+		if _, err := aead.Open(nil, nonce, got, header); err == nil {
+			t.Errorf("%s: expected error for a modified message", tt.key)
+		}
+	}
+}
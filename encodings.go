@@ -9,9 +9,10 @@ import (
 	"fmt"
 
 	"encoding/binary"
-	"log"
-
+	"image"
+	"image/color"
 	"io"
+	"log"
 
 	"github.com/CambridgeSoftwareLtd/go-vnc/encodings"
 	"github.com/CambridgeSoftwareLtd/go-vnc/rfbflags"
@@ -115,6 +116,20 @@ func (*RawEncoding) String() string { return "RawEncoding" }
 // Type implements the Encoding interface.
 func (*RawEncoding) Type() encodings.Encoding { return encodings.Raw }
 
+// readColor reads a single pixel value from r.
+func (c *ClientConn) readColor(r io.Reader) (*Color, error) {
+	buf := make([]byte, c.pixelFormat.BPP/8)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	color := NewColor(&c.pixelFormat, &c.colorMap)
+	if err := color.Unmarshal(buf); err != nil {
+		return nil, err
+	}
+	return color, nil
+}
+
 //-----------------------------------------------------------------------------
 // CopyRect Encoding
 //
@@ -170,6 +185,7 @@ type RREncoding struct {
 	NumSubRects uint32
 	BackColour  Color
 	Rects       []RRERect
+	Colors      []Color
 }
 
 type RRERect struct {
@@ -190,6 +206,22 @@ func (e *RREncoding) Marshal() ([]byte, error) {
 
 // Read implements the Encoding interface.
 func (*RREncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	e, err := readRRE(c, rect, false)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// String implements the fmt.Stringer interface.
+func (e *RREncoding) String() string { return "RREEncoding" }
+
+// Type implements the Encoding interface.
+func (*RREncoding) Type() encodings.Encoding { return encodings.RRE }
+
+// readRRE reads an RRE rectangle, or a CoRRE one if compact is true, and
+// renders its pixels.
+func readRRE(c *ClientConn, rect *Rectangle, compact bool) (*RREncoding, error) {
 	var buf bytes.Buffer
 	bytesPerPixel := int(c.pixelFormat.BPP / 8)
 
@@ -208,10 +240,21 @@ func (*RREncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
 		return nil, fmt.Errorf("unable to convert RRE backgroundColor: %s", err)
 	}
 
-	rects := make([]RRERect, nSubRects)
+	// Sub-rectangle positions and sizes are 16 bits, or 8 bits for CoRRE.
+	coordSize := 2
+	if compact {
+		coordSize = 1
+	}
+	coord := func() uint16 {
+		if compact {
+			return uint16(buf.Next(1)[0])
+		}
+		return binary.BigEndian.Uint16(buf.Next(2))
+	}
 
+	var rects []RRERect
 	for i := 0; i < int(nSubRects); i++ {
-		n := (8 + bytesPerPixel)
+		n := bytesPerPixel + 4*coordSize
 		if err := c.receiveN(&buf, n); err != nil {
 			return nil, fmt.Errorf("unable to read RRE subRects: %s", err)
 		}
@@ -220,26 +263,284 @@ func (*RREncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
 		if err := subRectPixVal.Unmarshal(buf.Next(bytesPerPixel)); err != nil {
 			return nil, fmt.Errorf("unable to read RRE sub-rectangle(%v) backgroundColor: %s", i, err)
 		}
-		rect := RRERect{
+		subRect := RRERect{
 			BackColour: *subRectPixVal,
-			X:          binary.BigEndian.Uint16(buf.Next(2)),
-			Y:          binary.BigEndian.Uint16(buf.Next(2)),
-			Width:      binary.BigEndian.Uint16(buf.Next(2)),
-			Height:     binary.BigEndian.Uint16(buf.Next(2)),
+			X:          coord(),
+			Y:          coord(),
+			Width:      coord(),
+			Height:     coord(),
+		}
+		if int(subRect.X)+int(subRect.Width) > int(rect.Width) || int(subRect.Y)+int(subRect.Height) > int(rect.Height) {
+			return nil, fmt.Errorf("RRE sub-rectangle(%v) { x: %d y: %d w: %d h: %d } exceeds %dx%d rectangle",
+				i, subRect.X, subRect.Y, subRect.Width, subRect.Height, rect.Width, rect.Height)
 		}
 
-		rects = append(rects, rect)
+		rects = append(rects, subRect)
 	}
 
-	// TODO: convert & return pixels
-	return &RREncoding{nSubRects, *backPixVal, rects}, nil
+	return &RREncoding{nSubRects, *backPixVal, rects, renderRRE(rect, *backPixVal, rects)}, nil
+}
+
+// renderRRE returns the pixels of an RRE or CoRRE rectangle.
+func renderRRE(rect *Rectangle, bg Color, rects []RRERect) []Color {
+	width, height := int(rect.Width), int(rect.Height)
+	colors := make([]Color, rect.Area())
+	fillColors(colors, width, 0, 0, width, height, bg)
+	for _, r := range rects {
+		fillColors(colors, width, int(r.X), int(r.Y), int(r.Width), int(r.Height), r.BackColour)
+	}
+	return colors
+}
+
+//-----------------------------------------------------------------------------
+// CoRRE Encoding
+//
+// CoRRE encoding is RRE encoding with rectangles of at most 255x255 pixels,
+// allowing sub-rectangle positions and sizes to be sent as single bytes.
+//
+// https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#corre-encoding
+
+// CoRREncoding represents a CoRRE encoded update.
+type CoRREncoding RREncoding
+
+// Verify that interfaces are honored.
+var _ Encoding = (*CoRREncoding)(nil)
+
+// Marshal implements the Marshaler interface.
+func (*CoRREncoding) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Read implements the Encoding interface.
+func (*CoRREncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	e, err := readRRE(c, rect, true)
+	if err != nil {
+		return nil, err
+	}
+	return (*CoRREncoding)(e), nil
 }
 
 // String implements the fmt.Stringer interface.
-func (e *RREncoding) String() string { return "RREEncoding" }
+func (*CoRREncoding) String() string { return "CoRREncoding" }
 
 // Type implements the Encoding interface.
-func (*RREncoding) Type() encodings.Encoding { return encodings.RRE }
+func (*CoRREncoding) Type() encodings.Encoding { return encodings.CoRRE }
+
+//-----------------------------------------------------------------------------
+// Hextile Encoding
+//
+// Hextile encoding splits the rectangle into 16x16 tiles, each of which is
+// either raw pixel data, or a background color overlaid with sub-rectangles.
+//
+// See RFC 6143 §7.7.4.
+// https://tools.ietf.org/html/rfc6143#section-7.7.4
+
+// HextileEncoding represents a Hextile encoded update.
+type HextileEncoding struct {
+	Colors []Color
+}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*HextileEncoding)(nil)
+
+// Hextile subencoding-mask bits.
+const (
+	hextileRaw uint8 = 1 << iota
+	hextileBackgroundSpecified
+	hextileForegroundSpecified
+	hextileAnySubrects
+	hextileSubrectsColoured
+)
+
+const hextileTileSize = 16
+
+// Marshal implements the Marshaler interface.
+func (*HextileEncoding) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Read implements the Encoding interface.
+func (*HextileEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	colors, err := c.readHextile(rect, false)
+	if err != nil {
+		return nil, err
+	}
+	return &HextileEncoding{colors}, nil
+}
+
+// readHextile reads the tiles of a Hextile rectangle. With zlibHex, tiles may
+// instead hold zlib compressed data, as used by the ZlibHex encoding.
+func (c *ClientConn) readHextile(rect *Rectangle, zlibHex bool) ([]Color, error) {
+	width, height := int(rect.Width), int(rect.Height)
+	colors := make([]Color, rect.Area())
+
+	// The background and foreground colors persist from tile to tile.
+	var bg, fg Color
+	for ty := 0; ty < height; ty += hextileTileSize {
+		th := hextileTileSize
+		if height-ty < th {
+			th = height - ty
+		}
+		for tx := 0; tx < width; tx += hextileTileSize {
+			tw := hextileTileSize
+			if width-tx < tw {
+				tw = width - tx
+			}
+
+			var mask uint8
+			if err := c.receive(&mask); err != nil {
+				return nil, fmt.Errorf("unable to read Hextile subencoding-mask: %s", err)
+			}
+
+			var r io.Reader = connReader{c}
+			var zs *zrle.ZlibStream
+			if zlibHex && mask&(zlibHexRaw|zlibHexSubrects) != 0 {
+				var err error
+				if zs, err = c.readZlibHexTile(mask); err != nil {
+					return nil, err
+				}
+				r = zs
+			}
+
+			if mask&hextileRaw != 0 || zlibHex && mask&zlibHexRaw != 0 {
+				for y := ty; y < ty+th; y++ {
+					for x := tx; x < tx+tw; x++ {
+						color, err := c.readColor(r)
+						if err != nil {
+							return nil, fmt.Errorf("unable to read Hextile raw tile: %s", err)
+						}
+						colors[y*width+x] = *color
+					}
+				}
+			} else if err := c.readHextileSubrects(r, mask, colors, width, tx, ty, tw, th, &bg, &fg); err != nil {
+				return nil, err
+			}
+
+			if zs != nil {
+				if err := zs.Finish(); err != nil {
+					return nil, fmt.Errorf("unable to decompress ZlibHex tile: %s", err)
+				}
+			}
+		}
+	}
+
+	return colors, nil
+}
+
+// readHextileSubrects reads a tile which is not raw, filling it with the
+// background color and then drawing any subrectangles.
+func (c *ClientConn) readHextileSubrects(r io.Reader, mask uint8, colors []Color, width, tx, ty, tw, th int, bg, fg *Color) error {
+	if mask&hextileBackgroundSpecified != 0 {
+		color, err := c.readColor(r)
+		if err != nil {
+			return fmt.Errorf("unable to read Hextile background-pixel-value: %s", err)
+		}
+		*bg = *color
+	}
+	fillColors(colors, width, tx, ty, tw, th, *bg)
+
+	if mask&hextileForegroundSpecified != 0 {
+		color, err := c.readColor(r)
+		if err != nil {
+			return fmt.Errorf("unable to read Hextile foreground-pixel-value: %s", err)
+		}
+		*fg = *color
+	}
+
+	if mask&hextileAnySubrects == 0 {
+		return nil
+	}
+	var nSubrects uint8
+	if err := binary.Read(r, binary.BigEndian, &nSubrects); err != nil {
+		return fmt.Errorf("unable to read Hextile number-of-subrectangles: %s", err)
+	}
+	for i := 0; i < int(nSubrects); i++ {
+		color := *fg
+		if mask&hextileSubrectsColoured != 0 {
+			subrectColor, err := c.readColor(r)
+			if err != nil {
+				return fmt.Errorf("unable to read Hextile sub-rectangle(%v) pixel-value: %s", i, err)
+			}
+			color = *subrectColor
+		}
+		var xy, wh uint8
+		if err := binary.Read(r, binary.BigEndian, &xy); err != nil {
+			return fmt.Errorf("unable to read Hextile sub-rectangle(%v) x-and-y-position: %s", i, err)
+		}
+		if err := binary.Read(r, binary.BigEndian, &wh); err != nil {
+			return fmt.Errorf("unable to read Hextile sub-rectangle(%v) width-and-height: %s", i, err)
+		}
+		sx, sy := int(xy>>4), int(xy&0x0f)
+		sw, sh := int(wh>>4)+1, int(wh&0x0f)+1
+		if sx+sw > tw || sy+sh > th {
+			return fmt.Errorf("Hextile sub-rectangle(%v) { x: %d y: %d w: %d h: %d } exceeds %dx%d tile", i, sx, sy, sw, sh, tw, th)
+		}
+		fillColors(colors, width, tx+sx, ty+sy, sw, sh, color)
+	}
+	return nil
+}
+
+// String implements the fmt.Stringer interface.
+func (*HextileEncoding) String() string { return "HextileEncoding" }
+
+// Type implements the Encoding interface.
+func (*HextileEncoding) Type() encodings.Encoding { return encodings.Hextile }
+
+// fillColors sets a w x h region at position x, y of a row-major slice of
+// colors with the given stride to color.
+func fillColors(colors []Color, stride, x, y, w, h int, color Color) {
+	for row := y; row < y+h; row++ {
+		for col := x; col < x+w; col++ {
+			colors[row*stride+col] = color
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TRLE Encoding
+//
+// TRLE encoding combines tiling, palettisation and run-length encoding. It is
+// ZRLE without the zlib compression, using 16x16 tiles, and allowing a tile
+// to reuse the palette of the previous tile.
+//
+// See RFC 6143 §7.7.5.
+// https://tools.ietf.org/html/rfc6143#section-7.7.5
+
+// TRLEncoding represents a TRLE encoded update
+type TRLEncoding struct {
+	ColourData [][]zrle.CPixel
+	Colors     []Color
+}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*TRLEncoding)(nil)
+
+// Marshal implements the Marshaler interface.
+func (*TRLEncoding) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Read implements the Encoding interface.
+func (*TRLEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	tiles := zrle.CreateTilesOfSize(int(rect.Width), int(rect.Height), zrle.TRLETileWidth, zrle.TRLETileHeight)
+	if err := zrle.ReadTiles(connReader{c}, tiles, c.pixelFormat.bytesPerCPixel(), zrle.GetTRLESubencoding); err != nil {
+		return nil, fmt.Errorf("unable to read TRLE tiles: %s", err)
+	}
+
+	colourData := zrle.TilesToPixels(int(rect.Width), int(rect.Height), tiles)
+	colors, err := cpixelsToColors(c, colourData)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TRLEncoding{colourData, colors}, nil
+}
+
+// String implements the fmt.Stringer interface.
+func (*TRLEncoding) String() string { return "TRLEncoding" }
+
+// Type implements the Encoding interface.
+func (*TRLEncoding) Type() encodings.Encoding { return encodings.TRLE }
 
 //-----------------------------------------------------------------------------
 // ZRLE Encoding
@@ -253,14 +554,81 @@ func (*RREncoding) Type() encodings.Encoding { return encodings.RRE }
 type ZRLEncoding struct {
 	Length     uint32
 	ColourData [][]zrle.CPixel
+	Colors     []Color
+
+	// Encoder compresses the colour data for Marshal. The zlib stream
+	// persists across rectangles, so every rectangle sent over a connection
+	// must use the same Encoder.
+	Encoder *zrle.Encoder
 }
 
 // Verify that interfaces are honored.
 var _ Encoding = (*ZRLEncoding)(nil)
 
-// Marshal implements the Marshaler interface.
+// NewZRLEncoding returns a ZRLE encoded update of the r region of img, with
+// colours converted to the true color pixel format pf, to be compressed by e.
+func NewZRLEncoding(img image.Image, r image.Rectangle, pf *PixelFormat, e *zrle.Encoder) (*ZRLEncoding, error) {
+	if !rfbflags.IsTrueColor(pf.TrueColor) {
+		return nil, fmt.Errorf("ZRLE encoding requires a true color pixel format")
+	}
+
+	z := &ZRLEncoding{ColourData: make([][]zrle.CPixel, r.Dy()), Encoder: e}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := make([]zrle.CPixel, 0, r.Dx())
+		for x := r.Min.X; x < r.Max.X; x++ {
+			cr, cg, cb, _ := img.At(x, y).RGBA()
+			color := NewColor(pf, nil)
+			color.R = unscaleChannel(cr, pf.RedMax)
+			color.G = unscaleChannel(cg, pf.GreenMax)
+			color.B = unscaleChannel(cb, pf.BlueMax)
+			pixel, err := color.Marshal()
+			if err != nil {
+				return nil, err
+			}
+			cpixel, err := pf.pixelToCPixel(pixel)
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, cpixel)
+			z.Colors = append(z.Colors, *color)
+		}
+		z.ColourData[y-r.Min.Y] = row
+	}
+	return z, nil
+}
+
+// unscaleChannel scales a 16-bit color channel to the range [0, max], and is
+// the inverse of scaleChannel.
+func unscaleChannel(v uint32, max uint16) uint16 {
+	return uint16((v*uint32(max) + 0x7fff) / 0xffff)
+}
+
+// Marshal implements the Marshaler interface. The colour data is compressed
+// by the Encoder, continuing the zlib stream of the previous rectangles.
 func (z *ZRLEncoding) Marshal() ([]byte, error) {
-	return []byte{}, nil
+	if z.Encoder == nil {
+		return nil, fmt.Errorf("ZRLE encoding requires the zrle.Encoder of the connection")
+	}
+	var width int
+	if len(z.ColourData) > 0 {
+		width = len(z.ColourData[0])
+	}
+	var pixels []zrle.CPixel
+	for _, row := range z.ColourData {
+		if len(row) != width {
+			return nil, fmt.Errorf("ZRLE colour data rows differ in width")
+		}
+		pixels = append(pixels, row...)
+	}
+
+	data, err := z.Encoder.Encode(width, len(z.ColourData), pixels)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	return append(buf, data...), nil
 }
 
 // Read implements the Encoding interface.
@@ -285,49 +653,56 @@ func (z *ZRLEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
 	c.zlibStream.Write(buf.Bytes())
 
 	colourData, err := z.Decode(c, rect)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.zlibStream.Finish(); err != nil {
+		return nil, err
+	}
 
+	colors, err := cpixelsToColors(c, colourData)
 	if err != nil {
 		return nil, err
 	}
 
-	return &ZRLEncoding{length, colourData}, nil
+	return &ZRLEncoding{Length: length, ColourData: colourData, Colors: colors}, nil
 }
 
-// Decode Decodes the data attached to the ZLRE message
-func (z *ZRLEncoding) Decode(c *ClientConn, rect *Rectangle) ([][]zrle.CPixel, error) {
-	tiles := zrle.CreateTiles(int(rect.Width), int(rect.Height))
-
-	for i := range tiles {
-
-		tiles[i].BytesPerCPixel = int(c.pixelFormat.BPP / 8)
-		if c.pixelFormat.TrueColor == rfbflags.RFBFlag(0) && c.pixelFormat.BPP == 32 && c.pixelFormat.Depth <= 24 {
-			tiles[i].BytesPerCPixel = 3
-		}
-
-		// TODO: remove this - testing against python version
-		tiles[i].BytesPerCPixel = 3
-
-		p := make([]byte, 1)
-		_, err := io.ReadAtLeast(&c.zlibStream, p, 1)
-
-		if err != nil {
-			log.Printf("\tFirst byte parse error (tile %d): %s", i, err)
-			return nil, err
+// cpixelsToColors converts a grid of CPIXELs into a row-major slice of colors.
+func cpixelsToColors(c *ClientConn, cpixels [][]zrle.CPixel) ([]Color, error) {
+	var colors []Color
+	for _, row := range cpixels {
+		for _, p := range row {
+			color, err := cpixelToColor(c, p)
+			if err != nil {
+				return nil, err
+			}
+			colors = append(colors, *color)
 		}
+	}
+	return colors, nil
+}
 
-		s := p[0]
+// cpixelToColor converts a CPIXEL into a Color.
+func cpixelToColor(c *ClientConn, p zrle.CPixel) (*Color, error) {
+	pixel, err := c.pixelFormat.cpixelToPixel(p)
+	if err != nil {
+		return nil, err
+	}
 
-		se, err := zrle.GetSubencoding(s)
-		if err != nil {
-			return nil, err
-		}
+	color := NewColor(&c.pixelFormat, &c.colorMap)
+	if err := color.Unmarshal(pixel); err != nil {
+		return nil, fmt.Errorf("unable to convert CPIXEL: %s", err)
+	}
+	return color, nil
+}
 
-		tiles[i].SubType = int(s)
-		_, err = se.Read(&c.zlibStream, &tiles[i])
-		if err != nil {
-			return nil, err
-		}
+// Decode Decodes the data attached to the ZLRE message
+func (z *ZRLEncoding) Decode(c *ClientConn, rect *Rectangle) ([][]zrle.CPixel, error) {
+	tiles := zrle.CreateTiles(int(rect.Width), int(rect.Height))
 
+	if err := zrle.ReadTiles(&c.zlibStream, tiles, c.pixelFormat.bytesPerCPixel(), zrle.GetSubencoding); err != nil {
+		return nil, fmt.Errorf("unable to read ZRLE tiles: %s", err)
 	}
 
 	drawData := zrle.TilesToPixels(int(rect.Width), int(rect.Height), tiles)
@@ -354,8 +729,10 @@ func (z *ZRLEncoding) Type() encodings.Encoding { return encodings.ZRLE }
 
 // CursorPseudoEncoding represents a Cursor message from the server.
 type CursorPseudoEncoding struct {
-	cursorPixels []Color
-	bitmask      []uint8
+	// Image is the cursor shape, transparent where the bitmask is unset.
+	Image *image.NRGBA
+	// Hotspot is the position within Image of the pointer.
+	Hotspot image.Point
 }
 
 // Verify that interfaces are honored.
@@ -381,8 +758,43 @@ func (*CursorPseudoEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, err
 		return nil, fmt.Errorf("unable to read bitmask: %s", err)
 	}
 
-	// TODO: convert & return cursorPixels / bitmask
-	return &CursorPseudoEncoding{}, nil
+	colors := make([]Color, rect.Area())
+	for i := range colors {
+		color := NewColor(&c.pixelFormat, &c.colorMap)
+		if err := color.Unmarshal(cursorPixels.Next(bytesPerPixel)); err != nil {
+			return nil, fmt.Errorf("unable to convert cursorpixels: %s", err)
+		}
+		colors[i] = *color
+	}
+
+	return &CursorPseudoEncoding{
+		Image:   maskedImage(int(rect.Width), int(rect.Height), colors, bitmask.Bytes()),
+		Hotspot: image.Pt(int(rect.X), int(rect.Y)),
+	}, nil
+}
+
+// maskedImage returns an image of row-major colors, which is transparent
+// where the corresponding bit of the bitmask is unset. Each row of the
+// bitmask is padded to a whole number of bytes, with the most significant bit
+// first.
+func maskedImage(width, height int, colors []Color, bitmask []byte) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if !bitSet(bitmask, width, x, y) {
+				continue
+			}
+			img.Set(x, y, &colors[y*width+x])
+		}
+	}
+	return img
+}
+
+// bitSet reports whether the bit for position x, y of a width pixels wide
+// bitmap is set. Each row is padded to a whole number of bytes, with the most
+// significant bit first.
+func bitSet(bitmap []byte, width, x, y int) bool {
+	return bitmap[y*((width+7)/8)+x/8]&(0x80>>uint(x%8)) != 0
 }
 
 // String implements the fmt.Stringer interface.
@@ -391,6 +803,205 @@ func (e *CursorPseudoEncoding) String() string { return "CursorPseudoEncoding" }
 // Type implements the Encoding interface.
 func (*CursorPseudoEncoding) Type() encodings.Encoding { return encodings.CursorPseudo }
 
+//-----------------------------------------------------------------------------
+// XCursor Pseudo-Encoding
+//
+// The XCursor pseudo-encoding sets a two colour cursor shape, as used by the
+// X Window System.
+//
+// https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#x-cursor-pseudo-encoding
+
+// XCursorPseudoEncoding represents an XCursor message from the server.
+type XCursorPseudoEncoding struct {
+	// Image is the cursor shape, transparent where the bitmask is unset.
+	Image *image.NRGBA
+	// Hotspot is the position within Image of the pointer.
+	Hotspot image.Point
+}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*XCursorPseudoEncoding)(nil)
+
+// Marshal implements the Marshaler interface.
+func (*XCursorPseudoEncoding) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Read implements the Encoding interface.
+func (*XCursorPseudoEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	width, height := int(rect.Width), int(rect.Height)
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	enc := &XCursorPseudoEncoding{img, image.Pt(int(rect.X), int(rect.Y))}
+	if rect.Area() == 0 {
+		return enc, nil
+	}
+
+	var colors [6]uint8
+	if err := c.receive(&colors); err != nil {
+		return nil, fmt.Errorf("unable to read XCursor colors: %s", err)
+	}
+	var bitmap, bitmask bytes.Buffer
+	n := height * ((width + 7) / 8)
+	if err := c.receiveN(&bitmap, n); err != nil {
+		return nil, fmt.Errorf("unable to read XCursor bitmap: %s", err)
+	}
+	if err := c.receiveN(&bitmask, n); err != nil {
+		return nil, fmt.Errorf("unable to read XCursor bitmask: %s", err)
+	}
+
+	fg := color.NRGBA{colors[0], colors[1], colors[2], 0xff}
+	bg := color.NRGBA{colors[3], colors[4], colors[5], 0xff}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			switch {
+			case !bitSet(bitmask.Bytes(), width, x, y):
+			case bitSet(bitmap.Bytes(), width, x, y):
+				img.SetNRGBA(x, y, fg)
+			default:
+				img.SetNRGBA(x, y, bg)
+			}
+		}
+	}
+	return enc, nil
+}
+
+// String implements the fmt.Stringer interface.
+func (*XCursorPseudoEncoding) String() string { return "XCursorPseudoEncoding" }
+
+// Type implements the Encoding interface.
+func (*XCursorPseudoEncoding) Type() encodings.Encoding { return encodings.XCursorPseudo }
+
+//-----------------------------------------------------------------------------
+// PointerPos Pseudo-Encoding
+//
+// The PointerPos pseudo-encoding reports the position of the pointer, which
+// may have been moved by the server or another client.
+//
+// https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#cursor-position-pseudo-encoding
+
+// PointerPosPseudoEncoding represents a PointerPos message from the server.
+type PointerPosPseudoEncoding struct {
+	Position image.Point
+}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*PointerPosPseudoEncoding)(nil)
+
+// Marshal implements the Marshaler interface.
+func (*PointerPosPseudoEncoding) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Read implements the Encoding interface.
+func (*PointerPosPseudoEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	return &PointerPosPseudoEncoding{image.Pt(int(rect.X), int(rect.Y))}, nil
+}
+
+// String implements the fmt.Stringer interface.
+func (*PointerPosPseudoEncoding) String() string { return "PointerPosPseudoEncoding" }
+
+// Type implements the Encoding interface.
+func (*PointerPosPseudoEncoding) Type() encodings.Encoding { return encodings.PointerPosPseudo }
+
+//-----------------------------------------------------------------------------
+// VMware Cursor Pseudo-Encoding
+//
+// The VMware Cursor pseudo-encoding sets either a classic cursor shape, made
+// of AND and XOR masks, or a cursor with an alpha channel.
+//
+// https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#vmware-cursor-pseudo-encoding
+
+// VMwareCursorPseudoEncoding represents a VMware Cursor message from the
+// server.
+type VMwareCursorPseudoEncoding struct {
+	// Image is the cursor shape, with transparency.
+	Image *image.NRGBA
+	// Hotspot is the position within Image of the pointer.
+	Hotspot image.Point
+}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*VMwareCursorPseudoEncoding)(nil)
+
+// VMware cursor-type values.
+const (
+	vmwareCursorClassic uint8 = iota
+	vmwareCursorAlpha
+)
+
+// Marshal implements the Marshaler interface.
+func (*VMwareCursorPseudoEncoding) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Read implements the Encoding interface.
+func (*VMwareCursorPseudoEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	var header [2]uint8 // cursor-type, padding
+	if err := c.receive(&header); err != nil {
+		return nil, fmt.Errorf("unable to read VMware cursor-type: %s", err)
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, int(rect.Width), int(rect.Height)))
+	switch header[0] {
+	case vmwareCursorClassic:
+		bytesPerPixel := int(c.pixelFormat.BPP / 8)
+		var andMask, xorMask bytes.Buffer
+		if err := c.receiveN(&andMask, rect.Area()*bytesPerPixel); err != nil {
+			return nil, fmt.Errorf("unable to read VMware cursor and-mask: %s", err)
+		}
+		if err := c.receiveN(&xorMask, rect.Area()*bytesPerPixel); err != nil {
+			return nil, fmt.Errorf("unable to read VMware cursor xor-mask: %s", err)
+		}
+		for i := 0; i < rect.Area(); i++ {
+			and, xor := andMask.Next(bytesPerPixel), xorMask.Next(bytesPerPixel)
+			x, y := i%int(rect.Width), i/int(rect.Width)
+			switch {
+			case isZero(and):
+				// The screen is replaced by the xor-mask.
+				pixel := NewColor(&c.pixelFormat, &c.colorMap)
+				if err := pixel.Unmarshal(xor); err != nil {
+					return nil, fmt.Errorf("unable to convert VMware cursor xor-mask: %s", err)
+				}
+				img.Set(x, y, pixel)
+			case isZero(xor):
+				// The screen is unchanged.
+			default:
+				// The screen is inverted, which is approximated as black.
+				img.SetNRGBA(x, y, color.NRGBA{0, 0, 0, 0xff})
+			}
+		}
+	case vmwareCursorAlpha:
+		// Each pixel is sent as red, green, blue and alpha bytes.
+		var buf bytes.Buffer
+		if err := c.receiveN(&buf, rect.Area()*4); err != nil {
+			return nil, fmt.Errorf("unable to read VMware alpha cursor: %s", err)
+		}
+		copy(img.Pix, buf.Bytes())
+	default:
+		return nil, fmt.Errorf("unsupported VMware cursor-type %d", header[0])
+	}
+
+	return &VMwareCursorPseudoEncoding{img, image.Pt(int(rect.X), int(rect.Y))}, nil
+}
+
+// String implements the fmt.Stringer interface.
+func (*VMwareCursorPseudoEncoding) String() string { return "VMwareCursorPseudoEncoding" }
+
+// Type implements the Encoding interface.
+func (*VMwareCursorPseudoEncoding) Type() encodings.Encoding {
+	return encodings.VMwareCursorPseudo
+}
+
+// isZero reports whether every byte of b is zero.
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
 //-----------------------------------------------------------------------------
 // DesktopSize Pseudo-Encoding
 //
@@ -415,8 +1026,10 @@ func (e *DesktopSizePseudoEncoding) Marshal() ([]byte, error) {
 
 // Read implements the Encoding interface.
 func (*DesktopSizePseudoEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	c.stateMu.Lock()
 	c.fbWidth = rect.Width
 	c.fbHeight = rect.Height
+	c.stateMu.Unlock()
 
 	return &DesktopSizePseudoEncoding{}, nil
 }
@@ -426,3 +1039,253 @@ func (e *DesktopSizePseudoEncoding) String() string { return "DesktopSizePseudoE
 
 // Type implements the Encoding interface.
 func (*DesktopSizePseudoEncoding) Type() encodings.Encoding { return encodings.DesktopSizePseudo }
+
+//-----------------------------------------------------------------------------
+// LastRect Pseudo-Encoding
+//
+// A LastRect rectangle marks the end of a FramebufferUpdate, allowing the
+// server to send number-of-rectangles as 0xFFFF when it does not know in
+// advance how many rectangles it will send.
+//
+// https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#lastrect-pseudo-encoding
+
+// LastRectPseudoEncoding represents a LastRect marker from the server.
+type LastRectPseudoEncoding struct{}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*LastRectPseudoEncoding)(nil)
+
+// Marshal implements the Marshaler interface.
+func (*LastRectPseudoEncoding) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Read implements the Encoding interface.
+func (*LastRectPseudoEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	return &LastRectPseudoEncoding{}, nil
+}
+
+// String implements the fmt.Stringer interface.
+func (*LastRectPseudoEncoding) String() string { return "LastRectPseudoEncoding" }
+
+// Type implements the Encoding interface.
+func (*LastRectPseudoEncoding) Type() encodings.Encoding { return encodings.LastRectPseudo }
+
+//-----------------------------------------------------------------------------
+// DesktopName Pseudo-Encoding
+//
+// The DesktopName pseudo-encoding informs the client of a change to the name
+// of the desktop. The rectangle is delivered as part of its FramebufferUpdate
+// on the server message channel, notifying the client of the change.
+//
+// https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#desktopname-pseudo-encoding
+
+// DesktopNamePseudoEncoding represents a DesktopName message from the server.
+type DesktopNamePseudoEncoding struct {
+	Name string
+}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*DesktopNamePseudoEncoding)(nil)
+
+// Marshal implements the Marshaler interface.
+func (e *DesktopNamePseudoEncoding) Marshal() ([]byte, error) {
+	buf := NewBuffer(nil)
+	if err := buf.Write(uint32(len(e.Name))); err != nil {
+		return nil, err
+	}
+	if err := buf.Write([]byte(e.Name)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Read implements the Encoding interface.
+func (*DesktopNamePseudoEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	var length uint32
+	if err := c.receive(&length); err != nil {
+		return nil, fmt.Errorf("unable to read DesktopName length: %s", err)
+	}
+	var name bytes.Buffer
+	if err := c.receiveN(&name, int(length)); err != nil {
+		return nil, fmt.Errorf("unable to read DesktopName name: %s", err)
+	}
+	c.setDesktopName(name.String())
+
+	return &DesktopNamePseudoEncoding{name.String()}, nil
+}
+
+// String implements the fmt.Stringer interface.
+func (*DesktopNamePseudoEncoding) String() string { return "DesktopNamePseudoEncoding" }
+
+// Type implements the Encoding interface.
+func (*DesktopNamePseudoEncoding) Type() encodings.Encoding { return encodings.DesktopNamePseudo }
+
+//-----------------------------------------------------------------------------
+// Quality and Compression Level Pseudo-Encodings
+//
+// The quality and compression level pseudo-encodings are hints from the client
+// to the server, trading CPU time against bandwidth. They are only ever sent
+// by the client, as part of SetEncodings.
+//
+// https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#jpeg-quality-level-pseudo-encoding
+// https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#compression-level-pseudo-encoding
+// https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#jpeg-fine-grained-quality-level-pseudo-encoding
+// https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#jpeg-subsampling-level-pseudo-encoding
+
+// levelEncoding is implemented by the pseudo-encodings which hold a level.
+type levelEncoding interface {
+	validate() error
+}
+
+// validateLevel checks that the level of a pseudo-encoding is in range.
+func validateLevel(e Encoding, level, max int) error {
+	if level < 0 || level > max {
+		return fmt.Errorf("invalid %s level %d; must be between 0 and %d", e, level, max)
+	}
+	return nil
+}
+
+// clientOnlyEncodingError is returned when the server sends a rectangle with
+// a pseudo-encoding only sent by the client.
+func clientOnlyEncodingError(e Encoding) error {
+	return fmt.Errorf("%s is not sent by the server", e)
+}
+
+// QualityLevelPseudoEncoding requests the JPEG quality level of the Tight
+// encoding, from 0 (lowest quality) to 9 (highest quality).
+type QualityLevelPseudoEncoding struct {
+	Level int
+}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*QualityLevelPseudoEncoding)(nil)
+
+// Marshal implements the Marshaler interface.
+func (*QualityLevelPseudoEncoding) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Read implements the Encoding interface.
+func (e *QualityLevelPseudoEncoding) Read(*ClientConn, *Rectangle) (Encoding, error) {
+	return nil, clientOnlyEncodingError(e)
+}
+
+// String implements the fmt.Stringer interface.
+func (*QualityLevelPseudoEncoding) String() string { return "QualityLevelPseudoEncoding" }
+
+// Type implements the Encoding interface.
+func (e *QualityLevelPseudoEncoding) Type() encodings.Encoding {
+	return encodings.QualityLevel0Pseudo + encodings.Encoding(e.Level)
+}
+
+func (e *QualityLevelPseudoEncoding) validate() error {
+	return validateLevel(e, e.Level, int(encodings.QualityLevel9Pseudo-encodings.QualityLevel0Pseudo))
+}
+
+// CompressLevelPseudoEncoding requests the compression level of the Tight and
+// ZRLE encodings, from 0 (fastest) to 9 (best compression).
+type CompressLevelPseudoEncoding struct {
+	Level int
+}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*CompressLevelPseudoEncoding)(nil)
+
+// Marshal implements the Marshaler interface.
+func (*CompressLevelPseudoEncoding) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Read implements the Encoding interface.
+func (e *CompressLevelPseudoEncoding) Read(*ClientConn, *Rectangle) (Encoding, error) {
+	return nil, clientOnlyEncodingError(e)
+}
+
+// String implements the fmt.Stringer interface.
+func (*CompressLevelPseudoEncoding) String() string { return "CompressLevelPseudoEncoding" }
+
+// Type implements the Encoding interface.
+func (e *CompressLevelPseudoEncoding) Type() encodings.Encoding {
+	return encodings.CompressLevel0Pseudo + encodings.Encoding(e.Level)
+}
+
+func (e *CompressLevelPseudoEncoding) validate() error {
+	return validateLevel(e, e.Level, int(encodings.CompressLevel9Pseudo-encodings.CompressLevel0Pseudo))
+}
+
+// FineQualityLevelPseudoEncoding requests the JPEG quality of the Tight
+// encoding as a percentage, superseding QualityLevelPseudoEncoding on servers
+// which support it.
+type FineQualityLevelPseudoEncoding struct {
+	Level int
+}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*FineQualityLevelPseudoEncoding)(nil)
+
+// Marshal implements the Marshaler interface.
+func (*FineQualityLevelPseudoEncoding) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Read implements the Encoding interface.
+func (e *FineQualityLevelPseudoEncoding) Read(*ClientConn, *Rectangle) (Encoding, error) {
+	return nil, clientOnlyEncodingError(e)
+}
+
+// String implements the fmt.Stringer interface.
+func (*FineQualityLevelPseudoEncoding) String() string { return "FineQualityLevelPseudoEncoding" }
+
+// Type implements the Encoding interface.
+func (e *FineQualityLevelPseudoEncoding) Type() encodings.Encoding {
+	return encodings.FineQualityLevel0Pseudo + encodings.Encoding(e.Level)
+}
+
+func (e *FineQualityLevelPseudoEncoding) validate() error {
+	return validateLevel(e, e.Level, int(encodings.FineQualityLevel100Pseudo-encodings.FineQualityLevel0Pseudo))
+}
+
+// Subsampling is the chrominance subsampling of JPEG compressed rectangles.
+type Subsampling int
+
+// Subsampling levels, in the order of their pseudo-encodings.
+const (
+	Subsampling1X Subsampling = iota // No subsampling.
+	Subsampling4X
+	Subsampling2X
+	SubsamplingGray // Grayscale only.
+	Subsampling8X
+	Subsampling16X
+)
+
+// SubsamplingPseudoEncoding requests the JPEG chrominance subsampling of the
+// Tight encoding.
+type SubsamplingPseudoEncoding struct {
+	Subsampling Subsampling
+}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*SubsamplingPseudoEncoding)(nil)
+
+// Marshal implements the Marshaler interface.
+func (*SubsamplingPseudoEncoding) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Read implements the Encoding interface.
+func (e *SubsamplingPseudoEncoding) Read(*ClientConn, *Rectangle) (Encoding, error) {
+	return nil, clientOnlyEncodingError(e)
+}
+
+// String implements the fmt.Stringer interface.
+func (*SubsamplingPseudoEncoding) String() string { return "SubsamplingPseudoEncoding" }
+
+// Type implements the Encoding interface.
+func (e *SubsamplingPseudoEncoding) Type() encodings.Encoding {
+	return encodings.Subsamp1XPseudo + encodings.Encoding(e.Subsampling)
+}
+
+func (e *SubsamplingPseudoEncoding) validate() error {
+	return validateLevel(e, int(e.Subsampling), int(encodings.Subsamp16XPseudo-encodings.Subsamp1XPseudo))
+}
@@ -10,12 +10,41 @@ type Encoding int32
 //go:generate stringer -type=Encoding
 
 const (
-	Raw               Encoding = 0
-	CopyRect          Encoding = 1
-	RRE               Encoding = 2
-	Hextile           Encoding = 5
-	TRLE              Encoding = 15
-	ZRLE              Encoding = 16
-	CursorPseudo      Encoding = -239
-	DesktopSizePseudo Encoding = -223
+	Raw                        Encoding = 0
+	CopyRect                   Encoding = 1
+	RRE                        Encoding = 2
+	CoRRE                      Encoding = 4
+	Hextile                    Encoding = 5
+	Zlib                       Encoding = 6
+	Tight                      Encoding = 7
+	ZlibHex                    Encoding = 8
+	TRLE                       Encoding = 15
+	ZRLE                       Encoding = 16
+	CursorPseudo               Encoding = -239
+	XCursorPseudo              Encoding = -240
+	DesktopSizePseudo          Encoding = -223
+	ExtendedDesktopSizePseudo  Encoding = -308
+	LastRectPseudo             Encoding = -224
+	DesktopNamePseudo          Encoding = -307
+	FencePseudo                Encoding = -312
+	ContinuousUpdatesPseudo    Encoding = -313
+	XVPPseudo                  Encoding = -309
+	QEMUExtendedKeyEventPseudo Encoding = -258
+	QEMUAudioPseudo            Encoding = -259
+	QualityLevel0Pseudo        Encoding = -32
+	QualityLevel9Pseudo        Encoding = -23
+	CompressLevel0Pseudo       Encoding = -256
+	CompressLevel9Pseudo       Encoding = -247
+	FineQualityLevel0Pseudo    Encoding = -512
+	FineQualityLevel100Pseudo  Encoding = -412
+	Subsamp1XPseudo            Encoding = -768
+	Subsamp4XPseudo            Encoding = -767
+	Subsamp2XPseudo            Encoding = -766
+	SubsampGrayPseudo          Encoding = -765
+	Subsamp8XPseudo            Encoding = -764
+	Subsamp16XPseudo           Encoding = -763
+	PointerPosPseudo           Encoding = -232
+	TightPNG                   Encoding = -260
+	VMwareCursorPseudo         Encoding = 0x574d5664
+	ExtendedClipboardPseudo    Encoding = -0x3f5e1a32 // 0xc0a1e5ce
 )
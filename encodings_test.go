@@ -3,12 +3,47 @@ package vnc
 // TODO(kward): Fully test the encodings.
 
 import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"reflect"
 	"testing"
 
 	"github.com/kward/go-vnc/encodings"
 	"github.com/kward/go-vnc/go/operators"
+	"github.com/kward/go-vnc/rfbflags"
+	"github.com/kward/go-vnc/zrle"
 )
 
+// pixelFormat8bitTrueColor is a BGR233 true color format, which allows pixel
+// values to be written as single bytes in tests.
+var pixelFormat8bitTrueColor = PixelFormat{
+	BPP:        8,
+	Depth:      8,
+	TrueColor:  rfbflags.RFBTrue,
+	RedMax:     7,
+	GreenMax:   7,
+	BlueMax:    3,
+	RedShift:   0,
+	GreenShift: 3,
+	BlueShift:  6,
+}
+
+// colorsToPixels returns the wire format pixel values of colors.
+func colorsToPixels(colors []Color) ([]byte, error) {
+	var pixels []byte
+	for _, c := range colors {
+		b, err := c.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		pixels = append(pixels, b...)
+	}
+	return pixels, nil
+}
+
 func TestEncoding_Marshal(t *testing.T) {
 	encs := Encodings{&RawEncoding{}}
 	bytes, err := encs.Marshal()
@@ -60,9 +95,645 @@ func TestRawEncoding_Marshal(t *testing.T) {
 
 func TestRawEncoding_Read(t *testing.T) {}
 
+func TestHextileEncoding_Read(t *testing.T) {
+	for _, tt := range []struct {
+		desc   string
+		w, h   uint16
+		data   []byte
+		pixels []byte
+		ok     bool
+	}{
+		{"raw tile",
+			2, 2,
+			[]byte{hextileRaw, 1, 2, 3, 4},
+			[]byte{1, 2, 3, 4},
+			true},
+		{"background only",
+			3, 1,
+			[]byte{hextileBackgroundSpecified, 9},
+			[]byte{9, 9, 9},
+			true},
+		{"foreground subrects",
+			4, 3,
+			[]byte{
+				hextileBackgroundSpecified | hextileForegroundSpecified | hextileAnySubrects, 1, 7, 2,
+				0x00, 0x00, // x: 0 y: 0, w: 1 h: 1
+				0x21, 0x11, // x: 2 y: 1, w: 2 h: 2
+			},
+			[]byte{
+				7, 1, 1, 1,
+				1, 1, 7, 7,
+				1, 1, 7, 7,
+			},
+			true},
+		{"coloured subrects",
+			3, 2,
+			[]byte{
+				hextileBackgroundSpecified | hextileAnySubrects | hextileSubrectsColoured, 0, 2,
+				5, 0x10, 0x10, // x: 1 y: 0, w: 2 h: 1
+				6, 0x01, 0x00, // x: 0 y: 1, w: 1 h: 1
+			},
+			[]byte{
+				0, 5, 5,
+				6, 0, 0,
+			},
+			true},
+		{"background and foreground persist across tiles",
+			20, 1,
+			[]byte{
+				hextileBackgroundSpecified | hextileForegroundSpecified, 3, 4,
+				hextileAnySubrects, 1, 0x20, 0x10, // x: 2 y: 0, w: 2 h: 1
+			},
+			[]byte{
+				3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+				3, 3, 4, 4,
+			},
+			true},
+		{"raw tile does not reset background",
+			33, 1,
+			[]byte{
+				hextileBackgroundSpecified, 2,
+				hextileRaw, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8,
+				0,
+			},
+			[]byte{
+				2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+				8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8,
+				2,
+			},
+			true},
+		{"missing tile",
+			17, 1,
+			[]byte{hextileBackgroundSpecified, 2},
+			nil,
+			false},
+		{"subrect exceeds tile",
+			2, 2,
+			[]byte{hextileAnySubrects, 1, 0x11, 0x11},
+			nil,
+			false},
+		{"truncated",
+			2, 2,
+			[]byte{hextileRaw, 1, 2},
+			nil,
+			false},
+	} {
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, &ClientConfig{})
+		conn.pixelFormat = pixelFormat8bitTrueColor
+
+		if err := conn.send(tt.data); err != nil {
+			t.Fatal(err)
+		}
+		rect := &Rectangle{Width: tt.w, Height: tt.h}
+		enc, err := (&HextileEncoding{}).Read(conn, rect)
+		if err == nil && !tt.ok {
+			t.Errorf("%s: expected error", tt.desc)
+			continue
+		}
+		if err != nil && tt.ok {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		pixels, err := colorsToPixels(enc.(*HextileEncoding).Colors)
+		if err != nil {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+		if got, want := pixels, tt.pixels; !operators.EqualSlicesOfByte(got, want) {
+			t.Errorf("%s: incorrect pixels; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
+
 func TestDesktopSizePseudoEncoding_Type(t *testing.T) {
 	e := &DesktopSizePseudoEncoding{}
 	if got, want := e.Type(), encodings.DesktopSizePseudo; got != want {
 		t.Errorf("incorrect encoding; got = %s, want = %s", got, want)
 	}
 }
+
+func TestTRLEncoding_Read(t *testing.T) {
+	for _, tt := range []struct {
+		desc   string
+		w, h   uint16
+		data   []byte
+		pixels []byte
+		ok     bool
+	}{
+		{"solid tile",
+			3, 2,
+			[]byte{1, 5},
+			[]byte{5, 5, 5, 5, 5, 5},
+			true},
+		{"raw tile",
+			2, 2,
+			[]byte{0, 1, 2, 3, 4},
+			[]byte{1, 2, 3, 4},
+			true},
+		{"16 pixel tiles with palette reuse",
+			18, 1,
+			[]byte{
+				2, 6, 7, 0xf0, 0x0f, // 2 colour palette, 1 bit per index
+				127, 0x40, // reuse palette
+			},
+			[]byte{7, 7, 7, 7, 6, 6, 6, 6, 6, 6, 6, 6, 7, 7, 7, 7, 6, 7},
+			true},
+		{"invalid palette reuse",
+			2, 2,
+			[]byte{127, 0x00},
+			nil,
+			false},
+		{"truncated",
+			2, 2,
+			[]byte{0, 1, 2},
+			nil,
+			false},
+	} {
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, &ClientConfig{})
+		conn.pixelFormat = pixelFormat8bitTrueColor
+
+		if err := conn.send(tt.data); err != nil {
+			t.Fatal(err)
+		}
+		rect := &Rectangle{Width: tt.w, Height: tt.h}
+		enc, err := (&TRLEncoding{}).Read(conn, rect)
+		if err == nil && !tt.ok {
+			t.Errorf("%s: expected error", tt.desc)
+			continue
+		}
+		if err != nil && tt.ok {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		pixels, err := colorsToPixels(enc.(*TRLEncoding).Colors)
+		if err != nil {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+		if got, want := pixels, tt.pixels; !operators.EqualSlicesOfByte(got, want) {
+			t.Errorf("%s: incorrect pixels; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
+
+func TestZRLEncoding_Read(t *testing.T) {
+	lsb24 := pixelFormat24bit
+	msb24 := PixelFormat{BPP: 32, Depth: 24, BigEndian: rfbflags.RFBTrue, TrueColor: rfbflags.RFBTrue, RedMax: 255, GreenMax: 255, BlueMax: 255, RedShift: 24, GreenShift: 16, BlueShift: 8}
+	rgb565 := PixelFormat{BPP: 16, Depth: 16, BigEndian: rfbflags.RFBTrue, TrueColor: rfbflags.RFBTrue, RedMax: 31, GreenMax: 63, BlueMax: 31, RedShift: 11, GreenShift: 5, BlueShift: 0}
+
+	for _, tt := range []struct {
+		desc string
+		pf   PixelFormat
+		w, h uint16
+		data []byte // Uncompressed tile data.
+		rgb  []uint16
+		ok   bool
+	}{
+		{"8bpp raw tile",
+			pixelFormat8bitTrueColor,
+			2, 1,
+			[]byte{0, 0x47, 0x38},
+			[]uint16{7, 0, 1, 0, 7, 0},
+			true},
+		{"16bpp solid tile",
+			rgb565,
+			2, 1,
+			[]byte{1, 0xf8, 0x1f},
+			[]uint16{31, 0, 31, 31, 0, 31},
+			true},
+		{"32bpp depth 24 ls bytes",
+			lsb24,
+			1, 2,
+			[]byte{0, 3, 2, 1, 6, 5, 4},
+			[]uint16{1, 2, 3, 4, 5, 6},
+			true},
+		{"32bpp depth 24 ms bytes",
+			msb24,
+			1, 2,
+			[]byte{0, 1, 2, 3, 4, 5, 6},
+			[]uint16{1, 2, 3, 4, 5, 6},
+			true},
+		{"truncated",
+			lsb24,
+			1, 2,
+			[]byte{0, 3, 2, 1, 6},
+			nil,
+			false},
+	} {
+		var zbuf bytes.Buffer
+		zw := zlib.NewWriter(&zbuf)
+		if _, err := zw.Write(tt.data); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		msg := make([]byte, 4, 4+zbuf.Len())
+		binary.BigEndian.PutUint32(msg, uint32(zbuf.Len()))
+		msg = append(msg, zbuf.Bytes()...)
+
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, &ClientConfig{})
+		conn.pixelFormat = tt.pf
+		if err := conn.send(msg); err != nil {
+			t.Fatal(err)
+		}
+
+		rect := &Rectangle{Width: tt.w, Height: tt.h}
+		enc, err := (&ZRLEncoding{}).Read(conn, rect)
+		if err == nil && !tt.ok {
+			t.Errorf("%s: expected error", tt.desc)
+			continue
+		}
+		if err != nil && tt.ok {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if got, want := rgbOf(enc.(*ZRLEncoding).Colors), tt.rgb; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: incorrect colors; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
+
+func TestZRLEncoding_Marshal(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 70, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 70; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 3), uint8(y * 10), uint8((x / 8) * 30), 255})
+		}
+	}
+	// Successive rectangles continue the zlib stream.
+	rects := []image.Rectangle{image.Rect(2, 3, 69, 20), image.Rect(0, 0, 10, 5)}
+
+	for _, tt := range []struct {
+		desc string
+		pf   PixelFormat
+	}{
+		{"8bpp", pixelFormat8bitTrueColor},
+		{"16bpp", PixelFormat{BPP: 16, Depth: 16, BigEndian: rfbflags.RFBTrue, TrueColor: rfbflags.RFBTrue, RedMax: 31, GreenMax: 63, BlueMax: 31, RedShift: 11, GreenShift: 5, BlueShift: 0}},
+		{"32bpp depth 24 ls bytes", pixelFormat24bit},
+		{"32bpp depth 24 ms bytes", PixelFormat{BPP: 32, Depth: 24, BigEndian: rfbflags.RFBTrue, TrueColor: rfbflags.RFBTrue, RedMax: 255, GreenMax: 255, BlueMax: 255, RedShift: 24, GreenShift: 16, BlueShift: 8}},
+	} {
+		e := zrle.NewEncoder()
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, &ClientConfig{})
+		conn.pixelFormat = tt.pf
+		for i, r := range rects {
+			enc, err := NewZRLEncoding(img, r, &tt.pf, e)
+			if err != nil {
+				t.Errorf("%s: unexpected error; %s", tt.desc, err)
+				break
+			}
+			data, err := enc.Marshal()
+			if err != nil {
+				t.Errorf("%s: unexpected error; %s", tt.desc, err)
+				break
+			}
+
+			if err := conn.send(data); err != nil {
+				t.Fatal(err)
+			}
+			got, err := (&ZRLEncoding{}).Read(conn, &Rectangle{Width: uint16(r.Dx()), Height: uint16(r.Dy())})
+			if err != nil {
+				t.Errorf("%s: rectangle %d: unexpected error; %s", tt.desc, i, err)
+				break
+			}
+			if got, want := got.(*ZRLEncoding).ColourData, enc.ColourData; !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: rectangle %d: incorrect colour data", tt.desc, i)
+			}
+			if got, want := rgbOf(got.(*ZRLEncoding).Colors), rgbOf(enc.Colors); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: rectangle %d: incorrect colors", tt.desc, i)
+			}
+		}
+	}
+
+	if _, err := NewZRLEncoding(img, rects[0], &PixelFormat8bit, zrle.NewEncoder()); err == nil {
+		t.Error("expected error for color map pixel format")
+	}
+	if _, err := (&ZRLEncoding{ColourData: [][]zrle.CPixel{{{0}}}}).Marshal(); err == nil {
+		t.Error("expected error without an Encoder")
+	}
+}
+
+func TestRREncoding_Read(t *testing.T) {
+	for _, tt := range []struct {
+		desc    string
+		compact bool
+		w, h    uint16
+		data    []byte
+		pixels  []byte
+		ok      bool
+	}{
+		{"RRE",
+			false,
+			3, 2,
+			[]byte{
+				0, 0, 0, 2, // number-of-subrectangles
+				1,                         // background-pixel-value
+				2, 0, 1, 0, 0, 0, 2, 0, 1, // subrect at 1,0 2x1
+				3, 0, 0, 0, 1, 0, 1, 0, 1, // subrect at 0,1 1x1
+			},
+			[]byte{1, 2, 2, 3, 1, 1},
+			true},
+		{"RRE without subrects",
+			false,
+			2, 1,
+			[]byte{0, 0, 0, 0, 4},
+			[]byte{4, 4},
+			true},
+		{"RRE subrect outside rectangle",
+			false,
+			2, 2,
+			[]byte{0, 0, 0, 1, 1, 2, 0, 1, 0, 0, 0, 2, 0, 1},
+			nil,
+			false},
+		{"RRE truncated",
+			false,
+			2, 2,
+			[]byte{0, 0, 0, 2, 1, 2, 0, 0, 0, 0, 0, 1, 0, 1},
+			nil,
+			false},
+		{"CoRRE",
+			true,
+			3, 2,
+			[]byte{
+				0, 0, 0, 2, // number-of-subrectangles
+				1,             // background-pixel-value
+				2, 1, 0, 2, 1, // subrect at 1,0 2x1
+				3, 0, 1, 1, 1, // subrect at 0,1 1x1
+			},
+			[]byte{1, 2, 2, 3, 1, 1},
+			true},
+		{"CoRRE subrect outside rectangle",
+			true,
+			2, 2,
+			[]byte{0, 0, 0, 1, 1, 2, 1, 1, 2, 1},
+			nil,
+			false},
+	} {
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, &ClientConfig{})
+		conn.pixelFormat = pixelFormat8bitTrueColor
+
+		if err := conn.send(tt.data); err != nil {
+			t.Fatal(err)
+		}
+		rect := &Rectangle{Width: tt.w, Height: tt.h}
+		var enc Encoding
+		var err error
+		if tt.compact {
+			enc, err = (&CoRREncoding{}).Read(conn, rect)
+		} else {
+			enc, err = (&RREncoding{}).Read(conn, rect)
+		}
+		if err == nil && !tt.ok {
+			t.Errorf("%s: expected error", tt.desc)
+			continue
+		}
+		if err != nil && tt.ok {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		var colors []Color
+		switch e := enc.(type) {
+		case *RREncoding:
+			colors = e.Colors
+			if got, want := len(e.Rects), int(e.NumSubRects); got != want {
+				t.Errorf("%s: incorrect number of subrects; got = %d, want = %d", tt.desc, got, want)
+			}
+		case *CoRREncoding:
+			colors = e.Colors
+			if got, want := len(e.Rects), int(e.NumSubRects); got != want {
+				t.Errorf("%s: incorrect number of subrects; got = %d, want = %d", tt.desc, got, want)
+			}
+		}
+		pixels, err := colorsToPixels(colors)
+		if err != nil {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+		if got, want := pixels, tt.pixels; !operators.EqualSlicesOfByte(got, want) {
+			t.Errorf("%s: incorrect pixels; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
+
+func TestCursorPseudoEncoding_Read(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+	conn.pixelFormat = pixelFormat8bitTrueColor
+
+	// A 10x2 cursor, so that each bitmask row is padded to 2 bytes.
+	data := []byte{
+		0x07, 0x07, 0x07, 0x07, 0x07, 0x07, 0x07, 0x07, 0x07, 0x07, // red
+		0x38, 0x38, 0x38, 0x38, 0x38, 0x38, 0x38, 0x38, 0x38, 0x38, // green
+		0xa0, 0x40, // red visible at 0, 2 and 9
+		0x00, 0xc0, // green visible at 8 and 9
+	}
+	if err := conn.send(data); err != nil {
+		t.Fatal(err)
+	}
+	enc, err := (&CursorPseudoEncoding{}).Read(conn, &Rectangle{X: 3, Y: 1, Width: 10, Height: 2})
+	if err != nil {
+		t.Fatalf("unexpected error; %s", err)
+	}
+	cursor := enc.(*CursorPseudoEncoding)
+	if got, want := cursor.Hotspot, image.Pt(3, 1); got != want {
+		t.Errorf("incorrect hotspot; got = %v, want = %v", got, want)
+	}
+	if got, want := cursor.Image.Bounds(), image.Rect(0, 0, 10, 2); got != want {
+		t.Fatalf("incorrect bounds; got = %v, want = %v", got, want)
+	}
+	red, green, clear := color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 255, 0, 255}, color.NRGBA{}
+	for _, tt := range []struct {
+		x, y int
+		want color.NRGBA
+	}{
+		{0, 0, red}, {1, 0, clear}, {2, 0, red}, {8, 0, clear}, {9, 0, red},
+		{0, 1, clear}, {7, 1, clear}, {8, 1, green}, {9, 1, green},
+	} {
+		if got := cursor.Image.NRGBAAt(tt.x, tt.y); got != tt.want {
+			t.Errorf("incorrect pixel at %d,%d; got = %v, want = %v", tt.x, tt.y, got, tt.want)
+		}
+	}
+}
+
+func TestXCursorPseudoEncoding_Read(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+
+	// A 10x2 cursor, so that each bitmap and bitmask row is padded to 2 bytes.
+	data := []byte{
+		0xff, 0x00, 0x00, // foreground
+		0x00, 0x00, 0xff, // background
+		0xa0, 0x40, 0x00, 0x00, // bitmap: foreground at 0, 2 and 9, then none
+		0xe0, 0x40, 0x00, 0x80, // bitmask: visible at 0-2 and 9, then 8
+	}
+	if err := conn.send(data); err != nil {
+		t.Fatal(err)
+	}
+	enc, err := (&XCursorPseudoEncoding{}).Read(conn, &Rectangle{X: 4, Y: 2, Width: 10, Height: 2})
+	if err != nil {
+		t.Fatalf("unexpected error; %s", err)
+	}
+	cursor := enc.(*XCursorPseudoEncoding)
+	if got, want := cursor.Hotspot, image.Pt(4, 2); got != want {
+		t.Errorf("incorrect hotspot; got = %v, want = %v", got, want)
+	}
+	if got, want := cursor.Image.Bounds(), image.Rect(0, 0, 10, 2); got != want {
+		t.Fatalf("incorrect bounds; got = %v, want = %v", got, want)
+	}
+	fg, bg, clear := color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 0, 255, 255}, color.NRGBA{}
+	for _, tt := range []struct {
+		x, y int
+		want color.NRGBA
+	}{
+		{0, 0, fg}, {1, 0, bg}, {2, 0, fg}, {3, 0, clear}, {9, 0, fg},
+		{0, 1, clear}, {8, 1, bg}, {9, 1, clear},
+	} {
+		if got := cursor.Image.NRGBAAt(tt.x, tt.y); got != tt.want {
+			t.Errorf("incorrect pixel at %d,%d; got = %v, want = %v", tt.x, tt.y, got, tt.want)
+		}
+	}
+
+	// An empty cursor has no colors or masks.
+	mockConn.Reset()
+	enc, err = (&XCursorPseudoEncoding{}).Read(conn, &Rectangle{})
+	if err != nil {
+		t.Fatalf("unexpected error; %s", err)
+	}
+	if got := enc.(*XCursorPseudoEncoding).Image.Bounds(); !got.Empty() {
+		t.Errorf("incorrect bounds; got = %v, want empty", got)
+	}
+}
+
+func TestPointerPosPseudoEncoding_Read(t *testing.T) {
+	conn := NewClientConn(&MockConn{}, &ClientConfig{})
+	enc, err := (&PointerPosPseudoEncoding{}).Read(conn, &Rectangle{X: 12, Y: 34})
+	if err != nil {
+		t.Fatalf("unexpected error; %s", err)
+	}
+	if got, want := enc.(*PointerPosPseudoEncoding).Position, image.Pt(12, 34); got != want {
+		t.Errorf("incorrect position; got = %v, want = %v", got, want)
+	}
+}
+
+func TestVMwareCursorPseudoEncoding_Read(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+	conn.pixelFormat = pixelFormat8bitTrueColor
+
+	red, black, clear := color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 0, 0, 255}, color.NRGBA{}
+	for _, tt := range []struct {
+		desc   string
+		data   []byte
+		pixels []color.NRGBA
+		ok     bool
+	}{
+		{"classic",
+			[]byte{
+				0, 0, // cursor-type, padding
+				0x00, 0xff, 0xff, // and-mask
+				0x07, 0x00, 0x07, // xor-mask
+			},
+			[]color.NRGBA{red, clear, black},
+			true},
+		{"alpha",
+			[]byte{
+				1, 0, // cursor-type, padding
+				0xff, 0x00, 0x00, 0xff,
+				0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0xff, 0x80,
+			},
+			[]color.NRGBA{red, clear, {0, 0, 255, 128}},
+			true},
+		{"unsupported cursor-type",
+			[]byte{2, 0},
+			nil,
+			false},
+		{"short data",
+			[]byte{1, 0, 0xff, 0x00},
+			nil,
+			false},
+	} {
+		mockConn.Reset()
+		if err := conn.send(tt.data); err != nil {
+			t.Fatal(err)
+		}
+		enc, err := (&VMwareCursorPseudoEncoding{}).Read(conn, &Rectangle{X: 1, Y: 0, Width: 3, Height: 1})
+		if err == nil && !tt.ok {
+			t.Errorf("%s: expected error", tt.desc)
+			continue
+		}
+		if err != nil && tt.ok {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		cursor := enc.(*VMwareCursorPseudoEncoding)
+		if got, want := cursor.Hotspot, image.Pt(1, 0); got != want {
+			t.Errorf("%s: incorrect hotspot; got = %v, want = %v", tt.desc, got, want)
+		}
+		for x, want := range tt.pixels {
+			if got := cursor.Image.NRGBAAt(x, 0); got != want {
+				t.Errorf("%s: incorrect pixel at %d; got = %v, want = %v", tt.desc, x, got, want)
+			}
+		}
+	}
+}
+
+func TestDesktopNamePseudoEncoding_Read(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+
+	for _, tt := range []struct {
+		desc string
+		data []byte
+		name string
+		ok   bool
+	}{
+		{"ascii", []byte{0, 0, 0, 4, 'h', 'o', 's', 't'}, "host", true},
+		{"utf-8", []byte{0, 0, 0, 5, 'c', 'a', 'f', 0xc3, 0xa9}, "café", true},
+		{"empty", []byte{0, 0, 0, 0}, "", true},
+		{"short name", []byte{0, 0, 0, 4, 'h', 'o'}, "", false},
+	} {
+		mockConn.Reset()
+		if err := conn.send(tt.data); err != nil {
+			t.Fatal(err)
+		}
+		enc, err := (&DesktopNamePseudoEncoding{}).Read(conn, &Rectangle{})
+		if err == nil && !tt.ok {
+			t.Errorf("%s: expected error", tt.desc)
+			continue
+		}
+		if err != nil && tt.ok {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if got, want := enc.(*DesktopNamePseudoEncoding).Name, tt.name; got != want {
+			t.Errorf("%s: incorrect name; got = %q, want = %q", tt.desc, got, want)
+		}
+		if got, want := conn.DesktopName(), tt.name; got != want {
+			t.Errorf("%s: incorrect desktop name; got = %q, want = %q", tt.desc, got, want)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+/*
+Implementation of the ExtendedDesktopSize pseudo-encoding and the
+SetDesktopSize message.
+https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#extendeddesktopsize-pseudo-encoding
+*/
+package vnc
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/CambridgeSoftwareLtd/go-vnc/encodings"
+	"github.com/CambridgeSoftwareLtd/go-vnc/logging"
+	"github.com/CambridgeSoftwareLtd/go-vnc/messages"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// Screen describes one of the screens making up the desktop.
+type Screen struct {
+	ID            uint32 // id
+	X, Y          uint16 // x-position, y-position
+	Width, Height uint16 // width, height
+	Flags         uint32 // flags
+}
+
+// Bounds returns the region of the framebuffer covered by the screen.
+func (s Screen) Bounds() image.Rectangle {
+	return image.Rect(int(s.X), int(s.Y), int(s.X)+int(s.Width), int(s.Y)+int(s.Height))
+}
+
+// DesktopSizeReason is the reason the server sent a desktop size update.
+type DesktopSizeReason uint16
+
+const (
+	// DesktopSizeServer is a change made by the server.
+	DesktopSizeServer DesktopSizeReason = iota
+	// DesktopSizeClient is a change requested by this client.
+	DesktopSizeClient
+	// DesktopSizeOtherClient is a change requested by another client.
+	DesktopSizeOtherClient
+)
+
+// DesktopSizeStatus is the result of a request to change the desktop size.
+type DesktopSizeStatus uint16
+
+const (
+	DesktopSizeOK DesktopSizeStatus = iota
+	DesktopSizeProhibited
+	DesktopSizeOutOfResources
+	DesktopSizeInvalidLayout
+	// DesktopSizeForwarded means the request was passed on, and may complete
+	// later with a change made by the server.
+	DesktopSizeForwarded
+)
+
+// String implements the fmt.Stringer interface.
+func (s DesktopSizeStatus) String() string {
+	switch s {
+	case DesktopSizeOK:
+		return "no error"
+	case DesktopSizeProhibited:
+		return "resize is administratively prohibited"
+	case DesktopSizeOutOfResources:
+		return "out of resources"
+	case DesktopSizeInvalidLayout:
+		return "invalid screen layout"
+	case DesktopSizeForwarded:
+		return "request forwarded"
+	}
+	return fmt.Sprintf("DesktopSizeStatus(%d)", uint16(s))
+}
+
+// DesktopSizeError is returned when the server rejects a SetDesktopSize
+// request.
+type DesktopSizeError struct {
+	Status DesktopSizeStatus
+}
+
+// Error implements the error interface.
+func (e *DesktopSizeError) Error() string {
+	return fmt.Sprintf("desktop size change rejected; %s", e.Status)
+}
+
+//-----------------------------------------------------------------------------
+// ExtendedDesktopSize Pseudo-Encoding
+//
+// ExtendedDesktopSize replaces DesktopSize, adding the layout of the screens
+// making up the desktop, and the result of client requested changes.
+
+// ExtendedDesktopSizePseudoEncoding represents an ExtendedDesktopSize message
+// from the server.
+type ExtendedDesktopSizePseudoEncoding struct {
+	Reason  DesktopSizeReason
+	Status  DesktopSizeStatus
+	Screens []Screen
+}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*ExtendedDesktopSizePseudoEncoding)(nil)
+
+// extendedDesktopSizeHeader holds the wire format, sans the screens field.
+type extendedDesktopSizeHeader struct {
+	NumScreens uint8   // number-of-screens
+	_          [3]byte // padding
+}
+
+// Err returns a *DesktopSizeError if the update rejects a requested change.
+func (e *ExtendedDesktopSizePseudoEncoding) Err() error {
+	switch e.Status {
+	case DesktopSizeOK, DesktopSizeForwarded:
+		return nil
+	}
+	return &DesktopSizeError{e.Status}
+}
+
+// Marshal implements the Marshaler interface.
+func (*ExtendedDesktopSizePseudoEncoding) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Read implements the Encoding interface.
+func (*ExtendedDesktopSizePseudoEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	var header extendedDesktopSizeHeader
+	if err := c.receive(&header); err != nil {
+		return nil, fmt.Errorf("unable to read ExtendedDesktopSize header: %s", err)
+	}
+	screens := make([]Screen, header.NumScreens)
+	if err := c.receive(screens); err != nil {
+		return nil, fmt.Errorf("unable to read ExtendedDesktopSize screens: %s", err)
+	}
+	enc := &ExtendedDesktopSizePseudoEncoding{
+		Reason:  DesktopSizeReason(rect.X),
+		Status:  DesktopSizeStatus(rect.Y),
+		Screens: screens,
+	}
+
+	// A rejected request is answered with the current size and layout.
+	c.stateMu.Lock()
+	c.fbWidth = rect.Width
+	c.fbHeight = rect.Height
+	c.screens = screens
+	c.stateMu.Unlock()
+
+	if enc.Reason == DesktopSizeClient {
+		c.desktopSizeReply(enc.Err())
+	}
+	return enc, nil
+}
+
+// String implements the fmt.Stringer interface.
+func (*ExtendedDesktopSizePseudoEncoding) String() string {
+	return "ExtendedDesktopSizePseudoEncoding"
+}
+
+// Type implements the Encoding interface.
+func (*ExtendedDesktopSizePseudoEncoding) Type() encodings.Encoding {
+	return encodings.ExtendedDesktopSizePseudo
+}
+
+//-----------------------------------------------------------------------------
+// SetDesktopSize Message
+
+// SetDesktopSizeMessage holds the wire format message, sans the screens field.
+type SetDesktopSizeMessage struct {
+	Msg           messages.ClientMessage // message-type
+	_             [1]byte                // padding
+	Width, Height uint16                 // width, height
+	NumScreens    uint8                  // number-of-screens
+	_             [1]byte                // padding
+}
+
+// maxScreens is the most screens a SetDesktopSize message can describe.
+const maxScreens = 255
+
+// SetDesktopSize requests that the server change the desktop to the given
+// size and screen layout, and waits for the server to reply or ctx to be done.
+// The client must have enabled the ExtendedDesktopSize pseudo-encoding, and
+// ListenAndHandle must be running to receive the reply. If the server rejects
+// the layout, a *DesktopSizeError is returned.
+func (c *ClientConn) SetDesktopSize(ctx context.Context, width, height uint16, screens []Screen) error {
+	if logging.V(logging.FnDeclLevel) {
+		glog.Infof("ClientConn.%s", logging.FnNameWithArgs("%d, %d, %v", width, height, screens))
+	}
+
+	if len(screens) == 0 || len(screens) > maxScreens {
+		return Errorf("invalid number of screens %d; must be between 1 and %d", len(screens), maxScreens)
+	}
+	if !c.hasEncoding(encodings.ExtendedDesktopSizePseudo) {
+		return NewVNCError("SetDesktopSize requires the ExtendedDesktopSize pseudo-encoding")
+	}
+
+	// Only one request may wait at a time, so that replies are not confused.
+	c.desktopSizeReqMu.Lock()
+	defer c.desktopSizeReqMu.Unlock()
+
+	buf := NewBuffer(nil)
+	msg := SetDesktopSizeMessage{
+		Msg:        messages.SetDesktopSize,
+		Width:      width,
+		Height:     height,
+		NumScreens: uint8(len(screens)),
+	}
+	if err := buf.Write(msg); err != nil {
+		return err
+	}
+	if err := buf.Write(screens); err != nil {
+		return err
+	}
+
+	result := make(chan error, 1)
+	c.desktopSizeMu.Lock()
+	c.desktopSizePending++
+	c.desktopSizeResult = result
+	c.desktopSizeMu.Unlock()
+	defer func() {
+		c.desktopSizeMu.Lock()
+		c.desktopSizeResult = nil
+		c.desktopSizeMu.Unlock()
+	}()
+
+	if err := c.send(buf.Bytes()); err != nil {
+		c.desktopSizeMu.Lock()
+		c.desktopSizePending--
+		c.desktopSizeMu.Unlock()
+		return err
+	}
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return NewVNCError("connection closed before the server replied to SetDesktopSize")
+	}
+}
+
+// desktopSizeReply delivers the server reply to a SetDesktopSize request.
+// Replies are sent in the order of the requests, so those to requests which
+// were given up on are dropped, as are unsolicited replies.
+func (c *ClientConn) desktopSizeReply(err error) {
+	c.desktopSizeMu.Lock()
+	defer c.desktopSizeMu.Unlock()
+
+	if c.desktopSizePending == 0 {
+		return // Unsolicited.
+	}
+	c.desktopSizePending--
+	if c.desktopSizePending > 0 || c.desktopSizeResult == nil {
+		return // Stale.
+	}
+	c.desktopSizeResult <- err
+	c.desktopSizeResult = nil
+}
+
+// Screens returns a copy of the server provided screen layout, if the
+// ExtendedDesktopSize pseudo-encoding is enabled.
+func (c *ClientConn) Screens() []Screen {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return append([]Screen(nil), c.screens...)
+}
+
+// hasEncoding reports whether the client supports the encoding.
+func (c *ClientConn) hasEncoding(e encodings.Encoding) bool {
+	for _, v := range c.Encodings() {
+		if v.Type() == e {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,286 @@
+package vnc
+
+import (
+	"encoding/binary"
+	"image"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kward/go-vnc/encodings"
+	"github.com/kward/go-vnc/messages"
+	"golang.org/x/net/context"
+)
+
+// extendedDesktopSizeData returns the wire format of an ExtendedDesktopSize
+// rectangle's screens.
+func extendedDesktopSizeData(t *testing.T, screens []Screen) []byte {
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+	if err := conn.send(extendedDesktopSizeHeader{NumScreens: uint8(len(screens))}); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.send(screens); err != nil {
+		t.Fatal(err)
+	}
+	return mockConn.b.Bytes()
+}
+
+func TestExtendedDesktopSizePseudoEncoding_Type(t *testing.T) {
+	if got, want := (&ExtendedDesktopSizePseudoEncoding{}).Type(), encodings.ExtendedDesktopSizePseudo; got != want {
+		t.Errorf("incorrect encoding; got = %s, want = %s", got, want)
+	}
+}
+
+func TestExtendedDesktopSizePseudoEncoding_Read(t *testing.T) {
+	screens := []Screen{
+		{ID: 1, X: 0, Y: 0, Width: 1024, Height: 768},
+		{ID: 2, X: 1024, Y: 0, Width: 800, Height: 600, Flags: 0x80},
+	}
+
+	for _, tt := range []struct {
+		desc   string
+		rect   Rectangle
+		data   []byte
+		enc    *ExtendedDesktopSizePseudoEncoding
+		result bool // Whether a SetDesktopSize result is delivered.
+		err    bool
+		ok     bool
+	}{
+		{"server change",
+			Rectangle{X: 0, Y: 0, Width: 1824, Height: 768},
+			extendedDesktopSizeData(t, screens),
+			&ExtendedDesktopSizePseudoEncoding{DesktopSizeServer, DesktopSizeOK, screens},
+			false, false, true},
+		{"client request accepted",
+			Rectangle{X: 1, Y: 0, Width: 1824, Height: 768},
+			extendedDesktopSizeData(t, screens),
+			&ExtendedDesktopSizePseudoEncoding{DesktopSizeClient, DesktopSizeOK, screens},
+			true, false, true},
+		{"client request rejected",
+			Rectangle{X: 1, Y: 3, Width: 1024, Height: 768},
+			extendedDesktopSizeData(t, screens[:1]),
+			&ExtendedDesktopSizePseudoEncoding{DesktopSizeClient, DesktopSizeInvalidLayout, screens[:1]},
+			true, true, true},
+		{"other client request",
+			Rectangle{X: 2, Y: 0, Width: 1024, Height: 768},
+			extendedDesktopSizeData(t, screens[:1]),
+			&ExtendedDesktopSizePseudoEncoding{DesktopSizeOtherClient, DesktopSizeOK, screens[:1]},
+			false, false, true},
+		{"short data",
+			Rectangle{Width: 1024, Height: 768},
+			extendedDesktopSizeData(t, screens)[:20],
+			nil,
+			false, false, false},
+	} {
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, &ClientConfig{})
+		result := make(chan error, 1)
+		conn.desktopSizePending, conn.desktopSizeResult = 1, result
+		if err := conn.send(tt.data); err != nil {
+			t.Fatal(err)
+		}
+		enc, err := (&ExtendedDesktopSizePseudoEncoding{}).Read(conn, &tt.rect)
+		if err == nil && !tt.ok {
+			t.Errorf("%s: expected error", tt.desc)
+			continue
+		}
+		if err != nil && tt.ok {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if got, want := enc, tt.enc; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: incorrect encoding; got = %v, want = %v", tt.desc, got, want)
+		}
+		if got, want := conn.FramebufferWidth(), tt.rect.Width; got != want {
+			t.Errorf("%s: incorrect width; got = %d, want = %d", tt.desc, got, want)
+		}
+		if got, want := conn.FramebufferHeight(), tt.rect.Height; got != want {
+			t.Errorf("%s: incorrect height; got = %d, want = %d", tt.desc, got, want)
+		}
+		if got, want := conn.Screens(), tt.enc.Screens; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: incorrect screens; got = %v, want = %v", tt.desc, got, want)
+		}
+		conn.Screens()[0].Width++
+		if got, want := conn.Screens(), tt.enc.Screens; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: screens modified through Screens(); got = %v, want = %v", tt.desc, got, want)
+		}
+
+		select {
+		case err := <-result:
+			if !tt.result {
+				t.Errorf("%s: unexpected SetDesktopSize result %v", tt.desc, err)
+			}
+			if err == nil && tt.err {
+				t.Errorf("%s: expected error", tt.desc)
+			}
+			if err != nil && !tt.err {
+				t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			}
+		default:
+			if tt.result {
+				t.Errorf("%s: expected SetDesktopSize result", tt.desc)
+			}
+		}
+	}
+}
+
+func TestExtendedDesktopSizePseudoEncoding_ReadConcurrent(t *testing.T) {
+	screens := []Screen{{ID: 1, X: 0, Y: 0, Width: 1024, Height: 768}}
+	data := extendedDesktopSizeData(t, screens)
+
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+
+	// The state is read while the server message handler updates it.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			conn.FramebufferWidth()
+			conn.FramebufferHeight()
+			conn.Screens()
+			conn.hasEncoding(encodings.ExtendedDesktopSizePseudo)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if err := conn.send(data); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := (&ExtendedDesktopSizePseudoEncoding{}).Read(conn, &Rectangle{Width: 1024, Height: 768}); err != nil {
+			t.Fatalf("unexpected error; %s", err)
+		}
+	}
+	<-done
+}
+
+func TestSetDesktopSize(t *testing.T) {
+	screens := []Screen{{ID: 1, Width: 1280, Height: 720}}
+
+	for _, tt := range []struct {
+		desc    string
+		encs    Encodings
+		screens []Screen
+		result  error // The SetDesktopSize result from the server.
+		reply   bool  // Whether the server replies.
+		closed  bool  // Whether the connection is closed without a result.
+		sent    bool
+		err     error
+	}{
+		{"accepted",
+			Encodings{&ExtendedDesktopSizePseudoEncoding{}}, screens, nil, true, false,
+			true, nil},
+		{"rejected",
+			Encodings{&ExtendedDesktopSizePseudoEncoding{}}, screens, &DesktopSizeError{DesktopSizeProhibited}, true, false,
+			true, &DesktopSizeError{DesktopSizeProhibited}},
+		{"connection closed",
+			Encodings{&ExtendedDesktopSizePseudoEncoding{}}, screens, nil, false, true,
+			true, NewVNCError("connection closed before the server replied to SetDesktopSize")},
+		{"timed out",
+			Encodings{&ExtendedDesktopSizePseudoEncoding{}}, screens, nil, false, false,
+			true, context.DeadlineExceeded},
+		{"no screens",
+			Encodings{&ExtendedDesktopSizePseudoEncoding{}}, nil, nil, false, false,
+			false, Errorf("invalid number of screens 0; must be between 1 and 255")},
+		{"not enabled",
+			Encodings{&DesktopSizePseudoEncoding{}}, screens, nil, false, false,
+			false, NewVNCError("SetDesktopSize requires the ExtendedDesktopSize pseudo-encoding")},
+	} {
+		client, server := net.Pipe()
+		conn := NewClientConn(client, &ClientConfig{})
+		conn.encodings = tt.encs
+
+		// The server reads the request, then replies as the server message
+		// handler would.
+		type request struct {
+			msg     SetDesktopSizeMessage
+			screens []Screen
+			err     error
+		}
+		requests := make(chan request, 1)
+		go func() {
+			var req request
+			defer func() { requests <- req }()
+			if req.err = binary.Read(server, binary.BigEndian, &req.msg); req.err != nil {
+				return
+			}
+			req.screens = make([]Screen, req.msg.NumScreens)
+			if req.err = binary.Read(server, binary.BigEndian, req.screens); req.err != nil {
+				return
+			}
+			switch {
+			case tt.reply:
+				conn.desktopSizeReply(tt.result)
+			case tt.closed:
+				close(conn.done)
+			}
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		err := conn.SetDesktopSize(ctx, 1280, 720, tt.screens)
+		cancel()
+		client.Close()
+		if got, want := err, tt.err; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: incorrect error; got = %v, want = %v", tt.desc, got, want)
+		}
+		req := <-requests
+		if !tt.sent {
+			if req.err == nil {
+				t.Errorf("%s: unexpected message", tt.desc)
+			}
+			continue
+		}
+		if req.err != nil {
+			t.Fatalf("%s: unexpected error reading request; %s", tt.desc, req.err)
+		}
+
+		// Validate the request.
+		if got, want := req.msg.Msg, messages.SetDesktopSize; got != want {
+			t.Errorf("%s: incorrect message-type; got = %v, want = %v", tt.desc, got, want)
+		}
+		if got, want := image.Pt(int(req.msg.Width), int(req.msg.Height)), image.Pt(1280, 720); got != want {
+			t.Errorf("%s: incorrect size; got = %v, want = %v", tt.desc, got, want)
+		}
+		if got, want := req.screens, tt.screens; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: incorrect screens; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
+
+func TestDesktopSizeReply(t *testing.T) {
+	conn := NewClientConn(&MockConn{}, &ClientConfig{})
+	rejected := &DesktopSizeError{DesktopSizeProhibited}
+
+	// An unsolicited reply is dropped.
+	conn.desktopSizeReply(rejected)
+	if got := conn.desktopSizePending; got != 0 {
+		t.Errorf("unsolicited: incorrect pending requests; got = %d, want = 0", got)
+	}
+
+	// The reply to a request given up on is dropped, and the next reply
+	// delivered to the request waiting.
+	result := make(chan error, 1)
+	conn.desktopSizePending, conn.desktopSizeResult = 2, result
+	conn.desktopSizeReply(rejected)
+	select {
+	case err := <-result:
+		t.Errorf("stale: unexpected result %v", err)
+	default:
+	}
+	conn.desktopSizeReply(nil)
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("current: unexpected error; %s", err)
+		}
+	default:
+		t.Errorf("current: expected result")
+	}
+	if got := conn.desktopSizePending; got != 0 {
+		t.Errorf("current: incorrect pending requests; got = %d, want = 0", got)
+	}
+}
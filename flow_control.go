@@ -0,0 +1,325 @@
+/*
+Implementation of the ContinuousUpdates and Fence extensions, which allow the
+server to stream updates without waiting for FramebufferUpdateRequest
+messages, and the client to synchronise with the server.
+https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#enablecontinuousupdates
+https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#clientfence
+*/
+package vnc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/CambridgeSoftwareLtd/go-vnc/encodings"
+	"github.com/CambridgeSoftwareLtd/go-vnc/logging"
+	"github.com/CambridgeSoftwareLtd/go-vnc/messages"
+	"github.com/CambridgeSoftwareLtd/go-vnc/rfbflags"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+//-----------------------------------------------------------------------------
+// ContinuousUpdates Pseudo-Encoding
+//
+// A client requesting the ContinuousUpdates pseudo-encoding indicates that it
+// supports the EnableContinuousUpdates and EndOfContinuousUpdates messages.
+
+// ContinuousUpdatesPseudoEncoding is sent by the client to indicate support
+// for continuous updates.
+type ContinuousUpdatesPseudoEncoding struct{}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*ContinuousUpdatesPseudoEncoding)(nil)
+
+// Marshal implements the Marshaler interface.
+func (*ContinuousUpdatesPseudoEncoding) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Read implements the Encoding interface.
+func (e *ContinuousUpdatesPseudoEncoding) Read(*ClientConn, *Rectangle) (Encoding, error) {
+	return nil, clientOnlyEncodingError(e)
+}
+
+// String implements the fmt.Stringer interface.
+func (*ContinuousUpdatesPseudoEncoding) String() string { return "ContinuousUpdatesPseudoEncoding" }
+
+// Type implements the Encoding interface.
+func (*ContinuousUpdatesPseudoEncoding) Type() encodings.Encoding {
+	return encodings.ContinuousUpdatesPseudo
+}
+
+// EnableContinuousUpdatesMessage holds the wire format message.
+type EnableContinuousUpdatesMessage struct {
+	Msg           messages.ClientMessage // message-type
+	Enable        rfbflags.RFBFlag       // enable-flag
+	X, Y          uint16                 // x-position, y-position
+	Width, Height uint16                 // width, height
+}
+
+// EnableContinuousUpdates asks the server to send updates of the given area
+// of the framebuffer as it changes, without FramebufferUpdateRequest
+// messages. Disabling continuous updates is confirmed by the server with an
+// EndOfContinuousUpdates message.
+//
+// The server must first have indicated its support with an
+// EndOfContinuousUpdates message.
+func (c *ClientConn) EnableContinuousUpdates(enable bool, x, y, w, h uint16) error {
+	if logging.V(logging.FnDeclLevel) {
+		glog.Infof("ClientConn.%s", logging.FnNameWithArgs("%t, %d, %d, %d, %d", enable, x, y, w, h))
+	}
+
+	if !c.ContinuousUpdatesSupported() {
+		return NewVNCError("server does not support continuous updates")
+	}
+	msg := EnableContinuousUpdatesMessage{messages.EnableContinuousUpdates, rfbflags.BoolToRFBFlag(enable), x, y, w, h}
+	return c.send(&msg)
+}
+
+// ContinuousUpdatesSupported reports whether the server supports continuous
+// updates.
+func (c *ClientConn) ContinuousUpdatesSupported() bool {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.continuousUpdates
+}
+
+// EndOfContinuousUpdates is sent by the server when continuous updates are
+// disabled, and to indicate its support for them.
+type EndOfContinuousUpdates struct{}
+
+// Verify that interfaces are honored.
+var _ ServerMessage = (*EndOfContinuousUpdates)(nil)
+
+// Type implements the ServerMessage interface.
+func (*EndOfContinuousUpdates) Type() messages.ServerMessage {
+	return messages.EndOfContinuousUpdates
+}
+
+// Read implements the ServerMessage interface.
+func (*EndOfContinuousUpdates) Read(c *ClientConn) (ServerMessage, error) {
+	if logging.V(logging.FnDeclLevel) {
+		glog.Info("EndOfContinuousUpdates." + logging.FnName())
+	}
+	c.stateMu.Lock()
+	c.continuousUpdates = true
+	c.stateMu.Unlock()
+	return &EndOfContinuousUpdates{}, nil
+}
+
+//-----------------------------------------------------------------------------
+// Fence Pseudo-Encoding
+//
+// A client requesting the Fence pseudo-encoding indicates that it supports
+// Fence messages. Fences synchronise the client and server, and a request
+// echoed back by the other side measures the round trip time.
+
+// FencePseudoEncoding is sent by the client to indicate support for fences.
+type FencePseudoEncoding struct{}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*FencePseudoEncoding)(nil)
+
+// Marshal implements the Marshaler interface.
+func (*FencePseudoEncoding) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Read implements the Encoding interface.
+func (e *FencePseudoEncoding) Read(*ClientConn, *Rectangle) (Encoding, error) {
+	return nil, clientOnlyEncodingError(e)
+}
+
+// String implements the fmt.Stringer interface.
+func (*FencePseudoEncoding) String() string { return "FencePseudoEncoding" }
+
+// Type implements the Encoding interface.
+func (*FencePseudoEncoding) Type() encodings.Encoding { return encodings.FencePseudo }
+
+// FenceFlag is a bitwise mask of the flags of a Fence message.
+type FenceFlag uint32
+
+const (
+	// FenceBlockBefore requires all preceding messages to have been
+	// processed before the fence is answered.
+	FenceBlockBefore FenceFlag = 1 << 0
+	// FenceBlockAfter requires no following messages to be processed until
+	// the fence is answered.
+	FenceBlockAfter FenceFlag = 1 << 1
+	// FenceSyncNext requires the message following the fence to be processed
+	// together with the response.
+	FenceSyncNext FenceFlag = 1 << 2
+	// FenceRequest marks a fence which must be answered.
+	FenceRequest FenceFlag = 1 << 31
+
+	// fenceSupported are the flags the client understands. Messages are
+	// processed in order as they are received, and a request is answered as
+	// soon as it is read, which satisfies every flag.
+	fenceSupported = FenceBlockBefore | FenceBlockAfter | FenceSyncNext | FenceRequest
+)
+
+// maxFencePayload is the longest payload of a Fence message.
+const maxFencePayload = 64
+
+// ClientFenceMessage holds the wire format message, sans the payload field.
+type ClientFenceMessage struct {
+	Msg    messages.ClientMessage // message-type
+	_      [3]byte                // padding
+	Flags  FenceFlag              // flags
+	Length uint8                  // length
+}
+
+// Fence sends a fence to the server. If flags includes FenceRequest, the
+// server answers with a ServerFence holding the same payload.
+//
+// The server must first have indicated its support with a ServerFence.
+func (c *ClientConn) Fence(flags FenceFlag, payload []byte) error {
+	if logging.V(logging.FnDeclLevel) {
+		glog.Infof("ClientConn.%s", logging.FnNameWithArgs("%#x, %v", flags, payload))
+	}
+
+	if !c.FenceSupported() {
+		return NewVNCError("server does not support fences")
+	}
+	return c.sendFence(flags, payload)
+}
+
+// FenceSupported reports whether the server supports fences.
+func (c *ClientConn) FenceSupported() bool {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.fence
+}
+
+// FenceRoundTrip sends a fence request to the server, and waits for the
+// reply holding the same payload or ctx to be done. It returns the round
+// trip time, which includes the processing of the messages sent before, as
+// the fence blocks on them. ListenAndHandle must be running to receive the
+// reply.
+//
+// The server must first have indicated its support with a ServerFence.
+func (c *ClientConn) FenceRoundTrip(ctx context.Context) (time.Duration, error) {
+	if logging.V(logging.FnDeclLevel) {
+		glog.Info("ClientConn." + logging.FnName())
+	}
+
+	if !c.FenceSupported() {
+		return 0, NewVNCError("server does not support fences")
+	}
+
+	reply := make(chan struct{})
+	payload := make([]byte, 8)
+	c.stateMu.Lock()
+	c.fenceSeq++
+	binary.BigEndian.PutUint64(payload, c.fenceSeq)
+	if c.fenceReplies == nil {
+		c.fenceReplies = make(map[string]chan struct{})
+	}
+	c.fenceReplies[string(payload)] = reply
+	c.stateMu.Unlock()
+	defer func() {
+		c.stateMu.Lock()
+		delete(c.fenceReplies, string(payload))
+		c.stateMu.Unlock()
+	}()
+
+	start := time.Now()
+	if err := c.sendFence(FenceBlockBefore|FenceRequest, payload); err != nil {
+		return 0, err
+	}
+	select {
+	case <-reply:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-c.done:
+		return 0, NewVNCError("connection closed before the server replied to the fence")
+	}
+}
+
+// fenceReply delivers the reply to a fence request sent by FenceRoundTrip.
+// Replies to other fences are ignored.
+func (c *ClientConn) fenceReply(payload []byte) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if reply, ok := c.fenceReplies[string(payload)]; ok {
+		close(reply)
+		delete(c.fenceReplies, string(payload))
+	}
+}
+
+// sendFence sends a Fence message as a single write, so that it is not split
+// by messages sent from another goroutine.
+func (c *ClientConn) sendFence(flags FenceFlag, payload []byte) error {
+	if len(payload) > maxFencePayload {
+		return Errorf("fence payload of %d bytes is longer than %d bytes", len(payload), maxFencePayload)
+	}
+
+	buf := NewBuffer(nil)
+	msg := ClientFenceMessage{
+		Msg:    messages.ClientFence,
+		Flags:  flags,
+		Length: uint8(len(payload)),
+	}
+	if err := buf.Write(msg); err != nil {
+		return err
+	}
+	if err := buf.Write(payload); err != nil {
+		return err
+	}
+	return c.send(buf.Bytes())
+}
+
+// ServerFence represents the wire format message, sans message-type and
+// padding.
+type ServerFence struct {
+	Flags   FenceFlag
+	Payload []byte
+}
+
+// Verify that interfaces are honored.
+var _ ServerMessage = (*ServerFence)(nil)
+
+// Type implements the ServerMessage interface.
+func (*ServerFence) Type() messages.ServerMessage { return messages.ServerFence }
+
+// Read implements the ServerMessage interface. A fence request is answered
+// before Read returns.
+func (*ServerFence) Read(c *ClientConn) (ServerMessage, error) {
+	if logging.V(logging.FnDeclLevel) {
+		glog.Info("ServerFence." + logging.FnName())
+	}
+
+	var msg struct {
+		_      [3]byte   // padding
+		Flags  FenceFlag // flags
+		Length uint8     // length
+	}
+	if err := c.receive(&msg); err != nil {
+		return nil, err
+	}
+	if msg.Length > maxFencePayload {
+		return nil, fmt.Errorf("fence payload of %d bytes is longer than %d bytes", msg.Length, maxFencePayload)
+	}
+	payload := make([]uint8, msg.Length)
+	if err := c.receive(&payload); err != nil {
+		return nil, err
+	}
+	c.stateMu.Lock()
+	c.fence = true
+	c.stateMu.Unlock()
+
+	if msg.Flags&FenceRequest != 0 {
+		// Flags which are not understood are cleared in the response.
+		flags := msg.Flags & fenceSupported &^ FenceRequest
+		if err := c.sendFence(flags, payload); err != nil {
+			return nil, fmt.Errorf("unable to answer fence: %s", err)
+		}
+	} else {
+		c.fenceReply(payload)
+	}
+
+	return &ServerFence{msg.Flags, payload}, nil
+}
@@ -0,0 +1,226 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kward/go-vnc/messages"
+	"github.com/kward/go-vnc/rfbflags"
+	"golang.org/x/net/context"
+)
+
+func TestEnableContinuousUpdates(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+
+	if err := conn.EnableContinuousUpdates(true, 0, 0, 10, 10); err == nil {
+		t.Errorf("expected error before the server indicated support")
+	}
+	if got := mockConn.b.Len(); got != 0 {
+		t.Errorf("unexpected message of %d bytes", got)
+	}
+
+	// The server indicates support with an EndOfContinuousUpdates message.
+	if _, err := (&EndOfContinuousUpdates{}).Read(conn); err != nil {
+		t.Fatalf("unexpected error; %s", err)
+	}
+	if !conn.ContinuousUpdatesSupported() {
+		t.Fatalf("continuous updates not supported")
+	}
+
+	for _, tt := range []struct {
+		enable     bool
+		x, y, w, h uint16
+	}{
+		{true, 0, 0, 1024, 768},
+		{false, 10, 20, 30, 40},
+	} {
+		mockConn.Reset()
+		if err := conn.EnableContinuousUpdates(tt.enable, tt.x, tt.y, tt.w, tt.h); err != nil {
+			t.Errorf("unexpected error; %s", err)
+			continue
+		}
+
+		// Read back in.
+		var req EnableContinuousUpdatesMessage
+		if err := conn.receive(&req); err != nil {
+			t.Fatal(err)
+		}
+
+		// Validate the request.
+		want := EnableContinuousUpdatesMessage{messages.EnableContinuousUpdates, rfbflags.BoolToRFBFlag(tt.enable), tt.x, tt.y, tt.w, tt.h}
+		if req != want {
+			t.Errorf("incorrect message; got = %v, want = %v", req, want)
+		}
+	}
+}
+
+func TestServerFence_Read(t *testing.T) {
+	for _, tt := range []struct {
+		desc     string
+		data     []byte
+		fence    *ServerFence
+		response []byte // The fence sent back to the server, if any.
+		ok       bool
+	}{
+		{"response",
+			[]byte{0, 0, 0, 0, 0, 0, 0, 2, 'h', 'i'},
+			&ServerFence{0, []byte("hi")},
+			nil,
+			true},
+		{"request",
+			[]byte{0, 0, 0, 0x80, 0, 0, 0x03, 1, 'x'},
+			&ServerFence{FenceRequest | FenceBlockBefore | FenceBlockAfter, []byte("x")},
+			[]byte{248, 0, 0, 0, 0, 0, 0, 0x03, 1, 'x'},
+			true},
+		{"request with unknown flags",
+			[]byte{0, 0, 0, 0x80, 0, 0, 0x0c, 0},
+			&ServerFence{FenceRequest | FenceSyncNext | 1<<3, []byte{}},
+			[]byte{248, 0, 0, 0, 0, 0, 0, 0x04, 0},
+			true},
+		{"payload too long",
+			[]byte{0, 0, 0, 0, 0, 0, 0, 65},
+			nil,
+			nil,
+			false},
+	} {
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, &ClientConfig{})
+		if err := conn.send(tt.data); err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := (&ServerFence{}).Read(conn)
+		if err == nil && !tt.ok {
+			t.Errorf("%s: expected error", tt.desc)
+			continue
+		}
+		if err != nil && tt.ok {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if got, want := msg.(*ServerFence), tt.fence; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: incorrect fence; got = %v, want = %v", tt.desc, got, want)
+		}
+		if !conn.FenceSupported() {
+			t.Errorf("%s: fences not supported", tt.desc)
+		}
+		if got, want := mockConn.b.Bytes(), tt.response; !bytes.Equal(got, want) {
+			t.Errorf("%s: incorrect response; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
+
+func TestFence(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+
+	if err := conn.Fence(FenceRequest, nil); err == nil {
+		t.Errorf("expected error before the server indicated support")
+	}
+	conn.fence = true
+
+	for _, tt := range []struct {
+		desc    string
+		flags   FenceFlag
+		payload []byte
+		data    []byte
+		ok      bool
+	}{
+		{"request",
+			FenceRequest | FenceBlockBefore, []byte{1, 2, 3},
+			[]byte{248, 0, 0, 0, 0x80, 0, 0, 0x01, 3, 1, 2, 3},
+			true},
+		{"empty payload",
+			FenceSyncNext, nil,
+			[]byte{248, 0, 0, 0, 0, 0, 0, 0x04, 0},
+			true},
+		{"payload too long",
+			FenceRequest, make([]byte, maxFencePayload+1),
+			nil,
+			false},
+	} {
+		mockConn.Reset()
+		err := conn.Fence(tt.flags, tt.payload)
+		if err == nil && !tt.ok {
+			t.Errorf("%s: expected error", tt.desc)
+			continue
+		}
+		if err != nil && tt.ok {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+		if got, want := mockConn.b.Bytes(), tt.data; !bytes.Equal(got, want) {
+			t.Errorf("%s: incorrect message; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
+
+func TestFenceRoundTrip(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := NewClientConn(client, &ClientConfig{})
+
+	if _, err := conn.FenceRoundTrip(context.Background()); err == nil {
+		t.Errorf("expected error before the server indicated support")
+	}
+	conn.fence = true
+
+	// The server answers the request after a reply to another fence, which
+	// the client handles as the server message handler would.
+	go func() {
+		var msg ClientFenceMessage
+		if err := binary.Read(server, binary.BigEndian, &msg); err != nil {
+			return
+		}
+		payload := make([]byte, msg.Length)
+		if _, err := io.ReadFull(server, payload); err != nil {
+			return
+		}
+		if msg.Flags&FenceRequest == 0 {
+			t.Errorf("incorrect flags %#x", msg.Flags)
+		}
+		for _, p := range [][]byte{[]byte("other"), payload} {
+			server.Write(append([]byte{0, 0, 0, 0, 0, 0, 0, uint8(len(p))}, p...))
+		}
+	}()
+	handled := make(chan error, 1)
+	go func() {
+		for i := 0; i < 2; i++ {
+			if _, err := (&ServerFence{}).Read(conn); err != nil {
+				handled <- err
+				return
+			}
+		}
+		handled <- nil
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := conn.FenceRoundTrip(ctx); err != nil {
+		t.Errorf("unexpected error; %s", err)
+	}
+	if err := <-handled; err != nil {
+		t.Errorf("unexpected error handling fences; %s", err)
+	}
+
+	// Without a reply, the wait ends with the context.
+	go io.Copy(ioutil.Discard, server)
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := conn.FenceRoundTrip(ctx); err != context.DeadlineExceeded {
+		t.Errorf("incorrect error; got = %v, want = %v", err, context.DeadlineExceeded)
+	}
+	if got := len(conn.fenceReplies); got != 0 {
+		t.Errorf("%d fences left waiting", got)
+	}
+}
@@ -0,0 +1,235 @@
+// Client-side framebuffer, composed from FramebufferUpdate messages.
+
+package vnc
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"sync"
+
+	"github.com/CambridgeSoftwareLtd/go-vnc/logging"
+	"github.com/golang/glog"
+)
+
+// Framebuffer holds the client's copy of the remote framebuffer. Every
+// rectangle of a FramebufferUpdate is applied to it in the order received.
+// It is safe for concurrent use.
+type Framebuffer struct {
+	mu      sync.RWMutex
+	img     *image.RGBA
+	cursor  *Cursor
+	pointer image.Point
+}
+
+// Cursor is the pointer shape set by the server.
+type Cursor struct {
+	// Image is the cursor shape, with transparency.
+	Image *image.NRGBA
+	// Hotspot is the position within Image of the pointer.
+	Hotspot image.Point
+}
+
+// NewFramebuffer returns a black framebuffer of the given size.
+func NewFramebuffer(width, height int) *Framebuffer {
+	return &Framebuffer{img: newFramebufferImage(width, height)}
+}
+
+func newFramebufferImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.Black, image.Point{}, draw.Src)
+	return img
+}
+
+// Bounds returns the current dimensions of the framebuffer.
+func (fb *Framebuffer) Bounds() image.Rectangle {
+	fb.mu.RLock()
+	defer fb.mu.RUnlock()
+	return fb.img.Bounds()
+}
+
+// Resize drops the framebuffer contents, replacing them with a black image of
+// the given size.
+func (fb *Framebuffer) Resize(width, height int) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	fb.img = newFramebufferImage(width, height)
+}
+
+// Snapshot returns a copy of the current framebuffer contents.
+func (fb *Framebuffer) Snapshot() *image.RGBA {
+	fb.mu.RLock()
+	defer fb.mu.RUnlock()
+	return fb.snapshot()
+}
+
+// snapshot returns a copy of the current framebuffer contents. The caller
+// must hold fb.mu.
+func (fb *Framebuffer) snapshot() *image.RGBA {
+	img := &image.RGBA{
+		Pix:    make([]uint8, len(fb.img.Pix)),
+		Stride: fb.img.Stride,
+		Rect:   fb.img.Rect,
+	}
+	copy(img.Pix, fb.img.Pix)
+	return img
+}
+
+// SnapshotWithCursor returns a copy of the current framebuffer contents, with
+// the cursor drawn over it at the last known pointer position.
+func (fb *Framebuffer) SnapshotWithCursor() *image.RGBA {
+	fb.mu.RLock()
+	defer fb.mu.RUnlock()
+	img := fb.snapshot()
+	if fb.cursor != nil {
+		r := fb.cursor.Image.Bounds().Add(fb.pointer.Sub(fb.cursor.Hotspot))
+		draw.Draw(img, r, fb.cursor.Image, fb.cursor.Image.Bounds().Min, draw.Over)
+	}
+	return img
+}
+
+// Cursor returns the current cursor, or nil if the server has not set one.
+// The cursor must not be modified.
+func (fb *Framebuffer) Cursor() *Cursor {
+	fb.mu.RLock()
+	defer fb.mu.RUnlock()
+	return fb.cursor
+}
+
+// Pointer returns the last known pointer position.
+func (fb *Framebuffer) Pointer() image.Point {
+	fb.mu.RLock()
+	defer fb.mu.RUnlock()
+	return fb.pointer
+}
+
+// SetPointer records the pointer position.
+func (fb *Framebuffer) SetPointer(x, y int) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	fb.pointer = image.Pt(x, y)
+}
+
+// Apply draws the rectangles into the framebuffer in order, and returns the
+// regions of the framebuffer that were modified. Rectangles of encodings
+// unknown to the framebuffer, such as those added to ClientConfig, leave it
+// unchanged.
+func (fb *Framebuffer) Apply(rects []Rectangle) ([]image.Rectangle, error) {
+	if logging.V(logging.FnDeclLevel) {
+		glog.Info("Framebuffer." + logging.FnName())
+	}
+
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	var dirty []image.Rectangle
+	for i := range rects {
+		r, err := fb.apply(&rects[i])
+		if err != nil {
+			return dirty, err
+		}
+		if !r.Empty() {
+			dirty = append(dirty, r)
+		}
+	}
+	return dirty, nil
+}
+
+// apply draws a single rectangle, returning the modified region.
+func (fb *Framebuffer) apply(rect *Rectangle) (image.Rectangle, error) {
+	dst := image.Rect(int(rect.X), int(rect.Y), int(rect.X)+int(rect.Width), int(rect.Y)+int(rect.Height))
+
+	switch enc := rect.Enc.(type) {
+	case *RawEncoding:
+		return fb.drawColors(dst, enc.Colors)
+	case *CopyRectEncoding:
+		src := image.Pt(int(enc.X), int(enc.Y))
+		dst = dst.Intersect(fb.img.Bounds())
+		// draw.Draw handles overlapping source and destination regions.
+		draw.Draw(fb.img, dst, fb.img, src.Add(dst.Min.Sub(image.Pt(int(rect.X), int(rect.Y)))), draw.Src)
+		return dst, nil
+	case *RREncoding:
+		return fb.drawRRE(dst, enc), nil
+	case *CoRREncoding:
+		return fb.drawRRE(dst, (*RREncoding)(enc)), nil
+	case *HextileEncoding:
+		return fb.drawColors(dst, enc.Colors)
+	case *TightEncoding:
+		return fb.drawColors(dst, enc.Colors)
+	case *TightPNGEncoding:
+		return fb.drawColors(dst, enc.Colors)
+	case *TRLEncoding:
+		return fb.drawColors(dst, enc.Colors)
+	case *ZlibEncoding:
+		return fb.drawColors(dst, enc.Colors)
+	case *ZlibHexEncoding:
+		return fb.drawColors(dst, enc.Colors)
+	case *ZRLEncoding:
+		return fb.drawColors(dst, enc.Colors)
+	case *DesktopSizePseudoEncoding:
+		fb.img = newFramebufferImage(int(rect.Width), int(rect.Height))
+		return fb.img.Bounds(), nil
+	case *ExtendedDesktopSizePseudoEncoding:
+		// A rejected request, whose status is held in y-position, leaves
+		// the framebuffer unchanged.
+		if DesktopSizeStatus(rect.Y) != DesktopSizeOK {
+			return image.Rectangle{}, nil
+		}
+		fb.img = newFramebufferImage(int(rect.Width), int(rect.Height))
+		return fb.img.Bounds(), nil
+	case *CursorPseudoEncoding:
+		// The cursor is not part of the framebuffer.
+		if enc.Image != nil {
+			fb.cursor = &Cursor{enc.Image, enc.Hotspot}
+		}
+		return image.Rectangle{}, nil
+	case *XCursorPseudoEncoding:
+		fb.cursor = &Cursor{enc.Image, enc.Hotspot}
+		return image.Rectangle{}, nil
+	case *VMwareCursorPseudoEncoding:
+		fb.cursor = &Cursor{enc.Image, enc.Hotspot}
+		return image.Rectangle{}, nil
+	case *PointerPosPseudoEncoding:
+		fb.pointer = enc.Position
+		return image.Rectangle{}, nil
+	case *DesktopNamePseudoEncoding:
+		// The name is not part of the framebuffer.
+		return image.Rectangle{}, nil
+	case *QEMUExtendedKeyEventPseudoEncoding, *QEMUAudioPseudoEncoding:
+		return image.Rectangle{}, nil
+	default:
+		if logging.V(logging.ResultLevel) {
+			glog.Infof("Framebuffer: skipping unknown encoding %v", rect.Enc)
+		}
+		return image.Rectangle{}, nil
+	}
+}
+
+// drawRRE draws the background and sub-rectangles of an RRE or CoRRE
+// rectangle into the dst region.
+func (fb *Framebuffer) drawRRE(dst image.Rectangle, enc *RREncoding) image.Rectangle {
+	clip := dst.Intersect(fb.img.Bounds())
+	draw.Draw(fb.img, clip, image.NewUniform(&enc.BackColour), image.Point{}, draw.Src)
+	for i := range enc.Rects {
+		sr := &enc.Rects[i]
+		r := image.Rect(int(sr.X), int(sr.Y), int(sr.X)+int(sr.Width), int(sr.Y)+int(sr.Height))
+		r = r.Add(dst.Min).Intersect(clip)
+		draw.Draw(fb.img, r, image.NewUniform(&sr.BackColour), image.Point{}, draw.Src)
+	}
+	return clip
+}
+
+// drawColors draws a row-major slice of colors into the dst region.
+func (fb *Framebuffer) drawColors(dst image.Rectangle, colors []Color) (image.Rectangle, error) {
+	if len(colors) != dst.Dx()*dst.Dy() {
+		return image.Rectangle{}, fmt.Errorf("incorrect number of colors for rectangle %v; got %d, want %d", dst, len(colors), dst.Dx()*dst.Dy())
+	}
+	clip := dst.Intersect(fb.img.Bounds())
+	for y := clip.Min.Y; y < clip.Max.Y; y++ {
+		row := (y - dst.Min.Y) * dst.Dx()
+		for x := clip.Min.X; x < clip.Max.X; x++ {
+			fb.img.Set(x, y, &colors[row+x-dst.Min.X])
+		}
+	}
+	return clip, nil
+}
@@ -0,0 +1,296 @@
+package vnc
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+
+	"github.com/CambridgeSoftwareLtd/go-vnc/encodings"
+	"github.com/CambridgeSoftwareLtd/go-vnc/rfbflags"
+)
+
+// pixelFormat24bit is the common 32 bpp, depth 24, little-endian format.
+var pixelFormat24bit = PixelFormat{
+	BPP:        32,
+	Depth:      24,
+	BigEndian:  rfbflags.RFBFalse,
+	TrueColor:  rfbflags.RFBTrue,
+	RedMax:     255,
+	GreenMax:   255,
+	BlueMax:    255,
+	RedShift:   16,
+	GreenShift: 8,
+	BlueShift:  0,
+}
+
+func testColor(r, g, b uint16) Color {
+	return Color{pf: &pixelFormat24bit, R: r, G: g, B: b}
+}
+
+func TestColor_RGBA(t *testing.T) {
+	for _, tt := range []struct {
+		desc string
+		c    Color
+		want color.RGBA
+	}{
+		{"true color black", testColor(0, 0, 0), color.RGBA{0, 0, 0, 255}},
+		{"true color mixed", testColor(255, 128, 1), color.RGBA{255, 128, 1, 255}},
+		{"color map", Color{R: 0xffff, G: 0x8000, B: 0}, color.RGBA{255, 128, 0, 255}},
+	} {
+		if got, want := color.RGBAModel.Convert(&tt.c), tt.want; got != want {
+			t.Errorf("%s: incorrect color; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
+
+// customEncoding is an encoding unknown to the framebuffer.
+type customEncoding struct{}
+
+func (*customEncoding) String() string                                 { return "customEncoding" }
+func (*customEncoding) Marshal() ([]byte, error)                       { return nil, nil }
+func (*customEncoding) Read(*ClientConn, *Rectangle) (Encoding, error) { return &customEncoding{}, nil }
+func (*customEncoding) Type() encodings.Encoding                       { return 0x4242 }
+
+func TestFramebuffer_Apply(t *testing.T) {
+	red, green, blue := testColor(255, 0, 0), testColor(0, 255, 0), testColor(0, 0, 255)
+	black := color.RGBA{0, 0, 0, 255}
+	rgbaRed, rgbaGreen, rgbaBlue := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 255, 0, 255}, color.RGBA{0, 0, 255, 255}
+
+	for _, tt := range []struct {
+		desc   string
+		rects  []Rectangle
+		dirty  []image.Rectangle
+		bounds image.Rectangle
+		pixels map[image.Point]color.RGBA
+		ok     bool
+	}{
+		{"raw",
+			[]Rectangle{{X: 1, Y: 1, Width: 2, Height: 1, Enc: &RawEncoding{[]Color{red, green}}}},
+			[]image.Rectangle{image.Rect(1, 1, 3, 2)},
+			image.Rect(0, 0, 4, 4),
+			map[image.Point]color.RGBA{{0, 0}: black, {1, 1}: rgbaRed, {2, 1}: rgbaGreen, {3, 1}: black},
+			true},
+		{"raw clipped to framebuffer",
+			[]Rectangle{{X: 3, Y: 3, Width: 2, Height: 1, Enc: &RawEncoding{[]Color{blue, red}}}},
+			[]image.Rectangle{image.Rect(3, 3, 4, 4)},
+			image.Rect(0, 0, 4, 4),
+			map[image.Point]color.RGBA{{3, 3}: rgbaBlue},
+			true},
+		{"raw with too few colors",
+			[]Rectangle{{X: 0, Y: 0, Width: 2, Height: 2, Enc: &RawEncoding{[]Color{red}}}},
+			nil,
+			image.Rect(0, 0, 4, 4),
+			nil,
+			false},
+		{"copyrect after raw",
+			[]Rectangle{
+				{X: 0, Y: 0, Width: 2, Height: 1, Enc: &RawEncoding{[]Color{red, green}}},
+				{X: 1, Y: 2, Width: 2, Height: 1, Enc: &CopyRectEncoding{0, 0}},
+			},
+			[]image.Rectangle{image.Rect(0, 0, 2, 1), image.Rect(1, 2, 3, 3)},
+			image.Rect(0, 0, 4, 4),
+			map[image.Point]color.RGBA{{1, 2}: rgbaRed, {2, 2}: rgbaGreen, {0, 2}: black},
+			true},
+		{"overlapping copyrect",
+			[]Rectangle{
+				{X: 0, Y: 0, Width: 3, Height: 1, Enc: &RawEncoding{[]Color{red, green, blue}}},
+				{X: 1, Y: 0, Width: 2, Height: 1, Enc: &CopyRectEncoding{0, 0}},
+			},
+			[]image.Rectangle{image.Rect(0, 0, 3, 1), image.Rect(1, 0, 3, 1)},
+			image.Rect(0, 0, 4, 4),
+			map[image.Point]color.RGBA{{0, 0}: rgbaRed, {1, 0}: rgbaRed, {2, 0}: rgbaGreen},
+			true},
+		{"rre",
+			[]Rectangle{{X: 1, Y: 1, Width: 3, Height: 3, Enc: &RREncoding{
+				NumSubRects: 1,
+				BackColour:  blue,
+				Rects:       []RRERect{{BackColour: red, X: 1, Y: 1, Width: 1, Height: 2}},
+			}}},
+			[]image.Rectangle{image.Rect(1, 1, 4, 4)},
+			image.Rect(0, 0, 4, 4),
+			map[image.Point]color.RGBA{{0, 0}: black, {1, 1}: rgbaBlue, {2, 2}: rgbaRed, {2, 3}: rgbaRed, {3, 3}: rgbaBlue},
+			true},
+		{"zrle",
+			[]Rectangle{{X: 0, Y: 0, Width: 1, Height: 2, Enc: &ZRLEncoding{Colors: []Color{green, blue}}}},
+			[]image.Rectangle{image.Rect(0, 0, 1, 2)},
+			image.Rect(0, 0, 4, 4),
+			map[image.Point]color.RGBA{{0, 0}: rgbaGreen, {0, 1}: rgbaBlue},
+			true},
+		{"desktop size then raw",
+			[]Rectangle{
+				{X: 0, Y: 0, Width: 1, Height: 1, Enc: &RawEncoding{[]Color{red}}},
+				{X: 0, Y: 0, Width: 8, Height: 2, Enc: &DesktopSizePseudoEncoding{}},
+				{X: 7, Y: 1, Width: 1, Height: 1, Enc: &RawEncoding{[]Color{green}}},
+			},
+			[]image.Rectangle{image.Rect(0, 0, 1, 1), image.Rect(0, 0, 8, 2), image.Rect(7, 1, 8, 2)},
+			image.Rect(0, 0, 8, 2),
+			map[image.Point]color.RGBA{{0, 0}: black, {7, 1}: rgbaGreen},
+			true},
+		{"extended desktop size",
+			[]Rectangle{
+				{X: 0, Y: 0, Width: 1, Height: 1, Enc: &RawEncoding{[]Color{red}}},
+				{X: 0, Y: 0, Width: 6, Height: 3, Enc: &ExtendedDesktopSizePseudoEncoding{}},
+			},
+			[]image.Rectangle{image.Rect(0, 0, 1, 1), image.Rect(0, 0, 6, 3)},
+			image.Rect(0, 0, 6, 3),
+			map[image.Point]color.RGBA{{0, 0}: black},
+			true},
+		{"extended desktop size rejected",
+			[]Rectangle{
+				{X: 0, Y: 0, Width: 1, Height: 1, Enc: &RawEncoding{[]Color{red}}},
+				{X: 1, Y: 3, Width: 6, Height: 3, Enc: &ExtendedDesktopSizePseudoEncoding{Reason: DesktopSizeClient, Status: DesktopSizeInvalidLayout}},
+			},
+			[]image.Rectangle{image.Rect(0, 0, 1, 1)},
+			image.Rect(0, 0, 4, 4),
+			map[image.Point]color.RGBA{{0, 0}: rgbaRed},
+			true},
+		{"extended desktop size accepted at the same size",
+			[]Rectangle{
+				{X: 0, Y: 0, Width: 1, Height: 1, Enc: &RawEncoding{[]Color{red}}},
+				{X: 1, Y: 0, Width: 4, Height: 4, Enc: &ExtendedDesktopSizePseudoEncoding{Reason: DesktopSizeClient, Status: DesktopSizeOK}},
+			},
+			[]image.Rectangle{image.Rect(0, 0, 1, 1), image.Rect(0, 0, 4, 4)},
+			image.Rect(0, 0, 4, 4),
+			map[image.Point]color.RGBA{{0, 0}: black},
+			true},
+		{"unknown encoding is skipped",
+			[]Rectangle{
+				{X: 0, Y: 0, Width: 1, Height: 1, Enc: &customEncoding{}},
+				{X: 1, Y: 0, Width: 1, Height: 1, Enc: &RawEncoding{[]Color{red}}},
+			},
+			[]image.Rectangle{image.Rect(1, 0, 2, 1)},
+			image.Rect(0, 0, 4, 4),
+			map[image.Point]color.RGBA{{0, 0}: black, {1, 0}: rgbaRed},
+			true},
+		{"cursor is not drawn",
+			[]Rectangle{{X: 0, Y: 0, Width: 2, Height: 2, Enc: &CursorPseudoEncoding{}}},
+			nil,
+			image.Rect(0, 0, 4, 4),
+			map[image.Point]color.RGBA{{0, 0}: black},
+			true},
+	} {
+		fb := NewFramebuffer(4, 4)
+		dirty, err := fb.Apply(tt.rects)
+		if err == nil && !tt.ok {
+			t.Errorf("%s: expected error", tt.desc)
+			continue
+		}
+		if err != nil && tt.ok {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if got, want := dirty, tt.dirty; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: incorrect dirty regions; got = %v, want = %v", tt.desc, got, want)
+		}
+		img := fb.Snapshot()
+		if got, want := img.Bounds(), tt.bounds; got != want {
+			t.Errorf("%s: incorrect bounds; got = %v, want = %v", tt.desc, got, want)
+		}
+		for p, want := range tt.pixels {
+			if got := img.RGBAAt(p.X, p.Y); got != want {
+				t.Errorf("%s: incorrect pixel at %v; got = %v, want = %v", tt.desc, p, got, want)
+			}
+		}
+	}
+}
+
+func TestFramebuffer_Snapshot(t *testing.T) {
+	fb := NewFramebuffer(2, 2)
+	before := fb.Snapshot()
+
+	red := testColor(255, 0, 0)
+	if _, err := fb.Apply([]Rectangle{{X: 0, Y: 0, Width: 1, Height: 1, Enc: &RawEncoding{[]Color{red}}}}); err != nil {
+		t.Fatalf("unexpected error; %s", err)
+	}
+	if got, want := before.RGBAAt(0, 0), (color.RGBA{0, 0, 0, 255}); got != want {
+		t.Errorf("snapshot modified by update; got = %v, want = %v", got, want)
+	}
+	if got, want := fb.Snapshot().RGBAAt(0, 0), (color.RGBA{255, 0, 0, 255}); got != want {
+		t.Errorf("incorrect pixel; got = %v, want = %v", got, want)
+	}
+}
+
+func TestFramebuffer_SnapshotWithCursor(t *testing.T) {
+	fb := NewFramebuffer(4, 4)
+	if got := fb.Cursor(); got != nil {
+		t.Errorf("unexpected cursor %v", got)
+	}
+
+	cursor := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	cursor.SetNRGBA(0, 0, color.NRGBA{255, 0, 0, 255})
+	cursor.SetNRGBA(1, 1, color.NRGBA{0, 0, 255, 128})
+	if _, err := fb.Apply([]Rectangle{{X: 1, Y: 1, Width: 2, Height: 2, Enc: &CursorPseudoEncoding{cursor, image.Pt(1, 1)}}}); err != nil {
+		t.Fatalf("unexpected error; %s", err)
+	}
+	if got := fb.Cursor(); got == nil || got.Image != cursor || got.Hotspot != image.Pt(1, 1) {
+		t.Errorf("incorrect cursor %v", got)
+	}
+
+	fb.SetPointer(2, 2)
+	img := fb.SnapshotWithCursor()
+	for p, want := range map[image.Point]color.RGBA{
+		{0, 0}: {0, 0, 0, 255},
+		{1, 1}: {255, 0, 0, 255},
+		{2, 1}: {0, 0, 0, 255},
+		{2, 2}: {0, 0, 128, 255},
+	} {
+		if got := img.RGBAAt(p.X, p.Y); got != want {
+			t.Errorf("incorrect pixel at %v; got = %v, want = %v", p, got, want)
+		}
+	}
+	if got, want := fb.Snapshot().RGBAAt(1, 1), (color.RGBA{0, 0, 0, 255}); got != want {
+		t.Errorf("cursor drawn into framebuffer; got = %v, want = %v", got, want)
+	}
+}
+
+func TestFramebuffer_ApplyPointer(t *testing.T) {
+	fb := NewFramebuffer(4, 4)
+	cursor := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	cursor.SetNRGBA(0, 0, color.NRGBA{255, 0, 0, 255})
+
+	for _, tt := range []struct {
+		desc    string
+		rect    Rectangle
+		cursor  *image.NRGBA
+		pointer image.Point
+	}{
+		{"pointer moved by server",
+			Rectangle{X: 3, Y: 2, Enc: &PointerPosPseudoEncoding{image.Pt(3, 2)}},
+			nil, image.Pt(3, 2)},
+		{"XCursor",
+			Rectangle{Width: 1, Height: 1, Enc: &XCursorPseudoEncoding{cursor, image.Pt(0, 0)}},
+			cursor, image.Pt(3, 2)},
+		{"VMware cursor",
+			Rectangle{Width: 1, Height: 1, Enc: &VMwareCursorPseudoEncoding{cursor, image.Pt(0, 0)}},
+			cursor, image.Pt(3, 2)},
+		{"pointer moved again",
+			Rectangle{X: 1, Y: 1, Enc: &PointerPosPseudoEncoding{image.Pt(1, 1)}},
+			cursor, image.Pt(1, 1)},
+	} {
+		dirty, err := fb.Apply([]Rectangle{tt.rect})
+		if err != nil {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+		if len(dirty) != 0 {
+			t.Errorf("%s: unexpected dirty regions %v", tt.desc, dirty)
+		}
+		if got, want := fb.Pointer(), tt.pointer; got != want {
+			t.Errorf("%s: incorrect pointer; got = %v, want = %v", tt.desc, got, want)
+		}
+		if tt.cursor != nil {
+			if got := fb.Cursor(); got == nil || got.Image != tt.cursor {
+				t.Errorf("%s: incorrect cursor %v", tt.desc, got)
+			}
+		}
+	}
+
+	img := fb.SnapshotWithCursor()
+	if got, want := img.RGBAAt(1, 1), (color.RGBA{255, 0, 0, 255}); got != want {
+		t.Errorf("incorrect pixel at pointer; got = %v, want = %v", got, want)
+	}
+}
@@ -36,6 +36,8 @@ const (
 	PROTO_VERS_UNSUP = "UNSUPPORTED"
 	PROTO_VERS_3_3   = "RFB 003.003\n"
 	PROTO_VERS_3_8   = "RFB 003.008\n"
+	// Announced by Apple Screen Sharing, and otherwise the same as 3.8.
+	PROTO_VERS_3_889 = "RFB 003.889\n"
 )
 
 // protocolVersionHandshake implements §7.1.1 ProtocolVersion Handshake.
@@ -60,7 +62,9 @@ func (c *ClientConn) protocolVersionHandshake(ctx context.Context) error {
 	}
 	pv := PROTO_VERS_UNSUP
 	if major == 3 {
-		if minor >= 8 {
+		if minor == 889 {
+			pv = PROTO_VERS_3_889
+		} else if minor >= 8 {
 			pv = PROTO_VERS_3_8
 		} else if minor >= 3 {
 			pv = PROTO_VERS_3_3
@@ -103,7 +107,7 @@ func (c *ClientConn) securityHandshake() error {
 		if err := c.securityHandshake33(); err != nil {
 			return err
 		}
-	case PROTO_VERS_3_8:
+	case PROTO_VERS_3_8, PROTO_VERS_3_889:
 		if err := c.securityHandshake38(); err != nil {
 			return err
 		}
@@ -152,21 +156,35 @@ func (c *ClientConn) securityHandshake38() error {
 		glog.Info(logging.FnName())
 	}
 
+	auth, err := c.chooseAuth(c.config.Auth)
+	if err != nil {
+		return err
+	}
+	c.config.secType = auth.SecurityType()
+	if err := auth.Handshake(c); err != nil {
+		return err
+	}
+	return nil
+}
+
+// chooseAuth reads the security types supported by the server, and sends the
+// first of them supported by auths, which is returned.
+func (c *ClientConn) chooseAuth(auths []ClientAuth) (ClientAuth, error) {
 	// Determine server supported security types.
 	var numSecurityTypes uint8
 	if err := c.receive(&numSecurityTypes); err != nil {
-		return err
+		return nil, err
 	}
 	if numSecurityTypes == 0 {
 		reason, err := c.readErrorReason()
 		if err != nil {
-			return err
+			return nil, err
 		}
-		return NewVNCError(fmt.Sprintf("Security handshake failed; no security types: %v", reason))
+		return nil, NewVNCError(fmt.Sprintf("Security handshake failed; no security types: %v", reason))
 	}
 	securityTypes := make([]uint8, numSecurityTypes)
 	if err := c.receive(&securityTypes); err != nil {
-		return err
+		return nil, err
 	}
 	if logging.V(logging.ResultLevel) {
 		glog.Infof("securityTypes: %v", securityTypes)
@@ -177,7 +195,7 @@ func (c *ClientConn) securityHandshake38() error {
 	var auth ClientAuth
 FindAuth:
 	for _, securityType := range securityTypes {
-		for _, a := range c.config.Auth {
+		for _, a := range auths {
 			if a.SecurityType() == securityType {
 				// We use the first matching supported authentication.
 				auth = a
@@ -186,16 +204,12 @@ FindAuth:
 		}
 	}
 	if auth == nil {
-		return NewVNCError(fmt.Sprintf("Security handshake failed; no suitable auth schemes found; server supports: %#v", securityTypes))
+		return nil, NewVNCError(fmt.Sprintf("Security handshake failed; no suitable auth schemes found; server supports: %#v", securityTypes))
 	}
 	if err := c.send(auth.SecurityType()); err != nil {
-		return err
+		return nil, err
 	}
-	c.config.secType = auth.SecurityType()
-	if err := auth.Handshake(c); err != nil {
-		return err
-	}
-	return nil
+	return auth, nil
 }
 
 // securityResultHandshake implements §7.1.3 SecurityResult Handshake.
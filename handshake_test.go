@@ -69,6 +69,7 @@ func TestProtocolVersionHandshake(t *testing.T) {
 		{"RFB 003.006\n", "RFB 003.003\n", true},
 		{"RFB 003.008\n", "RFB 003.008\n", true},
 		{"RFB 003.389\n", "RFB 003.008\n", true},
+		{"RFB 003.889\n", "RFB 003.889\n", true},
 		// Unsupported versions.
 		{server: "RFB 002.009\n", ok: false},
 	}
@@ -70,7 +70,7 @@ func (c *ClientConn) serverInit() error {
 	}
 
 	var msg ServerInit
-	if err := msg.Read(c.c); err != nil {
+	if err := msg.Read(connReader{c}); err != nil {
 		return Errorf("failure reading ServerInit message; %v", err)
 	}
 	if logging.V(logging.ResultLevel) {
@@ -79,6 +79,7 @@ func (c *ClientConn) serverInit() error {
 
 	c.setFramebufferWidth(msg.FBWidth)
 	c.setFramebufferHeight(msg.FBHeight)
+	c.fb.Resize(int(msg.FBWidth), int(msg.FBHeight))
 	c.pixelFormat = msg.PixelFormat
 
 	name := make([]uint8, msg.NameLength)
@@ -87,5 +88,16 @@ func (c *ClientConn) serverInit() error {
 	}
 	c.setDesktopName(string(name))
 
+	// The server starts new zlib streams for each connection, and keeps them
+	// until it closes, whatever the encodings requested.
+	c.resetZlibStreams()
+
+	// Tight security extends the message with the capabilities of the server.
+	if c.config.secType == secTypeTight {
+		if err := c.readTightServerInit(); err != nil {
+			return Errorf("failure reading Tight ServerInit capabilities; %v", err)
+		}
+	}
+
 	return nil
 }
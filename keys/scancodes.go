@@ -0,0 +1,137 @@
+package keys
+
+// Scancodes of the keys of a US layout PC keyboard, as used by the QEMU
+// Extended Key Event message. Single byte XT scancodes are used as is, while
+// the high bit is set on the second byte of 0xe0 prefixed scancodes.
+//
+// Only keysyms produced without a modifier are mapped, as a scancode alone
+// would not produce a shifted keysym such as A or Exclaim; those are sent as
+// keysyms instead.
+var scancodes = map[Key]uint32{
+	Escape:       0x01,
+	Digit1:       0x02,
+	Digit2:       0x03,
+	Digit3:       0x04,
+	Digit4:       0x05,
+	Digit5:       0x06,
+	Digit6:       0x07,
+	Digit7:       0x08,
+	Digit8:       0x09,
+	Digit9:       0x0a,
+	Digit0:       0x0b,
+	Minus:        0x0c,
+	Equal:        0x0d,
+	BackSpace:    0x0e,
+	Tab:          0x0f,
+	SmallQ:       0x10,
+	SmallW:       0x11,
+	SmallE:       0x12,
+	SmallR:       0x13,
+	SmallT:       0x14,
+	SmallY:       0x15,
+	SmallU:       0x16,
+	SmallI:       0x17,
+	SmallO:       0x18,
+	SmallP:       0x19,
+	BracketLeft:  0x1a,
+	BracketRight: 0x1b,
+	Return:       0x1c,
+	ControlLeft:  0x1d,
+	SmallA:       0x1e,
+	SmallS:       0x1f,
+	SmallD:       0x20,
+	SmallF:       0x21,
+	SmallG:       0x22,
+	SmallH:       0x23,
+	SmallJ:       0x24,
+	SmallK:       0x25,
+	SmallL:       0x26,
+	Semicolon:    0x27,
+	Apostrophe:   0x28,
+	Grave:        0x29,
+	ShiftLeft:    0x2a,
+	Backslash:    0x2b,
+	SmallZ:       0x2c,
+	SmallX:       0x2d,
+	SmallC:       0x2e,
+	SmallV:       0x2f,
+	SmallB:       0x30,
+	SmallN:       0x31,
+	SmallM:       0x32,
+	Comma:        0x33,
+	Period:       0x34,
+	Slash:        0x35,
+	ShiftRight:   0x36,
+
+	KeypadMultiply: 0x37,
+	AltLeft:        0x38,
+	Space:          0x39,
+	CapsLock:       0x3a,
+	F1:             0x3b,
+	F2:             0x3c,
+	F3:             0x3d,
+	F4:             0x3e,
+	F5:             0x3f,
+	F6:             0x40,
+	F7:             0x41,
+	F8:             0x42,
+	F9:             0x43,
+	F10:            0x44,
+	NumLock:        0x45,
+	ScrollLock:     0x46,
+	Keypad7:        0x47,
+	KeypadHome:     0x47,
+	Keypad8:        0x48,
+	KeypadUp:       0x48,
+	Keypad9:        0x49,
+	KeypadPrior:    0x49,
+	KeypadSubtract: 0x4a,
+	Keypad4:        0x4b,
+	KeypadLeft:     0x4b,
+	Keypad5:        0x4c,
+	KeypadBegin:    0x4c,
+	Keypad6:        0x4d,
+	KeypadRight:    0x4d,
+	KeypadAdd:      0x4e,
+	Keypad1:        0x4f,
+	KeypadEnd:      0x4f,
+	Keypad2:        0x50,
+	KeypadDown:     0x50,
+	Keypad3:        0x51,
+	KeypadNext:     0x51,
+	Keypad0:        0x52,
+	KeypadInsert:   0x52,
+	KeypadDecimal:  0x53,
+	KeypadDelete:   0x53,
+	SysReq:         0x54,
+	F11:            0x57,
+	F12:            0x58,
+
+	// 0xe0 prefixed scancodes.
+	KeypadEnter:  0x9c,
+	ControlRight: 0x9d,
+	KeypadDivide: 0xb5,
+	Print:        0xb7,
+	AltRight:     0xb8,
+	Pause:        0xc6,
+	Home:         0xc7,
+	Up:           0xc8,
+	PageUp:       0xc9,
+	Left:         0xcb,
+	Right:        0xcd,
+	End:          0xcf,
+	Down:         0xd0,
+	PageDown:     0xd1,
+	Insert:       0xd2,
+	Delete:       0xd3,
+	SuperLeft:    0xdb,
+	SuperRight:   0xdc,
+	Menu:         0xdd,
+}
+
+// Scancode returns the XT scancode of the key which produces the keysym on a
+// US layout keyboard without a modifier, or false if there is none.
+func (k Key) Scancode() (uint32, bool) {
+	s, ok := scancodes[k]
+	return s, ok
+}
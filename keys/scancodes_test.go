@@ -0,0 +1,31 @@
+package keys
+
+import "testing"
+
+func TestKey_Scancode(t *testing.T) {
+	for _, tt := range []struct {
+		key      Key
+		scancode uint32
+		ok       bool
+	}{
+		{Escape, 0x01, true},
+		{SmallQ, 0x10, true},
+		{Q, 0, false},
+		{Digit1, 0x02, true},
+		{Exclaim, 0, false},
+		{Keypad7, 0x47, true},
+		{KeypadPageUp, 0x49, true},
+		{KeypadEnter, 0x9c, true},
+		{Insert, 0xd2, true},
+		{Undo, 0, false},
+	} {
+		got, ok := tt.key.Scancode()
+		if ok != tt.ok {
+			t.Errorf("%s.Scancode() ok = %t, want %t", tt.key, ok, tt.ok)
+			continue
+		}
+		if got != tt.scancode {
+			t.Errorf("%s.Scancode() = %#x, want %#x", tt.key, got, tt.scancode)
+		}
+	}
+}
@@ -112,6 +112,74 @@ func (pf PixelFormat) String() string {
 		pf.BPP, pf.Depth, pf.BigEndian, pf.TrueColor, pf.RedMax, pf.GreenMax, pf.BlueMax, pf.RedShift, pf.GreenShift, pf.BlueShift)
 }
 
+// bytesPerCPixel returns the size of a compressed pixel (CPIXEL), as used by
+// the TRLE and ZRLE encodings.
+//
+// See RFC 6143 §7.7.5.
+func (pf PixelFormat) bytesPerCPixel() int {
+	if _, ok := pf.cpixel24(); ok {
+		return 3
+	}
+	return int(pf.BPP / 8)
+}
+
+// cpixel24 reports whether a CPIXEL is 3 bytes long, which is the case when a
+// true color 32 bpp pixel has a depth of 24 or less, and all of the color bits
+// fit in either the least or the most significant 3 bytes. If so, msb reports
+// whether the most significant 3 bytes are used.
+func (pf PixelFormat) cpixel24() (msb, ok bool) {
+	if !rfbflags.IsTrueColor(pf.TrueColor) || pf.BPP != 32 || pf.Depth > 24 {
+		return false, false
+	}
+	mask := uint64(pf.RedMax)<<pf.RedShift | uint64(pf.GreenMax)<<pf.GreenShift | uint64(pf.BlueMax)<<pf.BlueShift
+	switch {
+	case mask <= 0x00ffffff:
+		return false, true
+	case mask&0xff == 0 && mask <= 0xffffffff:
+		return true, true
+	}
+	return false, false
+}
+
+// cpixelToPixel expands a CPIXEL into a full PIXEL, in the byte order of the
+// pixel format.
+func (pf PixelFormat) cpixelToPixel(p []byte) ([]byte, error) {
+	bytesPerPixel := int(pf.BPP / 8)
+	if len(p) != pf.bytesPerCPixel() {
+		return nil, fmt.Errorf("invalid CPIXEL length %d; want %d", len(p), pf.bytesPerCPixel())
+	}
+	if len(p) == bytesPerPixel {
+		return p, nil
+	}
+
+	// A 3 byte CPIXEL drops either the most or least significant byte, which
+	// is at either end of the pixel depending upon the byte order.
+	pixel := make([]byte, bytesPerPixel)
+	msb, _ := pf.cpixel24()
+	if msb == rfbflags.IsBigEndian(pf.BigEndian) {
+		copy(pixel, p)
+	} else {
+		copy(pixel[1:], p)
+	}
+	return pixel, nil
+}
+
+// pixelToCPixel compacts a PIXEL into a CPIXEL, and is the inverse of
+// cpixelToPixel.
+func (pf PixelFormat) pixelToCPixel(p []byte) ([]byte, error) {
+	if len(p) != int(pf.BPP/8) {
+		return nil, fmt.Errorf("invalid PIXEL length %d; want %d", len(p), pf.BPP/8)
+	}
+	msb, ok := pf.cpixel24()
+	if !ok {
+		return p, nil
+	}
+	if msb == rfbflags.IsBigEndian(pf.BigEndian) {
+		return p[:3], nil
+	}
+	return p[1:], nil
+}
+
 func (pf PixelFormat) order() binary.ByteOrder {
 	if rfbflags.IsBigEndian(pf.BigEndian) {
 		return binary.BigEndian
@@ -143,3 +143,58 @@ func equalPixelFormat(g, w PixelFormat) bool {
 	}
 	return operators.EqualSlicesOfByte(got, want)
 }
+
+func TestPixelFormat_cpixelToPixel(t *testing.T) {
+	rgb565 := PixelFormat{BPP: 16, Depth: 16, TrueColor: RFBTrue, RedMax: 31, GreenMax: 63, BlueMax: 31, RedShift: 11, GreenShift: 5, BlueShift: 0}
+	lsb24 := PixelFormat{BPP: 32, Depth: 24, TrueColor: RFBTrue, RedMax: 255, GreenMax: 255, BlueMax: 255, RedShift: 16, GreenShift: 8, BlueShift: 0}
+	msb24 := PixelFormat{BPP: 32, Depth: 24, TrueColor: RFBTrue, RedMax: 255, GreenMax: 255, BlueMax: 255, RedShift: 24, GreenShift: 16, BlueShift: 8}
+	span24 := PixelFormat{BPP: 32, Depth: 24, TrueColor: RFBTrue, RedMax: 255, GreenMax: 255, BlueMax: 255, RedShift: 20, GreenShift: 8, BlueShift: 0}
+	depth32 := PixelFormat{BPP: 32, Depth: 32, TrueColor: RFBTrue, RedMax: 255, GreenMax: 255, BlueMax: 255, RedShift: 16, GreenShift: 8, BlueShift: 0}
+	colorMap32 := PixelFormat{BPP: 32, Depth: 24, TrueColor: RFBFalse}
+	bigEndian := func(pf PixelFormat) PixelFormat {
+		pf.BigEndian = RFBTrue
+		return pf
+	}
+
+	for _, tt := range []struct {
+		desc   string
+		pf     PixelFormat
+		size   int
+		cpixel []byte
+		pixel  []byte
+		ok     bool
+	}{
+		{"8bpp true color", pixelFormat8bitTrueColor, 1, []byte{0x47}, []byte{0x47}, true},
+		{"8bpp color map", PixelFormat8bit, 1, []byte{0x12}, []byte{0x12}, true},
+		{"16bpp little-endian", rgb565, 2, []byte{0x00, 0xf8}, []byte{0x00, 0xf8}, true},
+		{"16bpp big-endian", bigEndian(rgb565), 2, []byte{0xf8, 0x00}, []byte{0xf8, 0x00}, true},
+		{"32bpp depth 24 ls bytes little-endian", lsb24, 3, []byte{3, 2, 1}, []byte{3, 2, 1, 0}, true},
+		{"32bpp depth 24 ls bytes big-endian", bigEndian(lsb24), 3, []byte{1, 2, 3}, []byte{0, 1, 2, 3}, true},
+		{"32bpp depth 24 ms bytes little-endian", msb24, 3, []byte{3, 2, 1}, []byte{0, 3, 2, 1}, true},
+		{"32bpp depth 24 ms bytes big-endian", bigEndian(msb24), 3, []byte{1, 2, 3}, []byte{1, 2, 3, 0}, true},
+		{"32bpp depth 24 spanning all bytes", span24, 4, []byte{1, 2, 3, 4}, []byte{1, 2, 3, 4}, true},
+		{"32bpp depth 32", depth32, 4, []byte{1, 2, 3, 4}, []byte{1, 2, 3, 4}, true},
+		{"32bpp color map", colorMap32, 4, []byte{1, 0, 0, 0}, []byte{1, 0, 0, 0}, true},
+		{"too short", lsb24, 3, []byte{1, 2}, nil, false},
+		{"too long", lsb24, 3, []byte{1, 2, 3, 4}, nil, false},
+	} {
+		if got, want := tt.pf.bytesPerCPixel(), tt.size; got != want {
+			t.Errorf("%s: incorrect CPIXEL size; got = %d, want = %d", tt.desc, got, want)
+		}
+		pixel, err := tt.pf.cpixelToPixel(tt.cpixel)
+		if err == nil && !tt.ok {
+			t.Errorf("%s: expected error", tt.desc)
+			continue
+		}
+		if err != nil && tt.ok {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if got, want := pixel, tt.pixel; !bytes.Equal(got, want) {
+			t.Errorf("%s: incorrect pixel; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+/*
+Implementation of the QEMU extensions.
+https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#qemu-client-message
+*/
+package vnc
+
+import (
+	"fmt"
+
+	"github.com/CambridgeSoftwareLtd/go-vnc/encodings"
+	"github.com/CambridgeSoftwareLtd/go-vnc/keys"
+	"github.com/CambridgeSoftwareLtd/go-vnc/logging"
+	"github.com/CambridgeSoftwareLtd/go-vnc/messages"
+	"github.com/golang/glog"
+)
+
+// QEMU client and server message submessage-types.
+const (
+	qemuExtendedKeyEvent uint8 = 0
+	qemuAudio            uint8 = 1
+)
+
+//-----------------------------------------------------------------------------
+// QEMU Extended Key Event Pseudo-Encoding
+//
+// A client requesting the QEMU Extended Key Event pseudo-encoding indicates
+// that it can send key events with the scancode of the key, which the server
+// acknowledges with an empty rectangle of the pseudo-encoding. Scancodes do
+// not depend upon the keyboard layout of the client, unlike keysyms.
+
+// QEMUExtendedKeyEventPseudoEncoding represents the acknowledgement from the
+// server of QEMU Extended Key Event support.
+type QEMUExtendedKeyEventPseudoEncoding struct{}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*QEMUExtendedKeyEventPseudoEncoding)(nil)
+
+// Marshal implements the Marshaler interface.
+func (*QEMUExtendedKeyEventPseudoEncoding) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Read implements the Encoding interface.
+func (*QEMUExtendedKeyEventPseudoEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	c.stateMu.Lock()
+	c.qemuExtendedKeyEvent = true
+	c.stateMu.Unlock()
+	return &QEMUExtendedKeyEventPseudoEncoding{}, nil
+}
+
+// String implements the fmt.Stringer interface.
+func (*QEMUExtendedKeyEventPseudoEncoding) String() string {
+	return "QEMUExtendedKeyEventPseudoEncoding"
+}
+
+// Type implements the Encoding interface.
+func (*QEMUExtendedKeyEventPseudoEncoding) Type() encodings.Encoding {
+	return encodings.QEMUExtendedKeyEventPseudo
+}
+
+// QEMUExtendedKeyEventMessage holds the wire format message.
+type QEMUExtendedKeyEventMessage struct {
+	Msg      messages.ClientMessage // message-type
+	SubType  uint8                  // submessage-type
+	DownFlag uint16                 // down-flag
+	Key      keys.Key               // keysym
+	Keycode  uint32                 // keycode
+}
+
+// qemuKeyEvent sends a key event with the scancode of the key, returning
+// false if the server has not acknowledged QEMU Extended Key Event support or
+// the key has no scancode.
+func (c *ClientConn) qemuKeyEvent(key keys.Key, down bool) (bool, error) {
+	c.stateMu.Lock()
+	supported := c.qemuExtendedKeyEvent
+	c.stateMu.Unlock()
+	if !supported {
+		return false, nil
+	}
+	keycode, ok := key.Scancode()
+	if !ok {
+		return false, nil
+	}
+	if logging.V(logging.ResultLevel) {
+		glog.Infof("keycode: %#x", keycode)
+	}
+
+	msg := QEMUExtendedKeyEventMessage{
+		Msg:     messages.ClientQEMU,
+		SubType: qemuExtendedKeyEvent,
+		Key:     key,
+		Keycode: keycode,
+	}
+	if down {
+		msg.DownFlag = 1
+	}
+	return true, c.send(msg)
+}
+
+//-----------------------------------------------------------------------------
+// QEMU Audio Pseudo-Encoding
+//
+// A client requesting the QEMU Audio pseudo-encoding indicates that it can
+// receive the audio of the guest, which the server acknowledges with an empty
+// rectangle of the pseudo-encoding. Audio is then enabled by the client, and
+// streamed as QEMU server messages.
+
+// QEMUAudioPseudoEncoding represents the acknowledgement from the server of
+// QEMU Audio support.
+type QEMUAudioPseudoEncoding struct{}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*QEMUAudioPseudoEncoding)(nil)
+
+// Marshal implements the Marshaler interface.
+func (*QEMUAudioPseudoEncoding) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Read implements the Encoding interface.
+func (*QEMUAudioPseudoEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	c.stateMu.Lock()
+	c.qemuAudio = true
+	c.stateMu.Unlock()
+	return &QEMUAudioPseudoEncoding{}, nil
+}
+
+// String implements the fmt.Stringer interface.
+func (*QEMUAudioPseudoEncoding) String() string { return "QEMUAudioPseudoEncoding" }
+
+// Type implements the Encoding interface.
+func (*QEMUAudioPseudoEncoding) Type() encodings.Encoding { return encodings.QEMUAudioPseudo }
+
+// AudioSampleFormat is the format of the samples of an audio stream.
+type AudioSampleFormat uint8
+
+// Audio sample formats.
+const (
+	AudioU8 AudioSampleFormat = iota
+	AudioS8
+	AudioU16
+	AudioS16
+	AudioU32
+	AudioS32
+)
+
+// Size returns the size in bytes of a sample.
+func (f AudioSampleFormat) Size() int {
+	switch f {
+	case AudioU8, AudioS8:
+		return 1
+	case AudioU16, AudioS16:
+		return 2
+	case AudioU32, AudioS32:
+		return 4
+	}
+	return 0
+}
+
+// Signed reports whether the samples are signed.
+func (f AudioSampleFormat) Signed() bool {
+	return f == AudioS8 || f == AudioS16 || f == AudioS32
+}
+
+// AudioFormat describes an audio stream.
+type AudioFormat struct {
+	SampleFormat AudioSampleFormat
+	Channels     uint8
+	Frequency    uint32 // Samples per second.
+}
+
+// QEMU audio client message operations.
+const (
+	qemuAudioEnable uint16 = iota
+	qemuAudioDisable
+	qemuAudioSetFormat
+)
+
+// QEMUAudioMessage holds the wire format message to enable or disable audio.
+type QEMUAudioMessage struct {
+	Msg       messages.ClientMessage // message-type
+	SubType   uint8                  // submessage-type
+	Operation uint16                 // operation
+}
+
+// QEMUAudioFormatMessage holds the wire format message to set the format of
+// the audio stream.
+type QEMUAudioFormatMessage struct {
+	Msg          messages.ClientMessage // message-type
+	SubType      uint8                  // submessage-type
+	Operation    uint16                 // operation
+	SampleFormat AudioSampleFormat      // sample-format
+	Channels     uint8                  // number-of-channels
+	Frequency    uint32                 // frequency
+}
+
+// qemuAudioSupported reports whether the server acknowledged QEMU audio.
+func (c *ClientConn) qemuAudioSupported() bool {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.qemuAudio
+}
+
+// SetQEMUAudio enables or disables the audio stream. The server must have
+// acknowledged the QEMU Audio pseudo-encoding.
+func (c *ClientConn) SetQEMUAudio(enable bool) error {
+	if logging.V(logging.FnDeclLevel) {
+		glog.Infof("ClientConn.%s", logging.FnNameWithArgs("%t", enable))
+	}
+
+	if !c.qemuAudioSupported() {
+		return NewVNCError("server does not support QEMU audio")
+	}
+	msg := QEMUAudioMessage{messages.ClientQEMU, qemuAudio, qemuAudioDisable}
+	if enable {
+		msg.Operation = qemuAudioEnable
+	}
+	return c.send(msg)
+}
+
+// SetQEMUAudioFormat sets the format of the audio stream. The server must
+// have acknowledged the QEMU Audio pseudo-encoding.
+func (c *ClientConn) SetQEMUAudioFormat(f AudioFormat) error {
+	if logging.V(logging.FnDeclLevel) {
+		glog.Infof("ClientConn.%s", logging.FnNameWithArgs("%v", f))
+	}
+
+	if !c.qemuAudioSupported() {
+		return NewVNCError("server does not support QEMU audio")
+	}
+	if f.SampleFormat.Size() == 0 {
+		return Errorf("invalid audio sample-format %d", f.SampleFormat)
+	}
+	msg := QEMUAudioFormatMessage{messages.ClientQEMU, qemuAudio, qemuAudioSetFormat, f.SampleFormat, f.Channels, f.Frequency}
+	return c.send(msg)
+}
+
+// QEMUAudioOperation is the operation of a QEMU audio server message.
+type QEMUAudioOperation uint16
+
+// QEMU audio server message operations.
+const (
+	QEMUAudioEnd QEMUAudioOperation = iota
+	QEMUAudioBegin
+	QEMUAudioData
+)
+
+// maxQEMUAudioData is the longest sample data of a QEMUAudioData message.
+// Servers send a chunk of their audio buffer at a time, a few KiB long.
+const maxQEMUAudioData = 1024 * 1024
+
+// QEMUAudio represents a QEMU audio server message, sans message-type and
+// submessage-type. Data holds the samples of a QEMUAudioData message.
+type QEMUAudio struct {
+	Operation QEMUAudioOperation
+	Data      []byte
+}
+
+// Verify that interfaces are honored.
+var _ ServerMessage = (*QEMUAudio)(nil)
+
+// Type implements the ServerMessage interface.
+func (*QEMUAudio) Type() messages.ServerMessage { return messages.ServerQEMU }
+
+// Read implements the ServerMessage interface.
+func (*QEMUAudio) Read(c *ClientConn) (ServerMessage, error) {
+	if logging.V(logging.FnDeclLevel) {
+		glog.Info("QEMUAudio." + logging.FnName())
+	}
+
+	var msg struct {
+		SubType   uint8              // submessage-type
+		Operation QEMUAudioOperation // operation
+	}
+	if err := c.receive(&msg); err != nil {
+		return nil, err
+	}
+	if msg.SubType != qemuAudio {
+		return nil, fmt.Errorf("unsupported QEMU submessage-type %d", msg.SubType)
+	}
+
+	switch msg.Operation {
+	case QEMUAudioEnd, QEMUAudioBegin:
+		return &QEMUAudio{Operation: msg.Operation}, nil
+	case QEMUAudioData:
+		var length uint32
+		if err := c.receive(&length); err != nil {
+			return nil, err
+		}
+		if length > maxQEMUAudioData {
+			return nil, fmt.Errorf("QEMU audio data of %d bytes is longer than %d bytes", length, maxQEMUAudioData)
+		}
+		data := make([]uint8, length)
+		if err := c.receive(&data); err != nil {
+			return nil, err
+		}
+		return &QEMUAudio{msg.Operation, data}, nil
+	}
+	return nil, fmt.Errorf("unsupported QEMU audio operation %d", msg.Operation)
+}
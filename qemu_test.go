@@ -0,0 +1,159 @@
+package vnc
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/kward/go-vnc/keys"
+	"github.com/kward/go-vnc/messages"
+)
+
+func TestQEMUExtendedKeyEventPseudoEncoding_Read(t *testing.T) {
+	conn := NewClientConn(&MockConn{}, &ClientConfig{})
+	if _, err := (&QEMUExtendedKeyEventPseudoEncoding{}).Read(conn, &Rectangle{}); err != nil {
+		t.Fatalf("unexpected error; %s", err)
+	}
+	if !conn.qemuExtendedKeyEvent {
+		t.Errorf("QEMU Extended Key Event support not recorded")
+	}
+}
+
+func TestKeyEvent_QEMU(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+	conn.qemuExtendedKeyEvent = true
+
+	SetSettle(0) // Disable UI settling for tests.
+	for _, tt := range []struct {
+		desc    string
+		key     keys.Key
+		down    bool
+		keycode uint32
+	}{
+		{"letter down", keys.SmallA, true, 0x1e},
+		{"letter up", keys.SmallA, false, 0x1e},
+		{"digit down", keys.Digit1, true, 0x02},
+		{"extended key", keys.Up, true, 0xc8},
+	} {
+		mockConn.Reset()
+		if err := conn.KeyEvent(tt.key, tt.down); err != nil {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+
+		// Read back in.
+		var req QEMUExtendedKeyEventMessage
+		if err := conn.receive(&req); err != nil {
+			t.Fatal(err)
+		}
+
+		// Validate the request.
+		var down uint16
+		if tt.down {
+			down = 1
+		}
+		want := QEMUExtendedKeyEventMessage{messages.ClientQEMU, qemuExtendedKeyEvent, down, tt.key, tt.keycode}
+		if req != want {
+			t.Errorf("%s: incorrect message; got = %v, want = %v", tt.desc, req, want)
+		}
+	}
+
+	// Keys without a scancode, including shifted keysyms, are sent as a
+	// standard KeyEvent.
+	for _, key := range []keys.Key{keys.Undo, keys.A, keys.Exclaim} {
+		mockConn.Reset()
+		if err := conn.KeyEvent(key, true); err != nil {
+			t.Fatalf("%s: unexpected error; %s", key, err)
+		}
+		var req KeyEventMessage
+		if err := conn.receive(&req); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := req.Msg, messages.KeyEvent; got != want {
+			t.Errorf("%s: incorrect message-type; got = %v, want = %v", key, got, want)
+		}
+		if got, want := req.Key, key; got != want {
+			t.Errorf("%s: incorrect key; got = %v, want = %v", key, got, want)
+		}
+	}
+}
+
+func TestSetQEMUAudio(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+
+	if err := conn.SetQEMUAudio(true); err == nil {
+		t.Errorf("expected error before the server acknowledged QEMU audio")
+	}
+	if _, err := (&QEMUAudioPseudoEncoding{}).Read(conn, &Rectangle{}); err != nil {
+		t.Fatalf("unexpected error; %s", err)
+	}
+
+	for _, tt := range []struct {
+		enable bool
+		data   []byte
+	}{
+		{true, []byte{255, 1, 0, 0}},
+		{false, []byte{255, 1, 0, 1}},
+	} {
+		mockConn.Reset()
+		if err := conn.SetQEMUAudio(tt.enable); err != nil {
+			t.Errorf("%t: unexpected error; %s", tt.enable, err)
+			continue
+		}
+		if got, want := mockConn.b.Bytes(), tt.data; !bytes.Equal(got, want) {
+			t.Errorf("%t: incorrect message; got = %v, want = %v", tt.enable, got, want)
+		}
+	}
+
+	mockConn.Reset()
+	if err := conn.SetQEMUAudioFormat(AudioFormat{AudioS16, 2, 44100}); err != nil {
+		t.Fatalf("unexpected error; %s", err)
+	}
+	if got, want := mockConn.b.Bytes(), []byte{255, 1, 0, 2, 3, 2, 0, 0, 0xac, 0x44}; !bytes.Equal(got, want) {
+		t.Errorf("incorrect message; got = %v, want = %v", got, want)
+	}
+	if err := conn.SetQEMUAudioFormat(AudioFormat{6, 2, 44100}); err == nil {
+		t.Errorf("expected error for invalid sample-format")
+	}
+}
+
+func TestQEMUAudio_Read(t *testing.T) {
+	for _, tt := range []struct {
+		desc string
+		data []byte
+		msg  *QEMUAudio
+		ok   bool
+	}{
+		{"begin", []byte{1, 0, 1}, &QEMUAudio{Operation: QEMUAudioBegin}, true},
+		{"end", []byte{1, 0, 0}, &QEMUAudio{Operation: QEMUAudioEnd}, true},
+		{"data", []byte{1, 0, 2, 0, 0, 0, 4, 1, 2, 3, 4}, &QEMUAudio{QEMUAudioData, []byte{1, 2, 3, 4}}, true},
+		{"short data", []byte{1, 0, 2, 0, 0, 0, 4, 1, 2}, nil, false},
+		{"data too long", []byte{1, 0, 2, 0xff, 0xff, 0xff, 0xff}, nil, false},
+		{"unknown operation", []byte{1, 0, 3}, nil, false},
+		{"unknown submessage-type", []byte{0, 0, 0}, nil, false},
+	} {
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, &ClientConfig{})
+		if err := conn.send(tt.data); err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := (&QEMUAudio{}).Read(conn)
+		if err == nil && !tt.ok {
+			t.Errorf("%s: expected error", tt.desc)
+			continue
+		}
+		if err != nil && tt.ok {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if got, want := msg, tt.msg; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: incorrect message; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+/*
+Implementation of the RSA-AES security types, which authenticate over, and
+optionally encrypt the session with, AES-EAX keyed by an RSA key exchange.
+https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#rsa-aes-security-type
+*/
+package vnc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"hash"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+
+	"github.com/CambridgeSoftwareLtd/go-vnc/logging"
+	"github.com/golang/glog"
+)
+
+const (
+	// The range of RSA key lengths accepted from the server, in bits.
+	ra2MinKeyBits = 1024
+	ra2MaxKeyBits = 8192
+
+	// Sub-types for the credentials requested by the server.
+	ra2UserPass = uint8(1)
+	ra2Pass     = uint8(2)
+
+	// ra2MaxMessage is the longest message sent on an encrypted stream.
+	ra2MaxMessage = 8192
+)
+
+// ra2ClientKeyBits is the length in bits of the RSA key of the client.
+var ra2ClientKeyBits = 2048
+
+// ClientAuthRA2 is the RSA-AES authentication.
+type ClientAuthRA2 struct {
+	// KeySize is the AES key length in bits, either 128 (the default) or 256.
+	KeySize int
+
+	// Unencrypted selects the RA2ne security types, where only the
+	// authentication is encrypted and not the rest of the session.
+	Unencrypted bool
+
+	// Username and Password to authenticate with. The username is only sent
+	// if the server asks for one.
+	Username, Password string
+
+	// VerifyServerKey is called with the public key of the server and its
+	// SHA-256 fingerprint, and rejects the key by returning an error. Keys
+	// are typically trusted on first use, by remembering the fingerprint of
+	// each server. If nil, every key is accepted.
+	VerifyServerKey func(key *rsa.PublicKey, fingerprint []byte) error
+}
+
+// SecurityType implements the ClientAuth interface.
+func (auth *ClientAuthRA2) SecurityType() uint8 {
+	switch {
+	case auth.KeySize == 256 && auth.Unencrypted:
+		return secTypeRA2ne256
+	case auth.KeySize == 256:
+		return secTypeRA2256
+	case auth.Unencrypted:
+		return secTypeRA2ne
+	}
+	return secTypeRA2
+}
+
+// Handshake implements the ClientAuth interface.
+func (auth *ClientAuthRA2) Handshake(conn *ClientConn) error {
+	if logging.V(logging.FnDeclLevel) {
+		glog.Info("ClientAuthRA2." + logging.FnName())
+	}
+
+	if auth.Password == "" {
+		return NewVNCError("Security Handshake failed; no password provided for RSA-AES.")
+	}
+	if len(auth.Username) > 255 || len(auth.Password) > 255 {
+		return NewVNCError("Security Handshake failed; RSA-AES username and password must be at most 255 bytes.")
+	}
+	keySize := auth.KeySize
+	if keySize == 0 {
+		keySize = 128
+	}
+	newHash := sha1.New
+	switch keySize {
+	case 128:
+	case 256:
+		newHash = sha256.New
+	default:
+		return Errorf("Security Handshake failed; invalid RSA-AES key size %d.", auth.KeySize)
+	}
+
+	// Exchange public keys.
+	serverKey, serverBlob, err := ra2ReadPublicKey(conn)
+	if err != nil {
+		return err
+	}
+	if auth.VerifyServerKey != nil {
+		fingerprint := sha256.Sum256(serverBlob)
+		if err := auth.VerifyServerKey(serverKey, fingerprint[:]); err != nil {
+			return Errorf("Security Handshake failed; server key rejected: %s", err)
+		}
+	}
+	clientKey, err := rsa.GenerateKey(rand.Reader, ra2ClientKeyBits)
+	if err != nil {
+		return err
+	}
+	clientBlob := ra2PublicKeyBlob(&clientKey.PublicKey)
+	if err := conn.send(clientBlob); err != nil {
+		return err
+	}
+
+	// Exchange random values, encrypted by the public keys.
+	clientRandom := make([]byte, keySize/8)
+	if _, err := io.ReadFull(rand.Reader, clientRandom); err != nil {
+		return err
+	}
+	encrypted, err := rsa.EncryptPKCS1v15(rand.Reader, serverKey, clientRandom)
+	if err != nil {
+		return err
+	}
+	if err := conn.send(append([]byte{uint8(len(encrypted) >> 8), uint8(len(encrypted))}, encrypted...)); err != nil {
+		return err
+	}
+	var length uint16
+	if err := conn.receive(&length); err != nil {
+		return err
+	}
+	if int(length) != clientKey.Size() {
+		return Errorf("Security Handshake failed; invalid RSA-AES random length %d.", length)
+	}
+	encrypted = make([]byte, length)
+	if err := conn.receive(&encrypted); err != nil {
+		return err
+	}
+	serverRandom, err := rsa.DecryptPKCS1v15(nil, clientKey, encrypted)
+	if err != nil || len(serverRandom) != len(clientRandom) {
+		return NewVNCError("Security Handshake failed; invalid RSA-AES random.")
+	}
+
+	// Encrypt the stream.
+	raw := conn.Conn()
+	rc, err := newRA2Conn(raw,
+		ra2Digest(newHash, clientRandom, serverRandom)[:keySize/8],
+		ra2Digest(newHash, serverRandom, clientRandom)[:keySize/8])
+	if err != nil {
+		return err
+	}
+	conn.SetConn(rc)
+
+	// Verify that both ends hold the same public keys.
+	if err := conn.send(ra2Digest(newHash, clientBlob, serverBlob)); err != nil {
+		return err
+	}
+	serverHash := make([]byte, newHash().Size())
+	if err := conn.receive(&serverHash); err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(serverHash, ra2Digest(newHash, serverBlob, clientBlob)) != 1 {
+		return NewVNCError("Security Handshake failed; RSA-AES hash mismatch.")
+	}
+
+	// Send the credentials.
+	var subType uint8
+	if err := conn.receive(&subType); err != nil {
+		return err
+	}
+	var creds []byte
+	switch subType {
+	case ra2UserPass:
+		if auth.Username == "" {
+			return NewVNCError("Security Handshake failed; no username provided for RSA-AES.")
+		}
+		creds = append([]byte{uint8(len(auth.Username))}, auth.Username...)
+	case ra2Pass:
+		creds = []byte{0}
+	default:
+		return Errorf("Security Handshake failed; invalid RSA-AES sub-type %d.", subType)
+	}
+	creds = append(append(creds, uint8(len(auth.Password))), auth.Password...)
+	if err := conn.send(creds); err != nil {
+		return err
+	}
+
+	if auth.Unencrypted {
+		conn.SetConn(raw)
+	}
+	return nil
+}
+
+// ra2ReadPublicKey reads an RSA public key, returning it and its wire format.
+func ra2ReadPublicKey(conn *ClientConn) (*rsa.PublicKey, []byte, error) {
+	var bits uint32
+	if err := conn.receive(&bits); err != nil {
+		return nil, nil, err
+	}
+	if bits < ra2MinKeyBits || bits > ra2MaxKeyBits {
+		return nil, nil, Errorf("Security Handshake failed; invalid RSA-AES key length %d.", bits)
+	}
+	b := make([]byte, 2*((bits+7)/8))
+	if err := conn.receive(&b); err != nil {
+		return nil, nil, err
+	}
+	n := new(big.Int).SetBytes(b[:len(b)/2])
+	e := new(big.Int).SetBytes(b[len(b)/2:])
+	if n.BitLen() != int(bits) || e.BitLen() < 2 || e.BitLen() > 31 {
+		return nil, nil, NewVNCError("Security Handshake failed; invalid RSA-AES key.")
+	}
+	key := &rsa.PublicKey{N: n, E: int(e.Int64())}
+	return key, ra2PublicKeyBlob(key), nil
+}
+
+// ra2PublicKeyBlob returns the wire format of an RSA public key.
+func ra2PublicKeyBlob(key *rsa.PublicKey) []byte {
+	size := (key.N.BitLen() + 7) / 8
+	b := make([]byte, 4, 4+2*size)
+	binary.BigEndian.PutUint32(b, uint32(key.N.BitLen()))
+	b = append(b, padBytes(key.N.Bytes(), size)...)
+	return append(b, padBytes(big.NewInt(int64(key.E)).Bytes(), size)...)
+}
+
+// ra2Digest returns the digest of the concatenated values.
+func ra2Digest(newHash func() hash.Hash, values ...[]byte) []byte {
+	h := newHash()
+	for _, v := range values {
+		h.Write(v)
+	}
+	return h.Sum(nil)
+}
+
+// ra2Conn encrypts a connection with AES-EAX. Each message is sent as its
+// length, then the ciphertext and tag. The length is authenticated, and the
+// nonce is a little-endian counter of the messages in each direction.
+type ra2Conn struct {
+	net.Conn
+	in, out           cipher.AEAD
+	inNonce, outNonce [16]byte
+	buf               []byte // Decrypted bytes yet to be read.
+
+	// Serializes writes, so that a nonce is never reused and the messages of
+	// one write are not interleaved with another.
+	writeMu sync.Mutex
+}
+
+// newRA2Conn returns conn encrypted with inKey and outKey.
+func newRA2Conn(conn net.Conn, inKey, outKey []byte) (*ra2Conn, error) {
+	c := &ra2Conn{Conn: conn}
+	for _, v := range []struct {
+		aead *cipher.AEAD
+		key  []byte
+	}{{&c.in, inKey}, {&c.out, outKey}} {
+		block, err := aes.NewCipher(v.key)
+		if err != nil {
+			return nil, err
+		}
+		if *v.aead, err = newEAX(block); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Read implements the io.Reader interface.
+func (c *ra2Conn) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(c.Conn, header); err != nil {
+			return 0, err
+		}
+		msg := make([]byte, int(binary.BigEndian.Uint16(header))+c.in.Overhead())
+		if _, err := io.ReadFull(c.Conn, msg); err != nil {
+			return 0, err
+		}
+		plaintext, err := c.in.Open(nil, c.inNonce[:], msg, header)
+		if err != nil {
+			return 0, err
+		}
+		ra2Increment(&c.inNonce)
+		c.buf = plaintext
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// Write implements the io.Writer interface.
+func (c *ra2Conn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	var n int
+	for n < len(p) {
+		chunk := p[n:]
+		if len(chunk) > ra2MaxMessage {
+			chunk = chunk[:ra2MaxMessage]
+		}
+		header := []byte{uint8(len(chunk) >> 8), uint8(len(chunk))}
+		msg := c.out.Seal(header, c.outNonce[:], chunk, header)
+		if _, err := c.Conn.Write(msg); err != nil {
+			return n, err
+		}
+		ra2Increment(&c.outNonce)
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+// ra2Increment increments a little-endian counter.
+func ra2Increment(nonce *[16]byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package vnc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+)
+
+// ra2Server performs the server side of an RSA-AES handshake, asking for the
+// credentials of subType, and returns the credentials sent by the client.
+func ra2Server(c net.Conn, key *rsa.PrivateKey, keySize int, allEncrypted bool, subType uint8) ([]byte, error) {
+	defer c.Close()
+	newHash := sha1.New
+	if keySize == 256 {
+		newHash = sha256.New
+	}
+
+	serverBlob := ra2PublicKeyBlob(&key.PublicKey)
+	if _, err := c.Write(serverBlob); err != nil {
+		return nil, err
+	}
+	var bits uint32
+	if err := binary.Read(c, binary.BigEndian, &bits); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 2*((bits+7)/8))
+	if _, err := io.ReadFull(c, b); err != nil {
+		return nil, err
+	}
+	clientKey := &rsa.PublicKey{
+		N: new(big.Int).SetBytes(b[:len(b)/2]),
+		E: int(new(big.Int).SetBytes(b[len(b)/2:]).Int64()),
+	}
+	clientBlob := ra2PublicKeyBlob(clientKey)
+
+	var length uint16
+	if err := binary.Read(c, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	encrypted := make([]byte, length)
+	if _, err := io.ReadFull(c, encrypted); err != nil {
+		return nil, err
+	}
+	clientRandom, err := rsa.DecryptPKCS1v15(nil, key, encrypted)
+	if err != nil {
+		return nil, err
+	}
+	serverRandom := make([]byte, keySize/8)
+	rand.Read(serverRandom)
+	if encrypted, err = rsa.EncryptPKCS1v15(rand.Reader, clientKey, serverRandom); err != nil {
+		return nil, err
+	}
+	binary.Write(c, binary.BigEndian, uint16(len(encrypted)))
+	if _, err := c.Write(encrypted); err != nil {
+		return nil, err
+	}
+
+	rc, err := newRA2Conn(c,
+		ra2Digest(newHash, serverRandom, clientRandom)[:keySize/8],
+		ra2Digest(newHash, clientRandom, serverRandom)[:keySize/8])
+	if err != nil {
+		return nil, err
+	}
+	clientHash := make([]byte, newHash().Size())
+	if _, err := io.ReadFull(rc, clientHash); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(clientHash, ra2Digest(newHash, clientBlob, serverBlob)) {
+		return nil, errors.New("incorrect client hash")
+	}
+	if _, err := rc.Write(ra2Digest(newHash, serverBlob, clientBlob)); err != nil {
+		return nil, err
+	}
+	if _, err := rc.Write([]byte{subType}); err != nil {
+		return nil, err
+	}
+
+	// Read the username and password.
+	var creds []byte
+	for i := 0; i < 2; i++ {
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(rc, l); err != nil {
+			return nil, err
+		}
+		v := make([]byte, l[0])
+		if _, err := io.ReadFull(rc, v); err != nil {
+			return nil, err
+		}
+		creds = append(append(creds, l...), v...)
+	}
+
+	// Send the SecurityResult, encrypted unless RA2ne.
+	w := io.Writer(rc)
+	if !allEncrypted {
+		w = c
+	}
+	if _, err := w.Write([]byte{0, 0, 0, 0}); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+func TestClientAuthRA2_Impl(t *testing.T) {
+	var raw interface{}
+	raw = new(ClientAuthRA2)
+	if _, ok := raw.(ClientAuth); !ok {
+		t.Fatal("ClientAuthRA2 doesn't implement ClientAuth")
+	}
+}
+
+func TestClientAuthRA2_SecurityType(t *testing.T) {
+	for _, tt := range []struct {
+		auth    ClientAuthRA2
+		secType uint8
+	}{
+		{ClientAuthRA2{}, 5},
+		{ClientAuthRA2{Unencrypted: true}, 6},
+		{ClientAuthRA2{KeySize: 256}, 129},
+		{ClientAuthRA2{KeySize: 256, Unencrypted: true}, 130},
+	} {
+		if got, want := tt.auth.SecurityType(), tt.secType; got != want {
+			t.Errorf("%+v: incorrect security type; got = %d, want = %d", tt.auth, got, want)
+		}
+	}
+}
+
+func TestClientAuthRA2_Handshake(t *testing.T) {
+	defer func(bits int) { ra2ClientKeyBits = bits }(ra2ClientKeyBits)
+	ra2ClientKeyBits = 1024 // Quicker to generate.
+
+	serverKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := sha256.Sum256(ra2PublicKeyBlob(&serverKey.PublicKey))
+	trust := func(key *rsa.PublicKey, f []byte) error {
+		if !bytes.Equal(f, fingerprint[:]) {
+			return fmt.Errorf("unknown fingerprint %x", f)
+		}
+		return nil
+	}
+	reject := func(*rsa.PublicKey, []byte) error { return errors.New("untrusted") }
+
+	for _, tt := range []struct {
+		desc    string
+		auth    *ClientAuthRA2
+		subType uint8
+		creds   []byte
+		ok      bool
+	}{
+		{"RA2",
+			&ClientAuthRA2{Username: "user", Password: "secret", VerifyServerKey: trust},
+			ra2UserPass, []byte("\x04user\x06secret"), true},
+		{"RA2ne",
+			&ClientAuthRA2{Unencrypted: true, Username: "user", Password: "secret"},
+			ra2UserPass, []byte("\x04user\x06secret"), true},
+		{"RA2_256 password only",
+			&ClientAuthRA2{KeySize: 256, Username: "user", Password: "secret", VerifyServerKey: trust},
+			ra2Pass, []byte("\x00\x06secret"), true},
+		{"RA2ne_256",
+			&ClientAuthRA2{KeySize: 256, Unencrypted: true, Password: "secret"},
+			ra2Pass, []byte("\x00\x06secret"), true},
+		{"rejected server key",
+			&ClientAuthRA2{Password: "secret", VerifyServerKey: reject},
+			ra2Pass, nil, false},
+		{"no username",
+			&ClientAuthRA2{Password: "secret"},
+			ra2UserPass, nil, false},
+		{"invalid key size",
+			&ClientAuthRA2{KeySize: 192, Password: "secret"},
+			ra2Pass, nil, false},
+	} {
+		client, server := net.Pipe()
+		keySize := tt.auth.KeySize
+		if keySize == 0 {
+			keySize = 128
+		}
+		result := make(chan []byte, 1)
+		go func() {
+			b, _ := ra2Server(server, serverKey, keySize, !tt.auth.Unencrypted, tt.subType)
+			result <- b
+		}()
+
+		conn := NewClientConn(client, &ClientConfig{})
+		err := tt.auth.Handshake(conn)
+		if err == nil && !tt.ok {
+			t.Errorf("%s: expected error", tt.desc)
+		}
+		if err != nil && tt.ok {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+		}
+		if err == nil {
+			if _, ok := conn.Conn().(*ra2Conn); ok != !tt.auth.Unencrypted {
+				t.Errorf("%s: incorrect transport %T", tt.desc, conn.Conn())
+			}
+			// The SecurityResult is read over the same transport.
+			if err := conn.securityResultHandshake(); err != nil {
+				t.Errorf("%s: unexpected SecurityResult error; %s", tt.desc, err)
+			}
+		}
+		conn.Close()
+
+		got := <-result
+		if !tt.ok {
+			continue
+		}
+		if want := tt.creds; !bytes.Equal(got, want) {
+			t.Errorf("%s: incorrect credentials; got = %q, want = %q", tt.desc, got, want)
+		}
+	}
+}
+
+func TestRA2Conn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	k1, k2 := make([]byte, 16), make([]byte, 16)
+	k2[0] = 1
+	cc, err := newRA2Conn(client, k1, k2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := newRA2Conn(server, k2, k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Long writes are split into several messages.
+	want := make([]byte, 3*ra2MaxMessage/2)
+	rand.Read(want)
+	go func() {
+		cc.Write(want)
+		cc.Write([]byte{42})
+	}()
+	got := make([]byte, len(want)+1)
+	if _, err := io.ReadFull(sc, got); err != nil {
+		t.Fatalf("unexpected error; %s", err)
+	}
+	if !bytes.Equal(got, append(want, 42)) {
+		t.Errorf("incorrect data read")
+	}
+	if got, want := sc.inNonce, [16]byte{3}; got != want {
+		t.Errorf("incorrect nonce; got = %v, want = %v", got, want)
+	}
+}
+
+func TestRA2Conn_ConcurrentSend(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	k1, k2 := make([]byte, 16), make([]byte, 16)
+	k2[0] = 1
+	cc, err := newRA2Conn(client, k1, k2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := newRA2Conn(server, k2, k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := NewClientConn(cc, &ClientConfig{})
+
+	// Messages sent by several goroutines, e.g. the server message handler
+	// replying to a fence while the user sends input, must not share nonces
+	// nor be interleaved.
+	const (
+		numSends = 100
+		size     = 3 * ra2MaxMessage / 2
+	)
+	for _, v := range []byte{1, 2} {
+		go func(v byte) {
+			for i := 0; i < numSends; i++ {
+				if err := conn.send(bytes.Repeat([]byte{v}, size)); err != nil {
+					return
+				}
+			}
+		}(v)
+	}
+	msg := make([]byte, size)
+	for i := 0; i < 2*numSends; i++ {
+		if _, err := io.ReadFull(sc, msg); err != nil {
+			t.Fatalf("unexpected error; %s", err)
+		}
+		if !bytes.Equal(msg, bytes.Repeat(msg[:1], size)) {
+			t.Fatalf("message %d interleaved with another", i)
+		}
+	}
+}
@@ -10,9 +10,17 @@ import (
 )
 
 const (
-	secTypeInvalid = uint8(0)
-	secTypeNone    = uint8(1)
-	secTypeVNCAuth = uint8(2)
+	secTypeInvalid  = uint8(0)
+	secTypeNone     = uint8(1)
+	secTypeVNCAuth  = uint8(2)
+	secTypeRA2      = uint8(5)
+	secTypeRA2ne    = uint8(6)
+	secTypeTight    = uint8(16)
+	secTypeTLS      = uint8(18)
+	secTypeVeNCrypt = uint8(19)
+	secTypeARD      = uint8(30)
+	secTypeRA2256   = uint8(129)
+	secTypeRA2ne256 = uint8(130)
 )
 
 // ClientAuth implements a method of authenticating with a remote server.
@@ -7,6 +7,7 @@ package vnc
 import (
 	"fmt"
 	"image"
+	"image/color"
 
 	"log"
 
@@ -39,12 +40,19 @@ type ServerMessage interface {
 type FramebufferUpdate struct {
 	NumRect uint16      // number-of-rectangles
 	Rects   []Rectangle // rectangles
+
+	// Regions of the client framebuffer modified by this update.
+	Dirty []image.Rectangle
 }
 
 // Verify that interfaces are honored.
 var _ ServerMessage = (*FramebufferUpdate)(nil)
 var _ MarshalerUnmarshaler = (*FramebufferUpdate)(nil)
 
+// lastRectNumRects is the number-of-rectangles of an update ended by a
+// LastRect rectangle.
+const lastRectNumRects = 0xffff
+
 func newFramebufferUpdate(rects []Rectangle) *FramebufferUpdate {
 	return &FramebufferUpdate{
 		NumRect: uint16(len(rects)),
@@ -85,17 +93,29 @@ func (m *FramebufferUpdate) Read(c *ClientConn) (ServerMessage, error) {
 		glog.Infof("numRects: %d", numRects)
 	}
 
-	// Extract rectangles.
-	rects := make([]Rectangle, numRects)
-	for i := 0; i < int(numRects); i++ {
+	// Extract rectangles. With LastRect, the server may leave the number of
+	// rectangles open, ending the update with a LastRect rectangle instead.
+	untilLastRect := numRects == lastRectNumRects && c.hasEncoding(encodings.LastRectPseudo)
+	var rects []Rectangle
+	for i := 0; untilLastRect || i < int(numRects); i++ {
 		rect := NewRectangle(c.Encodable)
 		if err := rect.Read(c); err != nil {
 			return nil, err
 		}
-		rects[i] = *rect
+		if _, ok := rect.Enc.(*LastRectPseudoEncoding); ok {
+			break
+		}
+		rects = append(rects, *rect)
+	}
+
+	msg := newFramebufferUpdate(rects)
+	dirty, err := c.fb.Apply(rects)
+	if err != nil {
+		return nil, err
 	}
+	msg.Dirty = dirty
 
-	return newFramebufferUpdate(rects), nil
+	return msg, nil
 }
 
 // Marshal implements the Marshaler interface.
@@ -144,7 +164,7 @@ func (c *ClientConn) Encodable(enc encodings.Encoding) (Encoding, bool) {
 	if logging.V(logging.FnDeclLevel) {
 		glog.Info("ClientConn." + logging.FnName())
 	}
-	for _, e := range c.encodings {
+	for _, e := range c.Encodings() {
 		if e.Type() == enc {
 			return e, true
 		}
@@ -332,6 +352,7 @@ type Color struct {
 
 // Verify that interfaces are honored.
 var _ MarshalerUnmarshaler = (*Color)(nil)
+var _ color.Color = (*Color)(nil)
 
 // ColorMap represents a translation map of colors.
 type ColorMap [256]Color
@@ -408,6 +429,24 @@ func (c *Color) Unmarshal(data []byte) error {
 	return nil
 }
 
+// RGBA implements the color.Color interface. True color values are scaled
+// from the channel maximums of the pixel format, while color map values are
+// already 16-bit.
+func (c *Color) RGBA() (r, g, b, a uint32) {
+	if c.pf == nil || !rfbflags.IsTrueColor(c.pf.TrueColor) {
+		return uint32(c.R), uint32(c.G), uint32(c.B), 0xffff
+	}
+	return scaleChannel(c.R, c.pf.RedMax), scaleChannel(c.G, c.pf.GreenMax), scaleChannel(c.B, c.pf.BlueMax), 0xffff
+}
+
+// scaleChannel scales a color channel value in the range [0, max] to 16-bits.
+func scaleChannel(v, max uint16) uint32 {
+	if max == 0 {
+		return 0
+	}
+	return uint32(v) * 0xffff / uint32(max)
+}
+
 func colorsToImage(x, y, width, height uint16, colors []Color) *image.RGBA64 {
 	rect := image.Rect(int(x), int(y), int(x+width), int(y+height))
 	rgba := image.NewRGBA64(rect)
@@ -455,9 +494,12 @@ func (*Bell) Read(c *ClientConn) (ServerMessage, error) {
 // https://tools.ietf.org/html/rfc6143#section-7.6.4
 
 // ServerCutText represents the wire format message, sans message-type and
-// padding.
+// padding. Messages of the extended clipboard also hold their Flags, and the
+// RTF and HTML formats of provided clipboard contents.
 type ServerCutText struct {
-	Text string
+	Text      string
+	Flags     ClipboardFlags
+	RTF, HTML string
 }
 
 // Verify that interfaces are honored.
@@ -473,7 +515,7 @@ func (*ServerCutText) Read(c *ClientConn) (ServerMessage, error) {
 	}
 
 	// Read off the padding
-	var padding [1]byte
+	var padding [3]byte
 	if err := c.receive(&padding); err != nil {
 		return nil, err
 	}
@@ -482,11 +524,15 @@ func (*ServerCutText) Read(c *ClientConn) (ServerMessage, error) {
 	if err := c.receive(&textLength); err != nil {
 		return nil, err
 	}
+	// A negative length marks an extended clipboard message.
+	if int32(textLength) < 0 && c.hasEncoding(encodings.ExtendedClipboardPseudo) {
+		return c.readExtendedClipboard(int32(textLength))
+	}
 
 	textBytes := make([]uint8, textLength)
 	if err := c.receive(&textBytes); err != nil {
 		return nil, err
 	}
 
-	return &ServerCutText{string(textBytes)}, nil
+	return &ServerCutText{Text: latin1Decode(textBytes)}, nil
 }
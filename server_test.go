@@ -1,10 +1,12 @@
 package vnc
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/kward/go-vnc/encodings"
 	"github.com/kward/go-vnc/go/operators"
+	"github.com/kward/go-vnc/messages"
 )
 
 func TestRectangle_Marshal(t *testing.T) {
@@ -222,3 +224,81 @@ func TestSetColorMapEntries(t *testing.T) {}
 func TestBell(t *testing.T) {}
 
 func TestServerCutText(t *testing.T) {}
+
+func TestFramebufferUpdate_LastRect(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+	conn.encodings = Encodings{&RawEncoding{}, &LastRectPseudoEncoding{}, &DesktopNamePseudoEncoding{}}
+	// Use empty PixelFormat so that the BPP is zero, and rects won't be read.
+	conn.pixelFormat = PixelFormat{}
+
+	for _, tt := range []struct {
+		desc     string
+		numRects uint16
+		rects    []Rectangle
+		want     []encodings.Encoding
+	}{
+		{"open number of rectangles",
+			lastRectNumRects,
+			[]Rectangle{
+				{1, 2, 3, 4, &RawEncoding{}, conn.Encodable},
+				{0, 0, 0, 0, &DesktopNamePseudoEncoding{"remote"}, conn.Encodable},
+				{0, 0, 0, 0, &LastRectPseudoEncoding{}, conn.Encodable},
+			},
+			[]encodings.Encoding{encodings.Raw, encodings.DesktopNamePseudo}},
+		{"ended early",
+			3,
+			[]Rectangle{
+				{1, 2, 3, 4, &RawEncoding{}, conn.Encodable},
+				{0, 0, 0, 0, &LastRectPseudoEncoding{}, conn.Encodable},
+			},
+			[]encodings.Encoding{encodings.Raw}},
+		{"empty update",
+			lastRectNumRects,
+			[]Rectangle{{0, 0, 0, 0, &LastRectPseudoEncoding{}, conn.Encodable}},
+			nil},
+	} {
+		mockConn.Reset()
+
+		// Send the message, followed by the start of the next one.
+		msg := newFramebufferUpdate(tt.rects)
+		msg.NumRect = tt.numRects
+		bytes, err := msg.Marshal()
+		if err != nil {
+			t.Errorf("%s: failed to marshal; %s", tt.desc, err)
+			continue
+		}
+		if err := conn.send(append(bytes, uint8(messages.Bell))); err != nil {
+			t.Errorf("%s: failed to send; %s", tt.desc, err)
+			continue
+		}
+
+		// Validate message handling.
+		var messageType uint8
+		if err := conn.receive(&messageType); err != nil {
+			t.Fatal(err)
+		}
+		parsedFU, err := (&FramebufferUpdate{}).Read(conn)
+		if err != nil {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+		fu := parsedFU.(*FramebufferUpdate)
+		if got, want := int(fu.NumRect), len(tt.want); got != want {
+			t.Errorf("%s: incorrect number-of-rectangles; got %d, want %d", tt.desc, got, want)
+		}
+		var got []encodings.Encoding
+		for _, r := range fu.Rects {
+			got = append(got, r.Enc.Type())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: incorrect encodings; got %v, want %v", tt.desc, got, tt.want)
+		}
+		if err := conn.receive(&messageType); err != nil || messageType != uint8(messages.Bell) {
+			t.Errorf("%s: update not ended at LastRect; next message-type %d, %v", tt.desc, messageType, err)
+		}
+	}
+	if got, want := conn.DesktopName(), "remote"; got != want {
+		t.Errorf("incorrect desktop name; got = %q, want = %q", got, want)
+	}
+}
@@ -0,0 +1,417 @@
+/*
+Implementation of the Tight and TightPNG encodings.
+https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#tight-encoding
+*/
+package vnc
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"github.com/CambridgeSoftwareLtd/go-vnc/encodings"
+	"github.com/CambridgeSoftwareLtd/go-vnc/rfbflags"
+)
+
+//-----------------------------------------------------------------------------
+// Tight Encoding
+//
+// Tight encoding compresses pixel data with zlib, after first optionally
+// reducing it with a copy, palette or gradient filter. Rectangles may instead
+// be sent as a single fill color, or as a JPEG image.
+
+// TightEncoding represents a Tight encoded update.
+type TightEncoding struct {
+	Colors []Color
+}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*TightEncoding)(nil)
+
+// Tight compression-control values, held in the upper 4 bits.
+const (
+	tightBasic = 0x00
+	tightFill  = 0x08
+	tightJPEG  = 0x09
+	tightPNG   = 0x0a
+
+	// Basic compression flags.
+	tightExplicitFilter = 0x04
+	tightStreamMask     = 0x03
+)
+
+// Tight filter-id values.
+const (
+	tightFilterCopy uint8 = iota
+	tightFilterPalette
+	tightFilterGradient
+)
+
+const (
+	// Data smaller than this is sent without zlib compression.
+	tightMinToCompress = 12
+
+	// Number of zlib streams used by the Tight encoding.
+	tightNumStreams = 4
+)
+
+// Marshal implements the Marshaler interface.
+func (*TightEncoding) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Read implements the Encoding interface.
+func (*TightEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	colors, err := readTight(c, rect, false)
+	if err != nil {
+		return nil, err
+	}
+	return &TightEncoding{colors}, nil
+}
+
+// String implements the fmt.Stringer interface.
+func (*TightEncoding) String() string { return "TightEncoding" }
+
+// Type implements the Encoding interface.
+func (*TightEncoding) Type() encodings.Encoding { return encodings.Tight }
+
+//-----------------------------------------------------------------------------
+// TightPNG Encoding
+//
+// TightPNG encoding is Tight encoding where the basic compression is replaced
+// by PNG compression.
+
+// TightPNGEncoding represents a TightPNG encoded update.
+type TightPNGEncoding struct {
+	Colors []Color
+}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*TightPNGEncoding)(nil)
+
+// Marshal implements the Marshaler interface.
+func (*TightPNGEncoding) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Read implements the Encoding interface.
+func (*TightPNGEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	colors, err := readTight(c, rect, true)
+	if err != nil {
+		return nil, err
+	}
+	return &TightPNGEncoding{colors}, nil
+}
+
+// String implements the fmt.Stringer interface.
+func (*TightPNGEncoding) String() string { return "TightPNGEncoding" }
+
+// Type implements the Encoding interface.
+func (*TightPNGEncoding) Type() encodings.Encoding { return encodings.TightPNG }
+
+//-----------------------------------------------------------------------------
+// Tight decoding
+
+// readTight reads a Tight or TightPNG encoded rectangle from the connection.
+func readTight(c *ClientConn, rect *Rectangle, allowPNG bool) ([]Color, error) {
+	var ctrl uint8
+	if err := c.receive(&ctrl); err != nil {
+		return nil, fmt.Errorf("unable to read compression-control: %s", err)
+	}
+
+	// The lower 4 bits request a reset of the corresponding zlib streams.
+	for i := 0; i < tightNumStreams; i++ {
+		if ctrl&(1<<uint(i)) != 0 {
+			c.tightStreams[i].Reset()
+		}
+	}
+
+	switch comp := ctrl >> 4; {
+	case comp == tightFill:
+		color, err := c.readTPixel()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read fill color: %s", err)
+		}
+		colors := make([]Color, rect.Area())
+		for i := range colors {
+			colors[i] = *color
+		}
+		return colors, nil
+	case comp == tightJPEG:
+		return c.readTightImage(rect, jpeg.Decode)
+	case comp == tightPNG && allowPNG:
+		return c.readTightImage(rect, png.Decode)
+	case comp&0x08 == tightBasic && !allowPNG:
+		return c.readTightBasic(rect, comp)
+	default:
+		return nil, fmt.Errorf("invalid compression-control: %#02x", ctrl)
+	}
+}
+
+// readTightBasic reads a rectangle using basic compression.
+func (c *ClientConn) readTightBasic(rect *Rectangle, comp uint8) ([]Color, error) {
+	stream := int(comp & tightStreamMask)
+
+	filter := tightFilterCopy
+	if comp&tightExplicitFilter != 0 {
+		if err := c.receive(&filter); err != nil {
+			return nil, fmt.Errorf("unable to read filter-id: %s", err)
+		}
+	}
+
+	width, height := int(rect.Width), int(rect.Height)
+	tpixelSize := c.pixelFormat.bytesPerTPixel()
+
+	switch filter {
+	case tightFilterCopy:
+		data, err := c.readTightData(stream, rect.Area()*tpixelSize)
+		if err != nil {
+			return nil, err
+		}
+		return c.tpixelsToColors(data)
+	case tightFilterPalette:
+		var numColors uint8
+		if err := c.receive(&numColors); err != nil {
+			return nil, fmt.Errorf("unable to read palette size: %s", err)
+		}
+		palette := make([]Color, int(numColors)+1)
+		for i := range palette {
+			color, err := c.readTPixel()
+			if err != nil {
+				return nil, fmt.Errorf("unable to read palette color: %s", err)
+			}
+			palette[i] = *color
+		}
+		return c.readTightPalette(stream, width, height, palette)
+	case tightFilterGradient:
+		data, err := c.readTightData(stream, rect.Area()*tpixelSize)
+		if err != nil {
+			return nil, err
+		}
+		return c.gradientToColors(data, width, height)
+	default:
+		return nil, fmt.Errorf("invalid filter-id: %d", filter)
+	}
+}
+
+// readTightPalette reads palette indices, which are packed 1 bit per pixel
+// for a 2 color palette, and 1 byte per pixel otherwise.
+func (c *ClientConn) readTightPalette(stream, width, height int, palette []Color) ([]Color, error) {
+	if len(palette) == 2 {
+		rowLen := (width + 7) / 8
+		data, err := c.readTightData(stream, rowLen*height)
+		if err != nil {
+			return nil, err
+		}
+		colors := make([]Color, 0, width*height)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				b := data[y*rowLen+x/8]
+				colors = append(colors, palette[(b>>uint(7-x%8))&1])
+			}
+		}
+		return colors, nil
+	}
+
+	data, err := c.readTightData(stream, width*height)
+	if err != nil {
+		return nil, err
+	}
+	colors := make([]Color, len(data))
+	for i, idx := range data {
+		if int(idx) >= len(palette) {
+			return nil, fmt.Errorf("palette index %d out of range; palette size %d", idx, len(palette))
+		}
+		colors[i] = palette[idx]
+	}
+	return colors, nil
+}
+
+// readTightData reads n bytes of pixel data. Data of at least
+// tightMinToCompress bytes is compressed using the given zlib stream.
+func (c *ClientConn) readTightData(stream, n int) ([]byte, error) {
+	data := make([]byte, n)
+	if n < tightMinToCompress {
+		if err := c.receive(&data); err != nil {
+			return nil, fmt.Errorf("unable to read uncompressed data: %s", err)
+		}
+		return data, nil
+	}
+
+	length, err := c.readCompactLength()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := c.receiveN(&buf, length); err != nil {
+		return nil, fmt.Errorf("unable to read compressed data: %s", err)
+	}
+	zs := &c.tightStreams[stream]
+	zs.Write(buf.Bytes())
+	if _, err := io.ReadFull(zs, data); err != nil {
+		return nil, fmt.Errorf("unable to decompress data with stream %d: %s", stream, err)
+	}
+	if err := zs.Finish(); err != nil {
+		return nil, fmt.Errorf("unable to decompress data with stream %d: %s", stream, err)
+	}
+	return data, nil
+}
+
+// readTightImage reads a compressed image, decoding it with decode.
+func (c *ClientConn) readTightImage(rect *Rectangle, decode func(io.Reader) (image.Image, error)) ([]Color, error) {
+	length, err := c.readCompactLength()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := c.receiveN(&buf, length); err != nil {
+		return nil, fmt.Errorf("unable to read image data: %s", err)
+	}
+	img, err := decode(&buf)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode image: %s", err)
+	}
+
+	bounds := img.Bounds()
+	if bounds.Dx() != int(rect.Width) || bounds.Dy() != int(rect.Height) {
+		return nil, fmt.Errorf("image size %dx%d does not match rectangle %dx%d", bounds.Dx(), bounds.Dy(), rect.Width, rect.Height)
+	}
+	colors := make([]Color, 0, rect.Area())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			color := NewColor(&c.pixelFormat, &c.colorMap)
+			color.R = uint16(r * uint32(c.pixelFormat.RedMax) / 0xffff)
+			color.G = uint16(g * uint32(c.pixelFormat.GreenMax) / 0xffff)
+			color.B = uint16(b * uint32(c.pixelFormat.BlueMax) / 0xffff)
+			colors = append(colors, *color)
+		}
+	}
+	return colors, nil
+}
+
+// readCompactLength reads a length encoded in 1 to 3 bytes, 7 bits per byte,
+// least significant first, with the top bit set if another byte follows.
+func (c *ClientConn) readCompactLength() (int, error) {
+	length := 0
+	for i := uint(0); i < 3; i++ {
+		var b uint8
+		if err := c.receive(&b); err != nil {
+			return 0, fmt.Errorf("unable to read compact length: %s", err)
+		}
+		if i == 2 {
+			length |= int(b) << 14
+			break
+		}
+		length |= int(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	return length, nil
+}
+
+//-----------------------------------------------------------------------------
+// TPIXEL handling
+
+// bytesPerTPixel returns the size of a Tight pixel (TPIXEL). A true color
+// 32 bpp pixel of depth 24 with 8 bits per color is sent as 3 bytes of red,
+// green and blue.
+func (pf PixelFormat) bytesPerTPixel() int {
+	if pf.isTPixel24() {
+		return 3
+	}
+	return int(pf.BPP / 8)
+}
+
+func (pf PixelFormat) isTPixel24() bool {
+	return rfbflags.IsTrueColor(pf.TrueColor) && pf.BPP == 32 && pf.Depth == 24 &&
+		pf.RedMax == 255 && pf.GreenMax == 255 && pf.BlueMax == 255
+}
+
+// readTPixel reads a single TPIXEL from the connection.
+func (c *ClientConn) readTPixel() (*Color, error) {
+	data := make([]byte, c.pixelFormat.bytesPerTPixel())
+	if err := c.receive(&data); err != nil {
+		return nil, err
+	}
+	return c.tpixelToColor(data)
+}
+
+// tpixelToColor converts a TPIXEL into a Color.
+func (c *ClientConn) tpixelToColor(data []byte) (*Color, error) {
+	color := NewColor(&c.pixelFormat, &c.colorMap)
+	if c.pixelFormat.isTPixel24() {
+		color.R, color.G, color.B = uint16(data[0]), uint16(data[1]), uint16(data[2])
+		return color, nil
+	}
+	if err := color.Unmarshal(data); err != nil {
+		return nil, err
+	}
+	return color, nil
+}
+
+// tpixelsToColors converts a slice of TPIXEL data into colors.
+func (c *ClientConn) tpixelsToColors(data []byte) ([]Color, error) {
+	size := c.pixelFormat.bytesPerTPixel()
+	colors := make([]Color, 0, len(data)/size)
+	for i := 0; i+size <= len(data); i += size {
+		color, err := c.tpixelToColor(data[i : i+size])
+		if err != nil {
+			return nil, err
+		}
+		colors = append(colors, *color)
+	}
+	return colors, nil
+}
+
+// gradientToColors reverses the gradient filter. Each color component was
+// sent as the difference from the prediction left + above - above-left,
+// clamped to the component maximum.
+func (c *ClientConn) gradientToColors(data []byte, width, height int) ([]Color, error) {
+	diffs, err := c.tpixelsToColors(data)
+	if err != nil {
+		return nil, err
+	}
+
+	max := [3]int{int(c.pixelFormat.RedMax), int(c.pixelFormat.GreenMax), int(c.pixelFormat.BlueMax)}
+	component := func(color *Color) [3]int {
+		return [3]int{int(color.R), int(color.G), int(color.B)}
+	}
+
+	colors := make([]Color, len(diffs))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var left, above, aboveLeft [3]int
+			if x > 0 {
+				left = component(&colors[y*width+x-1])
+			}
+			if y > 0 {
+				above = component(&colors[(y-1)*width+x])
+			}
+			if x > 0 && y > 0 {
+				aboveLeft = component(&colors[(y-1)*width+x-1])
+			}
+			diff := component(&diffs[y*width+x])
+
+			var v [3]int
+			for i := range v {
+				p := left[i] + above[i] - aboveLeft[i]
+				if p < 0 {
+					p = 0
+				} else if p > max[i] {
+					p = max[i]
+				}
+				v[i] = (p + diff[i]) & max[i]
+			}
+
+			color := NewColor(&c.pixelFormat, &c.colorMap)
+			color.R, color.G, color.B = uint16(v[0]), uint16(v[1]), uint16(v[2])
+			colors[y*width+x] = *color
+		}
+	}
+	return colors, nil
+}
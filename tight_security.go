@@ -0,0 +1,163 @@
+/*
+Implementation of the Tight security type, which negotiates tunnelling and
+authentication capabilities, and extends ServerInit with the messages and
+encodings supported by the server.
+https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#tight-security-type
+*/
+package vnc
+
+import (
+	"fmt"
+
+	"github.com/CambridgeSoftwareLtd/go-vnc/logging"
+	"github.com/golang/glog"
+)
+
+// tightNoTunnel is the code of the tunnelling capability without tunnelling.
+const tightNoTunnel = int32(0)
+
+// TightCapability describes a capability of a server using Tight security.
+type TightCapability struct {
+	Code   int32
+	Vendor [4]byte // e.g. "STDV" or "TGHT".
+	Name   [8]byte // e.g. "NOTUNNEL".
+}
+
+// String implements the fmt.Stringer interface.
+func (c TightCapability) String() string {
+	return fmt.Sprintf("%d:%s:%s", c.Code, c.Vendor[:], c.Name[:])
+}
+
+// TightCapabilities holds the capabilities listed in the Tight extension of
+// the ServerInit message.
+type TightCapabilities struct {
+	ServerMessages []TightCapability
+	ClientMessages []TightCapability
+	Encodings      []TightCapability
+}
+
+// ClientAuthTight is the Tight authentication, which negotiates one of the
+// authentications of the Tight protocol without tunnelling.
+type ClientAuthTight struct {
+	// Auth lists the authentications which may be negotiated, in order of
+	// preference, as for ClientConfig.Auth. If empty, those of the
+	// ClientConfig are used. Tight authentication codes match the security
+	// types of None and VNC.
+	Auth []ClientAuth
+}
+
+// SecurityType implements the ClientAuth interface.
+func (*ClientAuthTight) SecurityType() uint8 {
+	return secTypeTight
+}
+
+// Handshake implements the ClientAuth interface.
+func (auth *ClientAuthTight) Handshake(conn *ClientConn) error {
+	if logging.V(logging.FnDeclLevel) {
+		glog.Info("ClientAuthTight." + logging.FnName())
+	}
+
+	// Decline tunnelling.
+	tunnels, err := conn.readTightCapabilities()
+	if err != nil {
+		return err
+	}
+	if logging.V(logging.ResultLevel) {
+		glog.Infof("tunnels: %v", tunnels)
+	}
+	if len(tunnels) > 0 {
+		if !hasTightCapability(tunnels, tightNoTunnel) {
+			return Errorf("Security handshake failed; server requires tunnelling: %v", tunnels)
+		}
+		if err := conn.send(tightNoTunnel); err != nil {
+			return err
+		}
+	}
+
+	// Choose the authentication.
+	caps, err := conn.readTightCapabilities()
+	if err != nil {
+		return err
+	}
+	if logging.V(logging.ResultLevel) {
+		glog.Infof("auths: %v", caps)
+	}
+	if len(caps) == 0 {
+		return nil // No authentication.
+	}
+	auths := auth.Auth
+	if len(auths) == 0 {
+		auths = conn.config.Auth
+	}
+	// The client's preference order is used.
+	for _, a := range auths {
+		code := int32(a.SecurityType())
+		if a.SecurityType() == secTypeTight || !hasTightCapability(caps, code) {
+			continue
+		}
+		if err := conn.send(code); err != nil {
+			return err
+		}
+		return a.Handshake(conn)
+	}
+	return Errorf("Security handshake failed; no suitable Tight auth schemes found; server supports: %v", caps)
+}
+
+// TightCapabilities returns the capabilities sent by a server using Tight
+// security, or nil for other security types.
+func (c *ClientConn) TightCapabilities() *TightCapabilities {
+	return c.tightCaps
+}
+
+// readTightServerInit reads the Tight extension of the ServerInit message.
+func (c *ClientConn) readTightServerInit() error {
+	var msg struct {
+		NumServerMessages, NumClientMessages, NumEncodings uint16
+		_                                                  [2]byte // padding
+	}
+	if err := c.receive(&msg); err != nil {
+		return err
+	}
+	caps := &TightCapabilities{
+		ServerMessages: make([]TightCapability, msg.NumServerMessages),
+		ClientMessages: make([]TightCapability, msg.NumClientMessages),
+		Encodings:      make([]TightCapability, msg.NumEncodings),
+	}
+	for _, list := range [][]TightCapability{caps.ServerMessages, caps.ClientMessages, caps.Encodings} {
+		if err := c.receive(list); err != nil {
+			return err
+		}
+	}
+	if logging.V(logging.ResultLevel) {
+		glog.Infof("Tight capabilities: %v", caps)
+	}
+	c.tightCaps = caps
+	return nil
+}
+
+// readTightCapabilities reads a counted list of capabilities.
+func (c *ClientConn) readTightCapabilities() ([]TightCapability, error) {
+	var n uint32
+	if err := c.receive(&n); err != nil {
+		return nil, err
+	}
+	// Lists are short, and a long one is likely a protocol error.
+	if n > 255 {
+		return nil, Errorf("Security handshake failed; invalid number of Tight capabilities %d", n)
+	}
+	caps := make([]TightCapability, n)
+	if err := c.receive(caps); err != nil {
+		return nil, err
+	}
+	return caps, nil
+}
+
+// hasTightCapability reports whether caps holds the code.
+func hasTightCapability(caps []TightCapability, code int32) bool {
+	for _, c := range caps {
+		if c.Code == code {
+			return true
+		}
+	}
+	return false
+}
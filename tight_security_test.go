@@ -0,0 +1,135 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// tightCapability returns a capability with the vendor and name given.
+func tightCapability(code int32, vendor, name string) TightCapability {
+	c := TightCapability{Code: code}
+	copy(c.Vendor[:], vendor)
+	copy(c.Name[:], name)
+	return c
+}
+
+func TestClientAuthTight_Impl(t *testing.T) {
+	var raw interface{}
+	raw = new(ClientAuthTight)
+	if _, ok := raw.(ClientAuth); !ok {
+		t.Fatal("ClientAuthTight doesn't implement ClientAuth")
+	}
+}
+
+func TestClientAuthTight_Handshake(t *testing.T) {
+	noTunnel := tightCapability(0, "TGHT", "NOTUNNEL")
+	noAuth := tightCapability(1, "STDV", "NOAUTH__")
+	vncAuth := tightCapability(2, "STDV", "VNCAUTH_")
+	unixAuth := tightCapability(129, "TGHT", "ULGNAUTH")
+
+	want := vncAuthChallenge{}
+	(&ClientAuthVNC{"secret"}).encode(&want)
+
+	for _, tt := range []struct {
+		desc    string
+		auth    *ClientAuthTight
+		tunnels []TightCapability
+		auths   []TightCapability
+		sent    []byte
+		ok      bool
+	}{
+		{"no tunnels or auths",
+			&ClientAuthTight{},
+			nil, nil,
+			[]byte{}, true},
+		{"no auth",
+			&ClientAuthTight{},
+			[]TightCapability{noTunnel}, []TightCapability{unixAuth, noAuth},
+			[]byte{0, 0, 0, 0, 0, 0, 0, 1}, true},
+		{"VNC auth in client order",
+			&ClientAuthTight{Auth: []ClientAuth{&ClientAuthVNC{"secret"}, &ClientAuthNone{}}},
+			[]TightCapability{noTunnel}, []TightCapability{noAuth, vncAuth},
+			append([]byte{0, 0, 0, 0, 0, 0, 0, 2}, want[:]...), true},
+		{"tunnel required",
+			&ClientAuthTight{},
+			[]TightCapability{tightCapability(1, "SICR", "SCHANNEL")}, nil,
+			nil, false},
+		{"unsupported auth",
+			&ClientAuthTight{},
+			nil, []TightCapability{unixAuth},
+			nil, false},
+	} {
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, &ClientConfig{Auth: []ClientAuth{&ClientAuthTight{}, &ClientAuthNone{}}})
+
+		for _, caps := range [][]TightCapability{tt.tunnels, tt.auths} {
+			binary.Write(&mockConn.b, binary.BigEndian, uint32(len(caps)))
+			binary.Write(&mockConn.b, binary.BigEndian, caps)
+		}
+		for _, c := range tt.auths {
+			if c.Code == 2 {
+				mockConn.b.Write(make([]byte, 16)) // A challenge of zeros.
+				break
+			}
+		}
+
+		err := tt.auth.Handshake(conn)
+		if err == nil && !tt.ok {
+			t.Errorf("%s: expected error", tt.desc)
+			continue
+		}
+		if err != nil && tt.ok {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		// All the server sent has been read, leaving what the client sent.
+		if got := mockConn.b.Bytes(); !bytes.Equal(got, tt.sent) {
+			t.Errorf("%s: incorrect data sent; got = %v, want = %v", tt.desc, got, tt.sent)
+		}
+	}
+}
+
+func TestServerInit_Tight(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+	conn.config.secType = secTypeTight
+
+	want := &TightCapabilities{
+		ServerMessages: []TightCapability{tightCapability(150, "TGHT", "FTS_LSDT")},
+		ClientMessages: []TightCapability{},
+		Encodings: []TightCapability{
+			tightCapability(7, "TGHT", "TIGHT___"),
+			tightCapability(-224, "TGHT", "LASTRECT"),
+		},
+	}
+
+	pf, err := PixelFormat32bit.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.Write(&mockConn.b, binary.BigEndian, []uint16{100, 200})
+	mockConn.b.Write(pf)
+	binary.Write(&mockConn.b, binary.BigEndian, uint32(3))
+	mockConn.b.Write([]byte("foo"))
+	binary.Write(&mockConn.b, binary.BigEndian, []uint16{1, 0, 2, 0})
+	binary.Write(&mockConn.b, binary.BigEndian, want.ServerMessages)
+	binary.Write(&mockConn.b, binary.BigEndian, want.Encodings)
+
+	if err := conn.serverInit(); err != nil {
+		t.Fatalf("unexpected error; %s", err)
+	}
+	if got, want := conn.DesktopName(), "foo"; got != want {
+		t.Errorf("incorrect desktop name; got = %q, want = %q", got, want)
+	}
+	if got := conn.TightCapabilities(); !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect capabilities; got = %v, want = %v", got, want)
+	}
+	if got := mockConn.b.Len(); got != 0 {
+		t.Errorf("%d bytes unread", got)
+	}
+}
@@ -0,0 +1,325 @@
+package vnc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"reflect"
+	"testing"
+
+	"github.com/CambridgeSoftwareLtd/go-vnc/encodings"
+)
+
+// compactLength returns the Tight compact representation of a length.
+func compactLength(n int) []byte {
+	b := []byte{byte(n & 0x7f)}
+	if n > 0x7f {
+		b[0] |= 0x80
+		b = append(b, byte((n>>7)&0x7f))
+		if n > 0x3fff {
+			b[1] |= 0x80
+			b = append(b, byte(n>>14))
+		}
+	}
+	return b
+}
+
+// tightZlib compresses data, flushing the stream so it can be decoded
+// without closing the writer.
+func tightZlib(t *testing.T, w *zlib.Writer, buf *bytes.Buffer, data []byte) []byte {
+	buf.Reset()
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return append(compactLength(buf.Len()), buf.Bytes()...)
+}
+
+// rgbOf returns the color components of colors, in order.
+func rgbOf(colors []Color) []uint16 {
+	var rgb []uint16
+	for _, c := range colors {
+		rgb = append(rgb, c.R, c.G, c.B)
+	}
+	return rgb
+}
+
+func TestTightEncoding_Type(t *testing.T) {
+	if got, want := (&TightEncoding{}).Type(), encodings.Tight; got != want {
+		t.Errorf("incorrect encoding; got = %s, want = %s", got, want)
+	}
+	if got, want := (&TightPNGEncoding{}).Type(), encodings.TightPNG; got != want {
+		t.Errorf("incorrect encoding; got = %s, want = %s", got, want)
+	}
+}
+
+func TestReadCompactLength(t *testing.T) {
+	for _, tt := range []struct {
+		data   []byte
+		length int
+	}{
+		{[]byte{0x00}, 0},
+		{[]byte{0x7f}, 127},
+		{[]byte{0x80, 0x01}, 128},
+		{[]byte{0xff, 0x7f}, 16383},
+		{[]byte{0x80, 0x80, 0x01}, 16384},
+		{[]byte{0xff, 0xff, 0xff}, 4194303},
+	} {
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, &ClientConfig{})
+		if err := conn.send(tt.data); err != nil {
+			t.Fatal(err)
+		}
+		length, err := conn.readCompactLength()
+		if err != nil {
+			t.Errorf("%v: unexpected error; %s", tt.data, err)
+			continue
+		}
+		if got, want := length, tt.length; got != want {
+			t.Errorf("%v: incorrect length; got = %d, want = %d", tt.data, got, want)
+		}
+		if got, want := compactLength(tt.length), tt.data; !bytes.Equal(got, want) {
+			t.Errorf("%v: incorrect compact length; got = %v, want = %v", tt.length, got, want)
+		}
+	}
+}
+
+func TestTightEncoding_Read(t *testing.T) {
+	var zbuf [tightNumStreams]bytes.Buffer
+	var zw [tightNumStreams]*zlib.Writer
+	for i := range zw {
+		zw[i] = zlib.NewWriter(&zbuf[i])
+	}
+
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+	conn.pixelFormat = pixelFormat24bit
+
+	for _, tt := range []struct {
+		desc string
+		w, h uint16
+		data []byte
+		rgb  []uint16
+		ok   bool
+	}{
+		{"fill",
+			2, 1,
+			[]byte{tightFill << 4, 1, 2, 3},
+			[]uint16{1, 2, 3, 1, 2, 3},
+			true},
+		{"copy filter uncompressed",
+			2, 1,
+			[]byte{0x00, 1, 2, 3, 4, 5, 6},
+			[]uint16{1, 2, 3, 4, 5, 6},
+			true},
+		{"copy filter compressed",
+			2, 2,
+			append([]byte{0x10}, tightZlib(t, zw[1], &zbuf[1], []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12})...),
+			[]uint16{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+			true},
+		{"copy filter compressed continues stream",
+			2, 2,
+			append([]byte{0x10}, tightZlib(t, zw[1], &zbuf[1], []byte{12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1})...),
+			[]uint16{12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+			true},
+		{"explicit copy filter",
+			1, 1,
+			[]byte{tightExplicitFilter << 4, tightFilterCopy, 7, 8, 9},
+			[]uint16{7, 8, 9},
+			true},
+		{"two color palette",
+			3, 2,
+			[]byte{
+				(tightExplicitFilter | 2) << 4, tightFilterPalette, 1, 10, 10, 10, 20, 20, 20,
+				0xa0, 0x40,
+			},
+			[]uint16{
+				20, 20, 20, 10, 10, 10, 20, 20, 20,
+				10, 10, 10, 20, 20, 20, 10, 10, 10,
+			},
+			true},
+		{"palette",
+			3, 1,
+			[]byte{tightExplicitFilter << 4, tightFilterPalette, 2, 1, 1, 1, 2, 2, 2, 3, 3, 3, 2, 0, 1},
+			[]uint16{3, 3, 3, 1, 1, 1, 2, 2, 2},
+			true},
+		{"palette index out of range",
+			3, 1,
+			[]byte{tightExplicitFilter << 4, tightFilterPalette, 2, 1, 1, 1, 2, 2, 2, 3, 3, 3, 2, 0, 3},
+			nil,
+			false},
+		{"gradient",
+			2, 2,
+			append([]byte{tightExplicitFilter << 4, tightFilterGradient}, tightZlib(t, zw[0], &zbuf[0], []byte{
+				// Predicted from nothing, then from the left pixel.
+				10, 20, 30, 5, 0, 251,
+				// Predicted from above, then left + above - above-left.
+				1, 1, 1, 0, 0, 0,
+			})...),
+			[]uint16{
+				10, 20, 30, 15, 20, 25,
+				11, 21, 31, 16, 21, 26,
+			},
+			true},
+		{"invalid filter",
+			1, 1,
+			[]byte{tightExplicitFilter << 4, 3},
+			nil,
+			false},
+		{"png is invalid for tight",
+			1, 1,
+			[]byte{tightPNG << 4, 0},
+			nil,
+			false},
+	} {
+		mockConn.Reset()
+		if err := conn.send(tt.data); err != nil {
+			t.Fatal(err)
+		}
+		rect := &Rectangle{Width: tt.w, Height: tt.h}
+		enc, err := (&TightEncoding{}).Read(conn, rect)
+		if err == nil && !tt.ok {
+			t.Errorf("%s: expected error", tt.desc)
+			continue
+		}
+		if err != nil && tt.ok {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if got, want := rgbOf(enc.(*TightEncoding).Colors), tt.rgb; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: incorrect colors; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
+
+func TestTightEncoding_StreamReset(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+	conn.pixelFormat = pixelFormat24bit
+
+	data := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	for i := 0; i < 2; i++ {
+		// Each rectangle uses a new zlib stream, so the stream must be reset.
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		msg := append([]byte{0x20 | 1<<2}, tightZlib(t, zw, &buf, data)...)
+
+		mockConn.Reset()
+		if err := conn.send(msg); err != nil {
+			t.Fatal(err)
+		}
+		enc, err := (&TightEncoding{}).Read(conn, &Rectangle{Width: 2, Height: 2})
+		if err != nil {
+			t.Fatalf("%d: unexpected error; %s", i, err)
+		}
+		if got, want := rgbOf(enc.(*TightEncoding).Colors), []uint16{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%d: incorrect colors; got = %v, want = %v", i, got, want)
+		}
+	}
+}
+
+func TestTightEncoding_ReadJPEG(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for i := 0; i < len(img.Pix); i += 4 {
+		copy(img.Pix[i:], []byte{200, 100, 50, 255})
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+	conn.pixelFormat = pixelFormat24bit
+	msg := append([]byte{tightJPEG << 4}, compactLength(buf.Len())...)
+	if err := conn.send(append(msg, buf.Bytes()...)); err != nil {
+		t.Fatal(err)
+	}
+
+	enc, err := (&TightEncoding{}).Read(conn, &Rectangle{Width: 8, Height: 8})
+	if err != nil {
+		t.Fatalf("unexpected error; %s", err)
+	}
+	colors := enc.(*TightEncoding).Colors
+	if got, want := len(colors), 64; got != want {
+		t.Fatalf("incorrect number of colors; got = %d, want = %d", got, want)
+	}
+	// JPEG is lossy, so allow for some error.
+	near := func(got, want uint16) bool { return got+4 >= want && got <= want+4 }
+	for i, c := range colors {
+		if !near(c.R, 200) || !near(c.G, 100) || !near(c.B, 50) {
+			t.Errorf("%d: incorrect color; got = %v, want = {200 100 50}", i, []uint16{c.R, c.G, c.B})
+			break
+		}
+	}
+}
+
+func TestTightPNGEncoding_Read(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	img.Set(0, 0, color.RGBA{1, 2, 3, 255})
+	img.Set(1, 0, color.RGBA{4, 5, 6, 255})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		desc string
+		w, h uint16
+		data []byte
+		rgb  []uint16
+		ok   bool
+	}{
+		{"png",
+			2, 1,
+			append(append([]byte{tightPNG << 4}, compactLength(buf.Len())...), buf.Bytes()...),
+			[]uint16{1, 2, 3, 4, 5, 6},
+			true},
+		{"png with wrong size",
+			3, 1,
+			append(append([]byte{tightPNG << 4}, compactLength(buf.Len())...), buf.Bytes()...),
+			nil,
+			false},
+		{"fill",
+			1, 1,
+			[]byte{tightFill << 4, 9, 8, 7},
+			[]uint16{9, 8, 7},
+			true},
+		{"basic is invalid for tightpng",
+			1, 1,
+			[]byte{0x00, 1, 2, 3},
+			nil,
+			false},
+	} {
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, &ClientConfig{})
+		conn.pixelFormat = pixelFormat24bit
+		if err := conn.send(tt.data); err != nil {
+			t.Fatal(err)
+		}
+
+		enc, err := (&TightPNGEncoding{}).Read(conn, &Rectangle{Width: tt.w, Height: tt.h})
+		if err == nil && !tt.ok {
+			t.Errorf("%s: expected error", tt.desc)
+			continue
+		}
+		if err != nil && tt.ok {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if got, want := rgbOf(enc.(*TightPNGEncoding).Colors), tt.rgb; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: incorrect colors; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Implementation of the TLS security type, which negotiates a further security
+type over a TLS connection to the server.
+https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#tls
+*/
+package vnc
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+
+	"github.com/CambridgeSoftwareLtd/go-vnc/logging"
+	"github.com/golang/glog"
+)
+
+// ClientAuthTLS is the TLS authentication, as used by Vino. Such servers offer
+// anonymous TLS, which encrypts the connection without authenticating the
+// server, and so is only used when Anonymous is set.
+type ClientAuthTLS struct {
+	// Anonymous selects anonymous TLS in place of TLS with a certificate. It
+	// does not protect against an active attacker.
+	Anonymous bool
+
+	// TLSConfig configures TLS with a certificate, which is verified against
+	// it, using the host of the connection when ServerName is not set. Set
+	// InsecureSkipVerify to accept any certificate. If nil, the certificate
+	// is verified against the system roots.
+	TLSConfig *tls.Config
+
+	// Auth lists the authentications which may be negotiated over TLS, as
+	// for ClientConfig.Auth. If empty, those of the ClientConfig are used.
+	Auth []ClientAuth
+}
+
+// SecurityType implements the ClientAuth interface.
+func (*ClientAuthTLS) SecurityType() uint8 {
+	return secTypeTLS
+}
+
+// Handshake implements the ClientAuth interface.
+func (auth *ClientAuthTLS) Handshake(conn *ClientConn) error {
+	if logging.V(logging.FnDeclLevel) {
+		glog.Info("ClientAuthTLS." + logging.FnName())
+	}
+
+	if auth.Anonymous {
+		if err := conn.startAnonTLS(); err != nil {
+			return err
+		}
+	} else {
+		cfg := &tls.Config{}
+		if auth.TLSConfig != nil {
+			cfg = auth.TLSConfig.Clone()
+		}
+		conn.setTLSServerName(cfg)
+		if err := conn.startTLS(cfg); err != nil {
+			return err
+		}
+	}
+
+	// The security types are negotiated again over TLS.
+	auths := auth.Auth
+	if len(auths) == 0 {
+		auths = conn.config.Auth
+	}
+	var inner []ClientAuth
+	for _, a := range auths {
+		if a.SecurityType() != secTypeTLS {
+			inner = append(inner, a)
+		}
+	}
+	a, err := conn.chooseAuth(inner)
+	if err != nil {
+		return err
+	}
+	return a.Handshake(conn)
+}
+
+// startTLS performs a TLS handshake over the connection, which is then
+// replaced by the TLS connection.
+func (c *ClientConn) startTLS(cfg *tls.Config) error {
+	tlsConn := tls.Client(c.Conn(), cfg)
+	if err := tlsConn.Handshake(); err != nil {
+		// A server offering only anonymous cipher suites has none in common
+		// with crypto/tls, and aborts the handshake.
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "remote error" && opErr.Err.Error() == "tls: handshake failure" {
+			return Errorf("Security handshake failed; TLS handshake failed, as the server may only offer anonymous TLS: %s", err)
+		}
+		return Errorf("Security handshake failed; TLS handshake failed: %s", err)
+	}
+	c.SetConn(tlsConn)
+	return nil
+}
+
+// startAnonTLS performs an anonymous TLS handshake over the connection, which
+// is then replaced by the TLS connection.
+func (c *ClientConn) startAnonTLS() error {
+	tlsConn, err := anonTLSClient(c.Conn())
+	if err != nil {
+		return Errorf("Security handshake failed; anonymous TLS handshake failed: %s", err)
+	}
+	c.SetConn(tlsConn)
+	return nil
+}
+
+// setTLSServerName sets the ServerName of cfg, if not set, to the host of the
+// connection, against which the certificate of the server is verified.
+func (c *ClientConn) setTLSServerName(cfg *tls.Config) {
+	if cfg.ServerName != "" || c.Conn().RemoteAddr() == nil {
+		return
+	}
+	if host, _, err := net.SplitHostPort(c.Conn().RemoteAddr().String()); err == nil {
+		cfg.ServerName = host
+	}
+}
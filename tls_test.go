@@ -0,0 +1,171 @@
+package vnc
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// testAddr is a TCP address, which may hold a host name.
+type testAddr string
+
+func (testAddr) Network() string  { return "tcp" }
+func (a testAddr) String() string { return string(a) }
+
+// remoteAddrConn is a connection to a remote address.
+type remoteAddrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *remoteAddrConn) RemoteAddr() net.Addr { return c.addr }
+
+// tlsServer performs the server side of a TLS security handshake, offering
+// VNC authentication over TLS, and returns the response to the challenge. The
+// TLS is anonymous if cfg is nil.
+func tlsServer(c net.Conn, cfg *tls.Config) ([]byte, error) {
+	defer c.Close()
+
+	if _, err := c.Write([]byte{1, secTypeTLS}); err != nil {
+		return nil, err
+	}
+	var secType uint8
+	if err := binary.Read(c, binary.BigEndian, &secType); err != nil {
+		return nil, err
+	}
+	if secType != secTypeTLS {
+		return nil, fmt.Errorf("incorrect security type %d", secType)
+	}
+
+	var tc net.Conn
+	if cfg == nil {
+		ac, err := anonTLSServer(c, 0x00a6, nil)
+		if err != nil {
+			return nil, err
+		}
+		tc = ac
+	} else {
+		sc := tls.Server(c, cfg)
+		if err := sc.Handshake(); err != nil {
+			return nil, err
+		}
+		tc = sc
+	}
+	if _, err := tc.Write([]byte{2, secTypeNone, secTypeVNCAuth}); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(tc, binary.BigEndian, &secType); err != nil {
+		return nil, err
+	}
+	if secType != secTypeVNCAuth {
+		return nil, fmt.Errorf("incorrect security type over TLS %d", secType)
+	}
+	// Send a challenge of zeros.
+	if _, err := tc.Write(make([]byte, 16)); err != nil {
+		return nil, err
+	}
+	res := make([]byte, 16)
+	if _, err := io.ReadFull(tc, res); err != nil {
+		return nil, err
+	}
+	// Send the SecurityResult.
+	if _, err := tc.Write([]byte{0, 0, 0, 0}); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func TestClientAuthTLS_Impl(t *testing.T) {
+	var raw interface{}
+	raw = new(ClientAuthTLS)
+	if _, ok := raw.(ClientAuth); !ok {
+		t.Fatal("ClientAuthTLS doesn't implement ClientAuth")
+	}
+}
+
+func TestClientAuthTLS_Handshake(t *testing.T) {
+	cert, pool := newTestCertificate(t)
+
+	want := vncAuthChallenge{}
+	(&ClientAuthVNC{"secret"}).encode(&want)
+
+	serverCfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	// No cipher suite in common, as with a server offering only anonymous
+	// cipher suites.
+	anonCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		CipherSuites: []uint16{tls.TLS_RSA_WITH_RC4_128_SHA},
+		MaxVersion:   tls.VersionTLS12,
+	}
+	verifiedCfg := &tls.Config{RootCAs: pool}
+
+	for _, tt := range []struct {
+		desc      string
+		auth      *ClientAuthTLS
+		serverCfg *tls.Config
+		ok        bool
+		err       string
+	}{
+		{"verified", &ClientAuthTLS{TLSConfig: &tls.Config{RootCAs: pool, ServerName: "localhost"}}, serverCfg, true, ""},
+		{"verified against the address", &ClientAuthTLS{TLSConfig: verifiedCfg}, serverCfg, true, ""},
+		{"unverified", &ClientAuthTLS{TLSConfig: &tls.Config{InsecureSkipVerify: true}}, serverCfg, true, ""},
+		{"inner auth", &ClientAuthTLS{TLSConfig: verifiedCfg, Auth: []ClientAuth{&ClientAuthVNC{"secret"}}}, serverCfg, true, ""},
+		{"untrusted", &ClientAuthTLS{TLSConfig: &tls.Config{ServerName: "localhost"}}, serverCfg, false, "certificate"},
+		{"untrusted without TLSConfig", &ClientAuthTLS{}, serverCfg, false, "certificate"},
+		{"anonymous", &ClientAuthTLS{Anonymous: true}, nil, true, ""},
+		{"anonymous server", &ClientAuthTLS{}, anonCfg, false, "anonymous TLS"},
+	} {
+		client, server := net.Pipe()
+		result := make(chan []byte, 1)
+		go func() {
+			b, _ := tlsServer(server, tt.serverCfg)
+			result <- b
+		}()
+
+		// The ClientConfig auths are used over TLS, unless given.
+		cfg := &ClientConfig{Auth: []ClientAuth{tt.auth, &ClientAuthVNC{"secret"}}}
+		if tt.auth.Auth != nil {
+			cfg.Auth = []ClientAuth{tt.auth}
+		}
+		conn := NewClientConn(&remoteAddrConn{client, testAddr("localhost:5900")}, cfg)
+		conn.protocolVersion = PROTO_VERS_3_8
+
+		err := conn.securityHandshake()
+		if err == nil && !tt.ok {
+			t.Errorf("%s: expected error", tt.desc)
+		}
+		if err != nil && tt.ok {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: incorrect error; got = %s, want = %s", tt.desc, err, tt.err)
+		}
+		if err == nil {
+			switch conn.Conn().(type) {
+			case *tls.Conn, *anonTLSConn:
+			default:
+				t.Errorf("%s: incorrect transport %T", tt.desc, conn.Conn())
+			}
+			if err := conn.securityResultHandshake(); err != nil {
+				t.Errorf("%s: unexpected SecurityResult error; %s", tt.desc, err)
+			}
+		}
+		conn.Close()
+
+		got := <-result
+		if !tt.ok {
+			continue
+		}
+		if !bytes.Equal(got, want[:]) {
+			t.Errorf("%s: incorrect response; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+	if got := verifiedCfg.ServerName; got != "" {
+		t.Errorf("TLSConfig modified; ServerName = %q", got)
+	}
+}
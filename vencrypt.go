@@ -0,0 +1,215 @@
+/*
+Implementation of the VeNCrypt security type, which authenticates over a TLS
+connection to the server.
+https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#vencrypt
+*/
+package vnc
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/CambridgeSoftwareLtd/go-vnc/logging"
+	"github.com/golang/glog"
+)
+
+// The supported version of VeNCrypt.
+const (
+	veNCryptMajor = uint8(0)
+	veNCryptMinor = uint8(2)
+)
+
+// VeNCryptSubType is a VeNCrypt security sub-type.
+type VeNCryptSubType uint32
+
+// VeNCrypt security sub-types. The TLS sub-types use anonymous TLS, which does
+// not authenticate the server, while the X509 sub-types verify its
+// certificate.
+const (
+	VeNCryptPlain     VeNCryptSubType = 256 // Plain authentication, unencrypted.
+	VeNCryptTLSNone   VeNCryptSubType = 257
+	VeNCryptTLSVnc    VeNCryptSubType = 258
+	VeNCryptTLSPlain  VeNCryptSubType = 259
+	VeNCryptX509None  VeNCryptSubType = 260
+	VeNCryptX509Vnc   VeNCryptSubType = 261
+	VeNCryptX509Plain VeNCryptSubType = 262
+)
+
+// String implements the fmt.Stringer interface.
+func (t VeNCryptSubType) String() string {
+	switch t {
+	case VeNCryptPlain:
+		return "Plain"
+	case VeNCryptTLSNone:
+		return "TLSNone"
+	case VeNCryptTLSVnc:
+		return "TLSVnc"
+	case VeNCryptTLSPlain:
+		return "TLSPlain"
+	case VeNCryptX509None:
+		return "X509None"
+	case VeNCryptX509Vnc:
+		return "X509Vnc"
+	case VeNCryptX509Plain:
+		return "X509Plain"
+	}
+	return fmt.Sprintf("VeNCryptSubType(%d)", uint32(t))
+}
+
+// security reports whether the sub-type is TLS encrypted, and whether the TLS
+// is anonymous.
+func (t VeNCryptSubType) security() (encrypted, anonymous bool) {
+	switch t {
+	case VeNCryptTLSNone, VeNCryptTLSVnc, VeNCryptTLSPlain:
+		return true, true
+	case VeNCryptX509None, VeNCryptX509Vnc, VeNCryptX509Plain:
+		return true, false
+	}
+	return false, false
+}
+
+// defaultVeNCryptSubTypes lists the sub-types used when none are configured,
+// which are those verifying the server.
+var defaultVeNCryptSubTypes = []VeNCryptSubType{
+	VeNCryptX509Plain, VeNCryptX509Vnc, VeNCryptX509None,
+}
+
+// ClientAuthVeNCrypt is the VeNCrypt authentication.
+type ClientAuthVeNCrypt struct {
+	// SubTypes lists the acceptable sub-types in order of preference. If
+	// empty, only the X509 sub-types are accepted. The TLS sub-types, which
+	// do not protect against an active attacker, must be listed to be used.
+	SubTypes []VeNCryptSubType
+
+	// TLSConfig configures the TLS of the X509 sub-types. The certificate of
+	// the server is verified against it, using the host of the connection
+	// when ServerName is not set. Set InsecureSkipVerify to accept any
+	// certificate. If nil, the certificate is verified against the system
+	// roots.
+	TLSConfig *tls.Config
+
+	// Username and Password for the Plain sub-types. Password is also used
+	// for the Vnc sub-types.
+	Username, Password string
+}
+
+// SecurityType implements the ClientAuth interface.
+func (*ClientAuthVeNCrypt) SecurityType() uint8 {
+	return secTypeVeNCrypt
+}
+
+// Handshake implements the ClientAuth interface.
+func (auth *ClientAuthVeNCrypt) Handshake(conn *ClientConn) error {
+	if logging.V(logging.FnDeclLevel) {
+		glog.Info("ClientAuthVeNCrypt." + logging.FnName())
+	}
+
+	// Negotiate the version.
+	var version [2]uint8
+	if err := conn.receive(&version); err != nil {
+		return err
+	}
+	if version[0] == veNCryptMajor && version[1] < veNCryptMinor {
+		return Errorf("Security handshake failed; unsupported VeNCrypt version %d.%d", version[0], version[1])
+	}
+	if err := conn.send([2]uint8{veNCryptMajor, veNCryptMinor}); err != nil {
+		return err
+	}
+	var status uint8
+	if err := conn.receive(&status); err != nil {
+		return err
+	}
+	if status != 0 {
+		return Errorf("Security handshake failed; server rejected VeNCrypt version %d.%d", veNCryptMajor, veNCryptMinor)
+	}
+
+	// Choose the sub-type.
+	var numSubTypes uint8
+	if err := conn.receive(&numSubTypes); err != nil {
+		return err
+	}
+	if numSubTypes == 0 {
+		return NewVNCError("Security handshake failed; no VeNCrypt sub-types")
+	}
+	subTypes := make([]VeNCryptSubType, numSubTypes)
+	if err := conn.receive(&subTypes); err != nil {
+		return err
+	}
+	if logging.V(logging.ResultLevel) {
+		glog.Infof("subTypes: %v", subTypes)
+	}
+	subType, ok := auth.chooseSubType(subTypes)
+	if !ok {
+		return Errorf("Security handshake failed; no suitable VeNCrypt sub-types found; server supports: %v", subTypes)
+	}
+	if err := conn.send(subType); err != nil {
+		return err
+	}
+
+	if encrypted, anonymous := subType.security(); encrypted {
+		var ack uint8
+		if err := conn.receive(&ack); err != nil {
+			return err
+		}
+		if ack != 1 {
+			return Errorf("Security handshake failed; server refused VeNCrypt sub-type %s", subType)
+		}
+		if err := auth.startTLS(conn, anonymous); err != nil {
+			return err
+		}
+	}
+
+	switch subType {
+	case VeNCryptTLSVnc, VeNCryptX509Vnc:
+		return (&ClientAuthVNC{auth.Password}).Handshake(conn)
+	case VeNCryptPlain, VeNCryptTLSPlain, VeNCryptX509Plain:
+		return auth.plain(conn)
+	}
+	return nil
+}
+
+// chooseSubType returns the most preferred sub-type supported by the server.
+func (auth *ClientAuthVeNCrypt) chooseSubType(supported []VeNCryptSubType) (VeNCryptSubType, bool) {
+	prefs := auth.SubTypes
+	if len(prefs) == 0 {
+		prefs = defaultVeNCryptSubTypes
+	}
+	for _, t := range prefs {
+		for _, s := range supported {
+			if t == s {
+				return t, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// startTLS performs the TLS handshake, after which the connection is TLS
+// encrypted.
+func (auth *ClientAuthVeNCrypt) startTLS(conn *ClientConn, anonymous bool) error {
+	if anonymous {
+		return conn.startAnonTLS()
+	}
+	cfg := &tls.Config{}
+	if auth.TLSConfig != nil {
+		cfg = auth.TLSConfig.Clone()
+	}
+	conn.setTLSServerName(cfg)
+	return conn.startTLS(cfg)
+}
+
+// plain performs the Plain sub-type authentication.
+func (auth *ClientAuthVeNCrypt) plain(conn *ClientConn) error {
+	if auth.Username == "" || auth.Password == "" {
+		return NewVNCError("Security Handshake failed; no username or password provided for VeNCrypt Plain.")
+	}
+
+	buf := NewBuffer(nil)
+	if err := buf.Write([2]uint32{uint32(len(auth.Username)), uint32(len(auth.Password))}); err != nil {
+		return err
+	}
+	if err := buf.Write([]byte(auth.Username + auth.Password)); err != nil {
+		return err
+	}
+	return conn.send(buf.Bytes())
+}
@@ -0,0 +1,241 @@
+package vnc
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestCertificate returns a self-signed certificate for localhost.
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// veNCryptServer performs the server side of a VeNCrypt handshake offering
+// subTypes, returning the authentication sent by the client.
+func veNCryptServer(c net.Conn, cert tls.Certificate, subTypes []VeNCryptSubType) ([]byte, error) {
+	defer c.Close()
+
+	if _, err := c.Write([]byte{0, 2}); err != nil {
+		return nil, err
+	}
+	var version [2]uint8
+	if err := binary.Read(c, binary.BigEndian, &version); err != nil {
+		return nil, err
+	}
+	if version != [2]uint8{0, 2} {
+		return nil, fmt.Errorf("incorrect version %v", version)
+	}
+	if _, err := c.Write([]byte{0, uint8(len(subTypes))}); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(c, binary.BigEndian, subTypes); err != nil {
+		return nil, err
+	}
+	var subType VeNCryptSubType
+	if err := binary.Read(c, binary.BigEndian, &subType); err != nil {
+		return nil, err
+	}
+
+	rw := io.ReadWriter(c)
+	if encrypted, anonymous := subType.security(); encrypted {
+		if _, err := c.Write([]byte{1}); err != nil {
+			return nil, err
+		}
+		if anonymous {
+			ac, err := anonTLSServer(c, 0x00a6, nil)
+			if err != nil {
+				return nil, err
+			}
+			rw = ac
+		} else {
+			tc := tls.Server(c, &tls.Config{Certificates: []tls.Certificate{cert}})
+			if err := tc.Handshake(); err != nil {
+				return nil, err
+			}
+			rw = tc
+		}
+	}
+
+	var auth bytes.Buffer
+	switch subType {
+	case VeNCryptTLSVnc, VeNCryptX509Vnc:
+		// Send a challenge of zeros.
+		if _, err := rw.Write(make([]byte, 16)); err != nil {
+			return nil, err
+		}
+		if _, err := io.CopyN(&auth, rw, 16); err != nil {
+			return nil, err
+		}
+	case VeNCryptPlain, VeNCryptTLSPlain, VeNCryptX509Plain:
+		var lengths [2]uint32
+		if err := binary.Read(rw, binary.BigEndian, &lengths); err != nil {
+			return nil, err
+		}
+		binary.Write(&auth, binary.BigEndian, lengths)
+		if _, err := io.CopyN(&auth, rw, int64(lengths[0]+lengths[1])); err != nil {
+			return nil, err
+		}
+	}
+	// Send the SecurityResult, over TLS if it is in use.
+	if _, err := rw.Write([]byte{0, 0, 0, 0}); err != nil {
+		return nil, err
+	}
+	return auth.Bytes(), nil
+}
+
+func TestClientAuthVeNCrypt_Impl(t *testing.T) {
+	var raw interface{}
+	raw = new(ClientAuthVeNCrypt)
+	if _, ok := raw.(ClientAuth); !ok {
+		t.Fatal("ClientAuthVeNCrypt doesn't implement ClientAuth")
+	}
+}
+
+func TestClientAuthVeNCrypt_Handshake(t *testing.T) {
+	cert, pool := newTestCertificate(t)
+	trusted := &tls.Config{RootCAs: pool, ServerName: "localhost"}
+
+	zeroChallenge := vncAuthChallenge{}
+	(&ClientAuthVNC{"secret"}).encode(&zeroChallenge)
+	plain := append([]byte{0, 0, 0, 4, 0, 0, 0, 6}, "usersecret"...)
+
+	for _, tt := range []struct {
+		desc     string
+		auth     *ClientAuthVeNCrypt
+		subTypes []VeNCryptSubType
+		sent     []byte
+		ok       bool
+	}{
+		{"X509None",
+			&ClientAuthVeNCrypt{TLSConfig: trusted},
+			[]VeNCryptSubType{VeNCryptX509None, VeNCryptTLSNone},
+			[]byte{}, true},
+		{"X509Vnc",
+			&ClientAuthVeNCrypt{TLSConfig: trusted, Password: "secret"},
+			[]VeNCryptSubType{VeNCryptX509Vnc},
+			zeroChallenge[:], true},
+		{"X509Plain",
+			&ClientAuthVeNCrypt{TLSConfig: trusted, Username: "user", Password: "secret"},
+			[]VeNCryptSubType{VeNCryptX509Plain, VeNCryptTLSPlain},
+			plain, true},
+		{"X509None with InsecureSkipVerify",
+			&ClientAuthVeNCrypt{TLSConfig: &tls.Config{InsecureSkipVerify: true}},
+			[]VeNCryptSubType{VeNCryptX509None},
+			[]byte{}, true},
+		{"TLSNone when configured",
+			&ClientAuthVeNCrypt{SubTypes: []VeNCryptSubType{VeNCryptTLSNone}, TLSConfig: &tls.Config{ServerName: "localhost"}},
+			[]VeNCryptSubType{VeNCryptTLSNone},
+			[]byte{}, true},
+		{"TLSVnc when configured",
+			&ClientAuthVeNCrypt{SubTypes: []VeNCryptSubType{VeNCryptTLSVnc}, Password: "secret"},
+			[]VeNCryptSubType{VeNCryptTLSVnc},
+			zeroChallenge[:], true},
+		{"TLSPlain when configured",
+			&ClientAuthVeNCrypt{SubTypes: []VeNCryptSubType{VeNCryptTLSPlain}, Username: "user", Password: "secret"},
+			[]VeNCryptSubType{VeNCryptTLSPlain},
+			plain, true},
+		{"Plain when configured",
+			&ClientAuthVeNCrypt{SubTypes: []VeNCryptSubType{VeNCryptPlain}, Username: "user", Password: "secret"},
+			[]VeNCryptSubType{VeNCryptPlain, VeNCryptTLSNone},
+			plain, true},
+		{"X509None with an untrusted certificate",
+			&ClientAuthVeNCrypt{TLSConfig: &tls.Config{ServerName: "localhost"}},
+			[]VeNCryptSubType{VeNCryptX509None},
+			nil, false},
+		{"X509None without TLSConfig",
+			&ClientAuthVeNCrypt{},
+			[]VeNCryptSubType{VeNCryptX509None},
+			nil, false},
+		{"Plain by default",
+			&ClientAuthVeNCrypt{Username: "user", Password: "secret"},
+			[]VeNCryptSubType{VeNCryptPlain},
+			nil, false},
+		{"TLS sub-types by default",
+			&ClientAuthVeNCrypt{Password: "secret"},
+			[]VeNCryptSubType{VeNCryptTLSVnc, VeNCryptTLSNone},
+			nil, false},
+	} {
+		client, server := net.Pipe()
+		result := make(chan []byte, 1)
+		go func() {
+			b, err := veNCryptServer(server, cert, tt.subTypes)
+			if err != nil {
+				b = nil
+			}
+			result <- b
+		}()
+
+		conn := NewClientConn(client, &ClientConfig{})
+		err := tt.auth.Handshake(conn)
+		if err == nil && !tt.ok {
+			t.Errorf("%s: expected error", tt.desc)
+		}
+		if err != nil && tt.ok {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+		}
+		if err == nil {
+			var ok bool
+			switch encrypted, anonymous := tt.subTypes[0].security(); {
+			case anonymous:
+				_, ok = conn.c.(*anonTLSConn)
+			case encrypted:
+				_, ok = conn.c.(*tls.Conn)
+			default:
+				ok = conn.c == client
+			}
+			if !ok {
+				t.Errorf("%s: incorrect transport %T", tt.desc, conn.c)
+			}
+			// The SecurityResult is read over the same transport.
+			if err := conn.securityResultHandshake(); err != nil {
+				t.Errorf("%s: unexpected SecurityResult error; %s", tt.desc, err)
+			}
+		}
+		conn.Close()
+
+		got := <-result
+		if !tt.ok {
+			continue
+		}
+		if want := tt.sent; !bytes.Equal(got, want) {
+			t.Errorf("%s: incorrect data sent; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
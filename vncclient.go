@@ -9,6 +9,7 @@ import (
 	"log"
 	"net"
 	"reflect"
+	"sync"
 
 	"github.com/CambridgeSoftwareLtd/go-vnc/go/metrics"
 	"github.com/CambridgeSoftwareLtd/go-vnc/logging"
@@ -90,6 +91,32 @@ type ClientConfig struct {
 	// This only needs to contain NEW server messages, and doesn't
 	// need to explicitly contain the RFC-required messages.
 	ServerMessages []ServerMessage
+
+	// Quality, CompressLevel, FineQuality and Subsampling are hints to the
+	// server, trading CPU time against bandwidth. Those which are set are
+	// added to the encodings given to SetEncodings, unless already present.
+	Quality       *QualityLevelPseudoEncoding
+	CompressLevel *CompressLevelPseudoEncoding
+	FineQuality   *FineQualityLevelPseudoEncoding
+	Subsampling   *SubsamplingPseudoEncoding
+}
+
+// hints returns the encoding hints which are set.
+func (c *ClientConfig) hints() Encodings {
+	var encs Encodings
+	if c.Quality != nil {
+		encs = append(encs, c.Quality)
+	}
+	if c.CompressLevel != nil {
+		encs = append(encs, c.CompressLevel)
+	}
+	if c.FineQuality != nil {
+		encs = append(encs, c.FineQuality)
+	}
+	if c.Subsampling != nil {
+		encs = append(encs, c.Subsampling)
+	}
+	return encs
 }
 
 // NewClientConfig returns a populated ClientConfig.
@@ -105,6 +132,10 @@ func NewClientConfig(p string) *ClientConfig {
 			&SetColorMapEntries{},
 			&Bell{},
 			&ServerCutText{},
+			&EndOfContinuousUpdates{},
+			&ServerFence{},
+			&QEMUAudio{},
+			&XVP{},
 		},
 	}
 }
@@ -112,6 +143,7 @@ func NewClientConfig(p string) *ClientConfig {
 // The ClientConn type holds client connection information.
 type ClientConn struct {
 	c               net.Conn
+	sendMu          sync.Mutex // Serializes messages sent by several goroutines.
 	config          *ClientConfig
 	protocolVersion string
 
@@ -125,13 +157,15 @@ type ClientConn struct {
 	desktopName string
 
 	// Encodings supported by the client. This should not be modified
-	// directly. Instead, SetEncodings() should be used.
+	// directly. Instead, SetEncodings() should be used. Guarded by stateMu.
 	encodings Encodings
 
-	// Height of the frame buffer in pixels, sent from the server.
+	// Height of the frame buffer in pixels, sent from the server. Guarded by
+	// stateMu.
 	fbHeight uint16
 
-	// Width of the frame buffer in pixels, sent from the server.
+	// Width of the frame buffer in pixels, sent from the server. Guarded by
+	// stateMu.
 	fbWidth uint16
 
 	// The pixel format associated with the connection. This shouldn't
@@ -142,11 +176,73 @@ type ClientConn struct {
 	// Track metrics on system performance.
 	metrics map[string]metrics.Metric
 
-	// Global zlib reader
+	// The zlib stream of the ZRLE encoding.
 	zlibStream zrle.ZlibStream
+
+	// The zlib stream of the Zlib encoding.
+	zlibEncodingStream zrle.ZlibStream
+
+	// The zlib streams of the ZlibHex encoding.
+	zlibHexStreams [zlibHexNumStreams]zrle.ZlibStream
+
+	// The zlib streams of the Tight encoding.
+	tightStreams [tightNumStreams]zrle.ZlibStream
+
+	// Client-side copy of the remote framebuffer.
+	fb *Framebuffer
+
+	// Serializes SetDesktopSize requests, whose results are delivered by
+	// the server message handler.
+	desktopSizeReqMu sync.Mutex
+
+	// Guards the number of SetDesktopSize requests yet to be answered, and
+	// the channel of the request waiting for its result, if any.
+	desktopSizeMu      sync.Mutex
+	desktopSizePending int
+	desktopSizeResult  chan error
+
+	// Closed when the server message handler stops.
+	done chan struct{}
+
+	// Guards the state below, which is set by the server message handler and
+	// read by the goroutines sending messages, and the encodings and
+	// framebuffer size.
+	stateMu sync.Mutex
+
+	// Screen layout of the desktop, sent from the server.
+	screens []Screen
+
+	// Whether the server supports continuous updates and fences.
+	continuousUpdates bool
+	fence             bool
+
+	// Whether the server accepts QEMU Extended Key Events.
+	qemuExtendedKeyEvent bool
+
+	// Whether the server supports QEMU audio.
+	qemuAudio bool
+
+	// Whether the server supports xvp, and the last xvp operation requested.
+	xvpSupported bool
+	xvpOp        XVPCode
+
+	// The extended clipboard capabilities of the server, or nil if it does
+	// not support the extended clipboard, and the client clipboard offered.
+	clipboardCaps *ClipboardCapabilities
+	clipboard     Clipboard
+
+	// The fence requests waiting for their reply, by payload, and the number
+	// of fences sent, which makes their payloads unique.
+	fenceReplies map[string]chan struct{}
+	fenceSeq     uint64
+
+	// The capabilities sent by a server using Tight security.
+	tightCaps *TightCapabilities
 }
 
-func (c ClientConn) SetFrameBuffer(width uint16, height uint16) (err error) {
+func (c *ClientConn) SetFrameBuffer(width uint16, height uint16) (err error) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
 	c.fbWidth = width
 	c.fbHeight = height
 	return
@@ -158,6 +254,8 @@ func NewClientConn(c net.Conn, cfg *ClientConfig) *ClientConn {
 		config:      cfg,
 		encodings:   Encodings{&RawEncoding{}},
 		pixelFormat: PixelFormat32bit,
+		fb:          NewFramebuffer(0, 0),
+		done:        make(chan struct{}),
 		metrics: map[string]metrics.Metric{
 			"bytes-received": &metrics.Gauge{},
 			"bytes-sent":     &metrics.Gauge{},
@@ -171,10 +269,45 @@ func (c *ClientConn) Close() error {
 	return c.c.Close()
 }
 
+// Conn returns the connection to the server.
+func (c *ClientConn) Conn() net.Conn {
+	return c.c
+}
+
+// SetConn replaces the connection to the server, after which all messages
+// are sent and received over conn. It allows a ClientAuth to layer TLS or
+// another cipher over the existing connection during the security
+// handshake, and must not be called once the server message handler runs.
+func (c *ClientConn) SetConn(conn net.Conn) {
+	c.c = conn
+}
+
+// ZlibStream returns a copy of the zlib stream of the ZRLE encoding.
+//
+// Deprecated: Use ZRLEStream, which returns the stream itself.
 func (c *ClientConn) ZlibStream() zrle.ZlibStream {
 	return c.zlibStream
 }
 
+// ZRLEStream returns the zlib stream of the ZRLE encoding.
+func (c *ClientConn) ZRLEStream() *zrle.ZlibStream {
+	return &c.zlibStream
+}
+
+// resetZlibStreams starts new zlib streams for every zlib based encoding, as
+// the server does when a connection is set up. Tight streams are otherwise
+// only reset when the server asks for it.
+func (c *ClientConn) resetZlibStreams() {
+	c.zlibStream.Reset()
+	c.zlibEncodingStream.Reset()
+	for i := range c.zlibHexStreams {
+		c.zlibHexStreams[i].Reset()
+	}
+	for i := range c.tightStreams {
+		c.tightStreams[i].Reset()
+	}
+}
+
 // DesktopName returns the server provided desktop name.
 func (c *ClientConn) DesktopName() string {
 	return c.desktopName
@@ -190,11 +323,27 @@ func (c *ClientConn) setDesktopName(name string) {
 
 // Encodings returns the server provided encodings.
 func (c *ClientConn) Encodings() Encodings {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
 	return c.encodings
 }
 
+// Framebuffer returns the client-side copy of the remote framebuffer, which
+// is kept up to date as FramebufferUpdate messages are received.
+func (c *ClientConn) Framebuffer() *Framebuffer {
+	return c.fb
+}
+
+// Cursor returns the current cursor shape set by the server, or nil if there
+// is none.
+func (c *ClientConn) Cursor() *Cursor {
+	return c.fb.Cursor()
+}
+
 // FramebufferHeight returns the server provided framebuffer height.
 func (c *ClientConn) FramebufferHeight() uint16 {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
 	return c.fbHeight
 }
 
@@ -203,11 +352,15 @@ func (c *ClientConn) setFramebufferHeight(height uint16) {
 	if logging.V(logging.ResultLevel) {
 		glog.Infof("height: %d", height)
 	}
+	c.stateMu.Lock()
 	c.fbHeight = height
+	c.stateMu.Unlock()
 }
 
 // FramebufferWidth returns the server provided framebuffer width.
 func (c *ClientConn) FramebufferWidth() uint16 {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
 	return c.fbWidth
 }
 
@@ -216,7 +369,9 @@ func (c *ClientConn) setFramebufferWidth(width uint16) {
 	if logging.V(logging.ResultLevel) {
 		glog.Infof("width: %d", width)
 	}
+	c.stateMu.Lock()
 	c.fbWidth = width
+	c.stateMu.Unlock()
 }
 
 // ListenAndHandle listens to a VNC server and handles server messages.
@@ -225,6 +380,7 @@ func (c *ClientConn) ListenAndHandle() error {
 		glog.Info(logging.FnName())
 	}
 	defer c.Close()
+	defer close(c.done)
 
 	if c.config.ServerMessages == nil {
 		return NewVNCError("Client config error: ServerMessages undefined")
@@ -277,6 +433,19 @@ func (c *ClientConn) receive(data interface{}) error {
 	return nil
 }
 
+// connReader adapts a ClientConn into an io.Reader, for decoders that consume
+// a stream of bytes directly from the network.
+type connReader struct {
+	c *ClientConn
+}
+
+// Read implements the io.Reader interface.
+func (r connReader) Read(p []byte) (int, error) {
+	n, err := r.c.c.Read(p)
+	r.c.metrics["bytes-received"].Adjust(int64(n))
+	return n, err
+}
+
 // receiveN receives N packets from the network.
 func (c *ClientConn) receiveN(data interface{}, n int) error {
 	if logging.V(logging.FnDeclLevel) {
@@ -321,11 +490,14 @@ func (c *ClientConn) receiveN(data interface{}, n int) error {
 	return nil
 }
 
-// send a packet to the network.
+// send a packet to the network. Each message must be sent by a single call,
+// as messages may be sent concurrently, e.g. by the server message handler.
 func (c *ClientConn) send(data interface{}) error {
 	if logging.V(logging.SpamLevel) {
 		glog.Infof("ClientConn.%s", logging.FnNameWithArgs("%v", data))
 	}
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
 	if err := binary.Write(c.c, binary.BigEndian, data); err != nil {
 		return err
 	}
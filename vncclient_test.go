@@ -82,6 +82,26 @@ func TestClientConn(t *testing.T) {
 	}
 }
 
+func TestClientConn_SetConn(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+
+	layered := &MockConn{}
+	conn.SetConn(layered)
+	if got, want := conn.Conn(), net.Conn(layered); got != want {
+		t.Errorf("incorrect Conn(); got = %v, want = %v", got, want)
+	}
+	if err := conn.send(uint8(42)); err != nil {
+		t.Fatalf("unexpected error; %s", err)
+	}
+	if got := mockConn.b.Len(); got != 0 {
+		t.Errorf("unexpected %d bytes sent over the replaced connection", got)
+	}
+	if got, want := layered.b.Bytes(), []byte{42}; !bytes.Equal(got, want) {
+		t.Errorf("incorrect bytes sent; got = %v, want = %v", got, want)
+	}
+}
+
 func TestReceiveN(t *testing.T) {
 	tests := []struct {
 		data interface{}
@@ -0,0 +1,125 @@
+// Writing of audio streams as WAV files.
+
+package vnc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// wavHeaderLen is the length of the header of a PCM WAV file.
+const wavHeaderLen = 44
+
+// wavHeader holds the header of a PCM WAV file.
+type wavHeader struct {
+	RIFF          [4]byte // "RIFF"
+	RIFFSize      uint32  // Size of the file, less 8 bytes.
+	WAVE          [4]byte // "WAVE"
+	Fmt           [4]byte // "fmt "
+	FmtSize       uint32  // Size of the fmt chunk.
+	AudioFormat   uint16  // 1 for PCM.
+	Channels      uint16
+	SampleRate    uint32
+	ByteRate      uint32
+	BlockAlign    uint16
+	BitsPerSample uint16
+	Data          [4]byte // "data"
+	DataSize      uint32  // Size of the samples.
+}
+
+// WAVWriter writes an audio stream, such as that of QEMU audio, as a PCM WAV
+// file. WAV samples of 8 bits are unsigned and larger samples are signed, so
+// samples of other formats have their sign converted. Samples are expected in
+// little-endian byte order.
+type WAVWriter struct {
+	w      io.WriteSeeker
+	format AudioFormat
+	n      int64 // Bytes of samples written.
+}
+
+// NewWAVWriter writes the header of a WAV file to w, returning a WAVWriter
+// for the samples of the stream. The header is completed by Close.
+func NewWAVWriter(w io.WriteSeeker, f AudioFormat) (*WAVWriter, error) {
+	size := f.SampleFormat.Size()
+	if size == 0 {
+		return nil, fmt.Errorf("invalid audio sample-format %d", f.SampleFormat)
+	}
+	if f.Channels == 0 {
+		return nil, fmt.Errorf("invalid number of audio channels 0")
+	}
+
+	ww := &WAVWriter{w: w, format: f}
+	if err := ww.writeHeader(); err != nil {
+		return nil, err
+	}
+	return ww, nil
+}
+
+// Write implements the io.Writer interface, writing samples to the file.
+func (ww *WAVWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > math.MaxUint32-wavHeaderLen-ww.n {
+		return 0, fmt.Errorf("WAV file too long")
+	}
+
+	size := ww.format.SampleFormat.Size()
+	// Only WAV samples larger than 8 bits are signed. The sign is converted
+	// by flipping the most significant bit of each sample, in its last byte.
+	convert := ww.format.SampleFormat.Signed() != (size > 1)
+	buf := p
+	if convert {
+		buf = make([]byte, len(p))
+		copy(buf, p)
+		for i := range buf {
+			if (ww.n+int64(i))%int64(size) == int64(size-1) {
+				buf[i] ^= 0x80
+			}
+		}
+	}
+
+	n, err := ww.w.Write(buf)
+	ww.n += int64(n)
+	return n, err
+}
+
+// Close completes the header of the file with the length of the stream. It
+// does not close the underlying writer.
+func (ww *WAVWriter) Close() error {
+	if ww.n%2 != 0 {
+		// RIFF chunks are padded to an even length.
+		if _, err := ww.w.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+	if _, err := ww.w.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := ww.writeHeader(); err != nil {
+		return err
+	}
+	_, err := ww.w.Seek(0, io.SeekEnd)
+	return err
+}
+
+// writeHeader writes the header for the samples written so far.
+func (ww *WAVWriter) writeHeader() error {
+	size := ww.format.SampleFormat.Size()
+	channels := int(ww.format.Channels)
+	h := wavHeader{
+		RIFF:          [4]byte{'R', 'I', 'F', 'F'},
+		RIFFSize:      uint32(wavHeaderLen - 8 + ww.n + ww.n%2),
+		WAVE:          [4]byte{'W', 'A', 'V', 'E'},
+		Fmt:           [4]byte{'f', 'm', 't', ' '},
+		FmtSize:       16,
+		AudioFormat:   1,
+		Channels:      uint16(channels),
+		SampleRate:    ww.format.Frequency,
+		ByteRate:      ww.format.Frequency * uint32(channels*size),
+		BlockAlign:    uint16(channels * size),
+		BitsPerSample: uint16(8 * size),
+		Data:          [4]byte{'d', 'a', 't', 'a'},
+		DataSize:      uint32(ww.n),
+	}
+	return binary.Write(ww.w, binary.LittleEndian, &h)
+}
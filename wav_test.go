@@ -0,0 +1,127 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// seekBuffer is an in-memory io.WriteSeeker.
+type seekBuffer struct {
+	b   []byte
+	pos int
+}
+
+func (s *seekBuffer) Write(p []byte) (int, error) {
+	if n := s.pos + len(p); n > len(s.b) {
+		s.b = append(s.b, make([]byte, n-len(s.b))...)
+	}
+	copy(s.b[s.pos:], p)
+	s.pos += len(p)
+	return len(p), nil
+}
+
+func (s *seekBuffer) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		s.pos = int(offset)
+	case io.SeekCurrent:
+		s.pos += int(offset)
+	case io.SeekEnd:
+		s.pos = len(s.b) + int(offset)
+	}
+	return int64(s.pos), nil
+}
+
+func TestWAVWriter(t *testing.T) {
+	for _, tt := range []struct {
+		desc    string
+		format  AudioFormat
+		writes  [][]byte
+		samples []byte // Samples as written to the file, with padding.
+		ok      bool
+	}{
+		{"signed 16-bit",
+			AudioFormat{AudioS16, 2, 44100},
+			[][]byte{{0x01, 0x80, 0xff, 0x7f}},
+			[]byte{0x01, 0x80, 0xff, 0x7f},
+			true},
+		{"unsigned 16-bit split across writes",
+			AudioFormat{AudioU16, 1, 8000},
+			[][]byte{{0x00, 0x80, 0x34}, {0x12}},
+			[]byte{0x00, 0x00, 0x34, 0x92},
+			true},
+		{"signed 8-bit padded",
+			AudioFormat{AudioS8, 1, 8000},
+			[][]byte{{0x00, 0x7f, 0x80}},
+			[]byte{0x80, 0xff, 0x00, 0x00},
+			true},
+		{"unsigned 32-bit",
+			AudioFormat{AudioU32, 1, 48000},
+			[][]byte{{0x01, 0x02, 0x03, 0x84}},
+			[]byte{0x01, 0x02, 0x03, 0x04},
+			true},
+		{"invalid sample-format",
+			AudioFormat{6, 1, 8000},
+			nil,
+			nil,
+			false},
+		{"no channels",
+			AudioFormat{AudioU8, 0, 8000},
+			nil,
+			nil,
+			false},
+	} {
+		var buf seekBuffer
+		ww, err := NewWAVWriter(&buf, tt.format)
+		if err == nil && !tt.ok {
+			t.Errorf("%s: expected error", tt.desc)
+			continue
+		}
+		if err != nil && tt.ok {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		var n int
+		for _, p := range tt.writes {
+			if _, err := ww.Write(p); err != nil {
+				t.Fatalf("%s: unexpected error; %s", tt.desc, err)
+			}
+			n += len(p)
+		}
+		if err := ww.Close(); err != nil {
+			t.Fatalf("%s: unexpected error; %s", tt.desc, err)
+		}
+
+		var h wavHeader
+		if err := binary.Read(bytes.NewReader(buf.b), binary.LittleEndian, &h); err != nil {
+			t.Fatalf("%s: unable to read header; %s", tt.desc, err)
+		}
+		size := tt.format.SampleFormat.Size()
+		want := wavHeader{
+			RIFF:          [4]byte{'R', 'I', 'F', 'F'},
+			RIFFSize:      uint32(wavHeaderLen - 8 + len(tt.samples)),
+			WAVE:          [4]byte{'W', 'A', 'V', 'E'},
+			Fmt:           [4]byte{'f', 'm', 't', ' '},
+			FmtSize:       16,
+			AudioFormat:   1,
+			Channels:      uint16(tt.format.Channels),
+			SampleRate:    tt.format.Frequency,
+			ByteRate:      tt.format.Frequency * uint32(int(tt.format.Channels)*size),
+			BlockAlign:    uint16(int(tt.format.Channels) * size),
+			BitsPerSample: uint16(8 * size),
+			Data:          [4]byte{'d', 'a', 't', 'a'},
+			DataSize:      uint32(n),
+		}
+		if h != want {
+			t.Errorf("%s: incorrect header; got = %+v, want = %+v", tt.desc, h, want)
+		}
+		if got, want := buf.b[wavHeaderLen:], tt.samples; !bytes.Equal(got, want) {
+			t.Errorf("%s: incorrect samples; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+/*
+Implementation of the xvp extension, which allows the client to power-cycle
+the virtual machine behind the server.
+https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#xvp-client-message
+*/
+package vnc
+
+import (
+	"fmt"
+
+	"github.com/CambridgeSoftwareLtd/go-vnc/encodings"
+	"github.com/CambridgeSoftwareLtd/go-vnc/logging"
+	"github.com/CambridgeSoftwareLtd/go-vnc/messages"
+	"github.com/golang/glog"
+)
+
+// xvpVersion is the supported version of the xvp extension.
+const xvpVersion = 1
+
+// XVPCode is the xvp-message-code of an xvp message.
+type XVPCode uint8
+
+// xvp message codes.
+const (
+	XVPFail     XVPCode = iota // Sent by the server when an operation fails.
+	XVPInit                    // Sent by the server to indicate support.
+	XVPShutdown                // Requests a clean shutdown.
+	XVPReboot                  // Requests a clean reboot.
+	XVPReset                   // Requests a reset.
+)
+
+// String implements the fmt.Stringer interface.
+func (c XVPCode) String() string {
+	switch c {
+	case XVPFail:
+		return "fail"
+	case XVPInit:
+		return "init"
+	case XVPShutdown:
+		return "shutdown"
+	case XVPReboot:
+		return "reboot"
+	case XVPReset:
+		return "reset"
+	}
+	return fmt.Sprintf("XVPCode(%d)", uint8(c))
+}
+
+// XVPUnsupportedError is returned when an xvp operation is requested of a
+// server which has not indicated support for xvp.
+type XVPUnsupportedError struct {
+	Op XVPCode
+}
+
+// Error implements the error interface.
+func (e *XVPUnsupportedError) Error() string {
+	return fmt.Sprintf("unable to %s; server does not support xvp", e.Op)
+}
+
+// XVPError reports the failure of an xvp operation by the server.
+type XVPError struct {
+	Op XVPCode // The last operation requested.
+}
+
+// Error implements the error interface.
+func (e *XVPError) Error() string {
+	return fmt.Sprintf("xvp %s failed", e.Op)
+}
+
+//-----------------------------------------------------------------------------
+// xvp Pseudo-Encoding
+//
+// A client requesting the xvp pseudo-encoding indicates that it supports the
+// xvp extension, and the server answers with an XVPInit message if it
+// supports it too.
+
+// XVPPseudoEncoding is sent by the client to indicate support for xvp.
+type XVPPseudoEncoding struct{}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*XVPPseudoEncoding)(nil)
+
+// Marshal implements the Marshaler interface.
+func (*XVPPseudoEncoding) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Read implements the Encoding interface.
+func (e *XVPPseudoEncoding) Read(*ClientConn, *Rectangle) (Encoding, error) {
+	return nil, clientOnlyEncodingError(e)
+}
+
+// String implements the fmt.Stringer interface.
+func (*XVPPseudoEncoding) String() string { return "XVPPseudoEncoding" }
+
+// Type implements the Encoding interface.
+func (*XVPPseudoEncoding) Type() encodings.Encoding { return encodings.XVPPseudo }
+
+//-----------------------------------------------------------------------------
+// xvp Client Message
+
+// XVPMessage holds the wire format message.
+type XVPMessage struct {
+	Msg     messages.ClientMessage // message-type
+	_       [1]byte                // padding
+	Version uint8                  // xvp-extension-version
+	Code    XVPCode                // xvp-message-code
+}
+
+// XVPShutdown requests a clean shutdown of the system. Failure is reported
+// asynchronously by an XVP server message.
+func (c *ClientConn) XVPShutdown() error {
+	return c.xvp(XVPShutdown)
+}
+
+// XVPReboot requests a clean reboot of the system. Failure is reported
+// asynchronously by an XVP server message.
+func (c *ClientConn) XVPReboot() error {
+	return c.xvp(XVPReboot)
+}
+
+// XVPReset requests a reset of the system. Failure is reported
+// asynchronously by an XVP server message.
+func (c *ClientConn) XVPReset() error {
+	return c.xvp(XVPReset)
+}
+
+// XVPSupported reports whether the server supports xvp.
+func (c *ClientConn) XVPSupported() bool {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.xvpSupported
+}
+
+// xvp sends an xvp operation to the server.
+func (c *ClientConn) xvp(op XVPCode) error {
+	if logging.V(logging.FnDeclLevel) {
+		glog.Infof("ClientConn.%s", logging.FnNameWithArgs("%s", op))
+	}
+
+	c.stateMu.Lock()
+	supported := c.xvpSupported
+	if supported {
+		// Recorded before sending, as the server may fail it at once.
+		c.xvpOp = op
+	}
+	c.stateMu.Unlock()
+	if !supported {
+		return &XVPUnsupportedError{op}
+	}
+	msg := XVPMessage{Msg: messages.ClientXVP, Version: xvpVersion, Code: op}
+	return c.send(msg)
+}
+
+//-----------------------------------------------------------------------------
+// xvp Server Message
+
+// XVP represents an xvp server message, sans message-type and padding.
+type XVP struct {
+	Version uint8
+	Code    XVPCode
+	// For XVPFail, the last operation requested by the client.
+	Op XVPCode
+}
+
+// Verify that interfaces are honored.
+var _ ServerMessage = (*XVP)(nil)
+
+// Err returns an *XVPError if the message reports a failed operation.
+func (m *XVP) Err() error {
+	if m.Code == XVPFail {
+		return &XVPError{m.Op}
+	}
+	return nil
+}
+
+// Type implements the ServerMessage interface.
+func (*XVP) Type() messages.ServerMessage { return messages.ServerXVP }
+
+// Read implements the ServerMessage interface.
+func (*XVP) Read(c *ClientConn) (ServerMessage, error) {
+	if logging.V(logging.FnDeclLevel) {
+		glog.Info("XVP." + logging.FnName())
+	}
+
+	var msg struct {
+		_       [1]byte // padding
+		Version uint8   // xvp-extension-version
+		Code    XVPCode // xvp-message-code
+	}
+	if err := c.receive(&msg); err != nil {
+		return nil, err
+	}
+
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	switch msg.Code {
+	case XVPInit:
+		c.xvpSupported = true
+	case XVPFail:
+	default:
+		return nil, fmt.Errorf("unsupported xvp-message-code %d", msg.Code)
+	}
+	return &XVP{msg.Version, msg.Code, c.xvpOp}, nil
+}
@@ -0,0 +1,95 @@
+package vnc
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestXVP(t *testing.T) {
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+
+	err := conn.XVPReboot()
+	if _, ok := err.(*XVPUnsupportedError); !ok {
+		t.Errorf("incorrect error before the server indicated support; got = %v", err)
+	}
+	if got := mockConn.b.Len(); got != 0 {
+		t.Errorf("unexpected message of %d bytes", got)
+	}
+
+	// The server indicates support with an XVPInit message.
+	if err := conn.send([]byte{0, 1, 1}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := (&XVP{}).Read(conn)
+	if err != nil {
+		t.Fatalf("unexpected error; %s", err)
+	}
+	if err := msg.(*XVP).Err(); err != nil {
+		t.Errorf("unexpected error; %s", err)
+	}
+	if !conn.XVPSupported() {
+		t.Fatalf("xvp not supported")
+	}
+
+	for _, tt := range []struct {
+		desc string
+		fn   func() error
+		data []byte
+	}{
+		{"shutdown", conn.XVPShutdown, []byte{250, 0, 1, 2}},
+		{"reboot", conn.XVPReboot, []byte{250, 0, 1, 3}},
+		{"reset", conn.XVPReset, []byte{250, 0, 1, 4}},
+	} {
+		mockConn.Reset()
+		if err := tt.fn(); err != nil {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+		if got, want := mockConn.b.Bytes(), tt.data; !bytes.Equal(got, want) {
+			t.Errorf("%s: incorrect message; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
+
+func TestXVP_Read(t *testing.T) {
+	for _, tt := range []struct {
+		desc string
+		data []byte
+		msg  *XVP
+		err  error
+		ok   bool
+	}{
+		{"init", []byte{0, 1, 1}, &XVP{1, XVPInit, XVPReset}, nil, true},
+		{"fail", []byte{0, 1, 0}, &XVP{1, XVPFail, XVPReset}, &XVPError{XVPReset}, true},
+		{"unknown code", []byte{0, 1, 5}, nil, nil, false},
+		{"short message", []byte{0, 1}, nil, nil, false},
+	} {
+		mockConn := &MockConn{}
+		conn := NewClientConn(mockConn, &ClientConfig{})
+		conn.xvpOp = XVPReset
+		if err := conn.send(tt.data); err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := (&XVP{}).Read(conn)
+		if err == nil && !tt.ok {
+			t.Errorf("%s: expected error", tt.desc)
+			continue
+		}
+		if err != nil && tt.ok {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if got, want := msg, tt.msg; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: incorrect message; got = %v, want = %v", tt.desc, got, want)
+		}
+		if got, want := msg.(*XVP).Err(), tt.err; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: incorrect error; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+/*
+Implementation of the Zlib and ZlibHex encodings.
+https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#zlib-encoding
+*/
+package vnc
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/CambridgeSoftwareLtd/go-vnc/encodings"
+	"github.com/CambridgeSoftwareLtd/go-vnc/zrle"
+)
+
+//-----------------------------------------------------------------------------
+// Zlib Encoding
+//
+// Zlib encoding sends Raw pixel data compressed with a zlib stream which
+// persists for the life of the connection.
+
+// ZlibEncoding represents a Zlib encoded update.
+type ZlibEncoding struct {
+	Colors []Color
+}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*ZlibEncoding)(nil)
+
+// Marshal implements the Marshaler interface.
+func (*ZlibEncoding) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Read implements the Encoding interface.
+func (*ZlibEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	var length uint32
+	if err := c.receive(&length); err != nil {
+		return nil, fmt.Errorf("unable to read Zlib length: %s", err)
+	}
+	zs := &c.zlibEncodingStream
+	if err := c.feedZlibStream(zs, int(length)); err != nil {
+		return nil, fmt.Errorf("unable to read Zlib data: %s", err)
+	}
+
+	colors := make([]Color, rect.Area())
+	for i := range colors {
+		color, err := c.readColor(zs)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decompress Zlib pixels: %s", err)
+		}
+		colors[i] = *color
+	}
+	if err := zs.Finish(); err != nil {
+		return nil, fmt.Errorf("unable to decompress Zlib pixels: %s", err)
+	}
+
+	return &ZlibEncoding{colors}, nil
+}
+
+// String implements the fmt.Stringer interface.
+func (*ZlibEncoding) String() string { return "ZlibEncoding" }
+
+// Type implements the Encoding interface.
+func (*ZlibEncoding) Type() encodings.Encoding { return encodings.Zlib }
+
+// feedZlibStream writes the next length bytes of compressed data from the
+// connection to a zlib stream.
+func (c *ClientConn) feedZlibStream(zs *zrle.ZlibStream, length int) error {
+	var buf bytes.Buffer
+	if err := c.receiveN(&buf, length); err != nil {
+		return err
+	}
+	_, err := zs.Write(buf.Bytes())
+	return err
+}
+
+//-----------------------------------------------------------------------------
+// ZlibHex Encoding
+//
+// ZlibHex encoding is Hextile encoding where the data of a tile may instead be
+// compressed, using one zlib stream for raw tiles and another for the
+// remainder.
+
+// ZlibHexEncoding represents a ZlibHex encoded update.
+type ZlibHexEncoding struct {
+	Colors []Color
+}
+
+// Verify that interfaces are honored.
+var _ Encoding = (*ZlibHexEncoding)(nil)
+
+// ZlibHex subencoding-mask bits, in addition to those of Hextile.
+const (
+	zlibHexRaw      uint8 = 1 << 5
+	zlibHexSubrects uint8 = 1 << 6
+)
+
+// The zlib streams of the ZlibHex encoding.
+const (
+	zlibHexRawStream = iota
+	zlibHexSubrectsStream
+	zlibHexNumStreams
+)
+
+// Marshal implements the Marshaler interface.
+func (*ZlibHexEncoding) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Read implements the Encoding interface.
+func (*ZlibHexEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	colors, err := c.readHextile(rect, true)
+	if err != nil {
+		return nil, err
+	}
+	return &ZlibHexEncoding{colors}, nil
+}
+
+// String implements the fmt.Stringer interface.
+func (*ZlibHexEncoding) String() string { return "ZlibHexEncoding" }
+
+// Type implements the Encoding interface.
+func (*ZlibHexEncoding) Type() encodings.Encoding { return encodings.ZlibHex }
+
+// readZlibHexTile reads the compressed data of a tile, returning the zlib
+// stream to decompress it with.
+func (c *ClientConn) readZlibHexTile(mask uint8) (*zrle.ZlibStream, error) {
+	zs := &c.zlibHexStreams[zlibHexSubrectsStream]
+	if mask&zlibHexRaw != 0 {
+		zs = &c.zlibHexStreams[zlibHexRawStream]
+	}
+
+	var length uint16
+	if err := c.receive(&length); err != nil {
+		return nil, fmt.Errorf("unable to read ZlibHex length: %s", err)
+	}
+	if err := c.feedZlibStream(zs, int(length)); err != nil {
+		return nil, fmt.Errorf("unable to read ZlibHex data: %s", err)
+	}
+	return zs, nil
+}
@@ -0,0 +1,160 @@
+package vnc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"testing"
+
+	"github.com/kward/go-vnc/encodings"
+	"github.com/kward/go-vnc/go/operators"
+)
+
+// zlibWriter compresses data for a persistent zlib stream, flushing it after
+// each write as a server does.
+type zlibWriter struct {
+	t   *testing.T
+	buf bytes.Buffer
+	zw  *zlib.Writer
+}
+
+func newZlibWriter(t *testing.T) *zlibWriter {
+	w := &zlibWriter{t: t}
+	w.zw = zlib.NewWriter(&w.buf)
+	return w
+}
+
+func (w *zlibWriter) compress(data []byte) []byte {
+	w.buf.Reset()
+	if _, err := w.zw.Write(data); err != nil {
+		w.t.Fatal(err)
+	}
+	if err := w.zw.Flush(); err != nil {
+		w.t.Fatal(err)
+	}
+	return append([]byte(nil), w.buf.Bytes()...)
+}
+
+func TestZlibEncoding_Type(t *testing.T) {
+	if got, want := (&ZlibEncoding{}).Type(), encodings.Zlib; got != want {
+		t.Errorf("incorrect encoding; got = %s, want = %s", got, want)
+	}
+	if got, want := (&ZlibHexEncoding{}).Type(), encodings.ZlibHex; got != want {
+		t.Errorf("incorrect encoding; got = %s, want = %s", got, want)
+	}
+}
+
+func TestZlibEncoding_Read(t *testing.T) {
+	zw := newZlibWriter(t)
+	withLength := func(data []byte) []byte {
+		b := make([]byte, 4, 4+len(data))
+		binary.BigEndian.PutUint32(b, uint32(len(data)))
+		return append(b, data...)
+	}
+
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+	conn.pixelFormat = pixelFormat8bitTrueColor
+
+	for _, tt := range []struct {
+		desc   string
+		w, h   uint16
+		data   []byte
+		pixels []byte
+		ok     bool
+	}{
+		{"first rectangle",
+			2, 2,
+			withLength(zw.compress([]byte{1, 2, 3, 4})),
+			[]byte{1, 2, 3, 4},
+			true},
+		{"stream continues",
+			3, 1,
+			withLength(zw.compress([]byte{1, 2, 3})),
+			[]byte{1, 2, 3},
+			true},
+		{"too much data",
+			1, 1,
+			withLength(zw.compress([]byte{5, 6})),
+			nil,
+			false},
+	} {
+		mockConn.Reset()
+		if err := conn.send(tt.data); err != nil {
+			t.Fatal(err)
+		}
+		enc, err := (&ZlibEncoding{}).Read(conn, &Rectangle{Width: tt.w, Height: tt.h})
+		if err == nil && !tt.ok {
+			t.Errorf("%s: expected error", tt.desc)
+			continue
+		}
+		if err != nil && tt.ok {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		pixels, err := colorsToPixels(enc.(*ZlibEncoding).Colors)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := pixels, tt.pixels; !operators.EqualSlicesOfByte(got, want) {
+			t.Errorf("%s: incorrect pixels; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
+
+func TestZlibHexEncoding_Read(t *testing.T) {
+	raw, subrects := newZlibWriter(t), newZlibWriter(t)
+	compressed := func(mask uint8, data []byte) []byte {
+		b := []byte{mask, byte(len(data) >> 8), byte(len(data))}
+		return append(b, data...)
+	}
+
+	mockConn := &MockConn{}
+	conn := NewClientConn(mockConn, &ClientConfig{})
+	conn.pixelFormat = pixelFormat8bitTrueColor
+
+	for _, tt := range []struct {
+		desc   string
+		w, h   uint16
+		data   []byte
+		pixels []byte
+	}{
+		{"compressed raw and subrectangle tiles",
+			20, 1,
+			append(
+				compressed(zlibHexRaw, raw.compress([]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15})),
+				compressed(zlibHexSubrects|hextileBackgroundSpecified|hextileForegroundSpecified|hextileAnySubrects,
+					subrects.compress([]byte{5, 6, 1, 0x10, 0x10}))...),
+			[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 5, 6, 6, 5}},
+		{"uncompressed tiles",
+			18, 1,
+			[]byte{hextileBackgroundSpecified, 4, 0},
+			[]byte{4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4}},
+		{"streams continue",
+			18, 1,
+			append(
+				compressed(zlibHexRaw, raw.compress([]byte{15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0})),
+				compressed(zlibHexSubrects|hextileBackgroundSpecified, subrects.compress([]byte{3}))...),
+			[]byte{15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0, 3, 3}},
+	} {
+		mockConn.Reset()
+		if err := conn.send(tt.data); err != nil {
+			t.Fatal(err)
+		}
+		enc, err := (&ZlibHexEncoding{}).Read(conn, &Rectangle{Width: tt.w, Height: tt.h})
+		if err != nil {
+			t.Errorf("%s: unexpected error; %s", tt.desc, err)
+			continue
+		}
+		pixels, err := colorsToPixels(enc.(*ZlibHexEncoding).Colors)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := pixels, tt.pixels; !operators.EqualSlicesOfByte(got, want) {
+			t.Errorf("%s: incorrect pixels; got = %v, want = %v", tt.desc, got, want)
+		}
+	}
+}
@@ -2,34 +2,202 @@ package zrle
 
 import (
 	"bytes"
-	"compress/zlib"
+	"compress/flate"
+	"errors"
+	"fmt"
 	"io"
-	"log"
 )
 
+var (
+	// ErrShortCompressedData is returned when decoding a rectangle needs more
+	// compressed data than the rectangle contained.
+	ErrShortCompressedData = errors.New("zlib stream: rectangle needs more compressed data than was sent")
+	// ErrExcessCompressedData is returned when a rectangle contained more
+	// compressed data than was needed to decode it.
+	ErrExcessCompressedData = errors.New("zlib stream: rectangle contains more compressed data than was used")
+
+	// errNoInput is returned by the source when all the compressed data of a
+	// rectangle has been consumed.
+	errNoInput = errors.New("zlib stream: no more input")
+)
+
+// windowSize is the size of the deflate sliding window.
+const windowSize = 32 * 1024
+
+// ZlibStream is a zlib stream which persists across rectangles, as used by
+// the ZRLE, Zlib and Tight encodings. The compressed data of each rectangle
+// is written to the stream in full, decompressed with Read, and the
+// rectangle ended with Finish.
+//
+// The server flushes the stream at the end of each rectangle, so the stream
+// is resumed at a deflate block boundary from the previous output, rather
+// than relying upon the decompressor never running out of input.
+//
+// After an error the stream is out of sync with the server, and every Read
+// returns the error until the stream is Reset.
 type ZlibStream struct {
-	zlibReader io.ReadCloser
-	buffer     *bytes.Buffer
+	src     zlibSource
+	fr      io.ReadCloser
+	header  bool   // Whether the zlib header has been read.
+	resume  bool   // Whether fr must be resumed before the next Read.
+	history []byte // Recent decompressed data, for resuming the window.
+	err     error
+}
+
+// zlibSource holds the compressed data of the current rectangle. It
+// implements io.ByteReader, so that the decompressor does not read ahead.
+type zlibSource struct {
+	buf bytes.Buffer
+}
+
+func (s *zlibSource) Read(p []byte) (int, error) {
+	if s.buf.Len() == 0 {
+		return 0, errNoInput
+	}
+	return s.buf.Read(p)
+}
+
+func (s *zlibSource) ReadByte() (byte, error) {
+	if s.buf.Len() == 0 {
+		return 0, errNoInput
+	}
+	return s.buf.ReadByte()
+}
+
+// Write adds compressed data for the current rectangle.
+func (z *ZlibStream) Write(p []byte) (int, error) {
+	return z.src.buf.Write(p)
+}
+
+// Read decompresses data of the current rectangle.
+func (z *ZlibStream) Read(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	if err := z.start(); err != nil {
+		return 0, z.fail(err)
+	}
+
+	n, err := z.fr.Read(p)
+	z.remember(p[:n])
+	switch err {
+	case nil:
+	case errNoInput:
+		return n, z.fail(ErrShortCompressedData)
+	case io.EOF:
+		// The server ended the stream, which it must only do when closing it.
+		return n, z.fail(fmt.Errorf("zlib stream: unexpected end of stream"))
+	default:
+		return n, z.fail(err)
+	}
+	return n, nil
 }
 
-func (z *ZlibStream) Read(p []byte) (n int, e error) {
+// Finish ends the current rectangle, checking that all its compressed data
+// was used. Any data remaining must only complete the flush which ends the
+// rectangle, and not decompress to anything.
+func (z *ZlibStream) Finish() error {
+	if z.err != nil {
+		return z.err
+	}
+	if (!z.header || z.resume) && z.src.buf.Len() == 0 {
+		// No data was sent for the rectangle.
+		return nil
+	}
+	if err := z.start(); err != nil {
+		return z.fail(err)
+	}
+
+	var p [1]byte
+	for {
+		n, err := z.fr.Read(p[:])
+		if n > 0 {
+			return z.fail(ErrExcessCompressedData)
+		}
+		switch err {
+		case nil:
+		case errNoInput:
+			// The decompressor must be resumed from the block boundary.
+			z.resume = true
+			return nil
+		default:
+			return z.fail(err)
+		}
+	}
+}
 
-	if z.zlibReader == nil {
-		log.Println("  no zlib reader found, creating one...")
-		z.zlibReader, _ = zlib.NewReader(z.buffer)
+// Reset discards any buffered data and decompression state, so that the next
+// data written starts a new zlib stream.
+func (z *ZlibStream) Reset() {
+	z.src.buf.Reset()
+	if z.fr != nil {
+		z.fr.Close()
 	}
-	n, e = z.zlibReader.Read(p)
-	//log.Printf("      zlib read: %v bytes, %v remaining", n, z.buffer.Len())
+	z.fr = nil
+	z.header, z.resume = false, false
+	z.history = z.history[:0]
+	z.err = nil
+}
 
-	return
+// start prepares the decompressor for reading the current rectangle.
+func (z *ZlibStream) start() error {
+	if !z.header {
+		if err := z.readHeader(); err != nil {
+			return err
+		}
+		z.header = true
+		z.fr = flate.NewReader(&z.src)
+		return nil
+	}
+	if z.resume {
+		z.resume = false
+		return z.fr.(flate.Resetter).Reset(&z.src, z.window())
+	}
+	return nil
 }
 
-func (z *ZlibStream) Write(p []byte) (n int, e error) {
-	log.Printf("  zlib write - %v bytes", len(p))
-	if z.buffer == nil {
-		log.Println("  no zlib buffer found, creating one...")
-		z.buffer = bytes.NewBuffer([]byte{})
+// readHeader reads the zlib header which starts the stream.
+//
+// See RFC 1950 §2.2.
+func (z *ZlibStream) readHeader() error {
+	var h [2]byte
+	if _, err := io.ReadFull(&z.src, h[:]); err != nil {
+		if err == errNoInput {
+			return ErrShortCompressedData
+		}
+		return err
 	}
-	n, e = z.buffer.Write(p)
-	return
+	switch {
+	case h[0]&0x0f != 8 || h[0]>>4 > 7:
+		return fmt.Errorf("zlib stream: invalid compression method %#x", h[0])
+	case (uint(h[0])<<8|uint(h[1]))%31 != 0:
+		return fmt.Errorf("zlib stream: invalid header checksum")
+	case h[1]&0x20 != 0:
+		return fmt.Errorf("zlib stream: preset dictionaries are not supported")
+	}
+	return nil
+}
+
+// remember adds decompressed data to the history, which is needed to resume
+// the decompressor.
+func (z *ZlibStream) remember(p []byte) {
+	z.history = append(z.history, p...)
+	if len(z.history) > 2*windowSize {
+		n := copy(z.history, z.window())
+		z.history = z.history[:n]
+	}
+}
+
+// window returns the current deflate sliding window.
+func (z *ZlibStream) window() []byte {
+	if len(z.history) > windowSize {
+		return z.history[len(z.history)-windowSize:]
+	}
+	return z.history
+}
+
+// fail records a fatal error.
+func (z *ZlibStream) fail(err error) error {
+	z.err = err
+	return err
 }
@@ -0,0 +1,123 @@
+package zrle
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// zlibRects compresses each rectangle of data in turn with a single zlib
+// stream, flushing it at the end of every rectangle as a server does.
+func zlibRects(t *testing.T, rects [][]byte) [][]byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	var compressed [][]byte
+	for _, r := range rects {
+		if _, err := zw.Write(r); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		compressed = append(compressed, append([]byte(nil), buf.Bytes()...))
+		buf.Reset()
+	}
+	return compressed
+}
+
+func TestZlibStream_ManyRects(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	var rects [][]byte
+	for i := 0; i < 300; i++ {
+		// Mix fresh and repeated data, so that later rectangles refer back
+		// to the output of earlier ones.
+		r := make([]byte, rnd.Intn(3000))
+		for j := range r {
+			r[j] = byte(rnd.Intn(4))
+		}
+		if i > 0 && i%3 == 0 {
+			r = append(r, rects[i-1]...)
+		}
+		rects = append(rects, r)
+	}
+
+	var z ZlibStream
+	for i, data := range zlibRects(t, rects) {
+		z.Write(data)
+		got := make([]byte, len(rects[i]))
+		if _, err := io.ReadFull(&z, got); err != nil {
+			t.Fatalf("rect %d: unexpected error %v", i, err)
+		}
+		if err := z.Finish(); err != nil {
+			t.Fatalf("rect %d: unexpected error %v", i, err)
+		}
+		if !bytes.Equal(got, rects[i]) {
+			t.Fatalf("rect %d: decompressed data differs", i)
+		}
+	}
+}
+
+func TestZlibStream_Errors(t *testing.T) {
+	rects := [][]byte{
+		bytes.Repeat([]byte{1, 2, 3}, 100),
+		bytes.Repeat([]byte{4, 5}, 100),
+	}
+	compressed := zlibRects(t, rects)
+
+	for _, tt := range []struct {
+		desc   string
+		data   []byte
+		read   int
+		err    error // Expected error from reading the rectangle.
+		finish error // Expected error from finishing the rectangle.
+	}{
+		{"short compressed data", compressed[0][:len(compressed[0])/2], len(rects[0]), ErrShortCompressedData, ErrShortCompressedData},
+		{"excess compressed data", compressed[0], len(rects[0]) - 1, nil, ErrExcessCompressedData},
+		{"excess rectangle", append(append([]byte(nil), compressed[0]...), compressed[1]...), len(rects[0]), nil, ErrExcessCompressedData},
+		{"no compressed data", nil, 1, ErrShortCompressedData, ErrShortCompressedData},
+	} {
+		var z ZlibStream
+		z.Write(tt.data)
+		_, err := io.ReadFull(&z, make([]byte, tt.read))
+		if err != tt.err {
+			t.Errorf("%s: expected read error %v, got %v", tt.desc, tt.err, err)
+		}
+		if err := z.Finish(); err != tt.finish {
+			t.Errorf("%s: expected finish error %v, got %v", tt.desc, tt.finish, err)
+		}
+		// The stream is out of sync until it is reset.
+		if _, err := z.Read(make([]byte, 1)); err != tt.finish {
+			t.Errorf("%s: expected sticky error %v, got %v", tt.desc, tt.finish, err)
+		}
+
+		z.Reset()
+		z.Write(compressed[0])
+		got := make([]byte, len(rects[0]))
+		if _, err := io.ReadFull(&z, got); err != nil {
+			t.Errorf("%s: unexpected error after reset %v", tt.desc, err)
+			continue
+		}
+		if err := z.Finish(); err != nil {
+			t.Errorf("%s: unexpected error after reset %v", tt.desc, err)
+		}
+		if !bytes.Equal(got, rects[0]) {
+			t.Errorf("%s: decompressed data differs after reset", tt.desc)
+		}
+	}
+}
+
+func TestZlibStream_InvalidHeader(t *testing.T) {
+	for _, data := range [][]byte{
+		{0x78, 0x00}, // Bad checksum.
+		{0x79, 0x9d}, // Not deflate.
+		{0x78, 0xbb}, // Preset dictionary.
+	} {
+		var z ZlibStream
+		z.Write(data)
+		if _, err := z.Read(make([]byte, 1)); err == nil {
+			t.Errorf("%v: expected error", data)
+		}
+	}
+}
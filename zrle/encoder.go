@@ -0,0 +1,211 @@
+package zrle
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+)
+
+// maxPaletteSize is the largest palette of a palette RLE tile.
+const maxPaletteSize = 127
+
+// Encoder encodes rectangles of CPIXELs as ZRLE data. The zlib stream
+// persists across rectangles, as the encoding requires, so an Encoder must
+// only be used for a single connection.
+type Encoder struct {
+	buf bytes.Buffer
+	zw  *zlib.Writer
+}
+
+// NewEncoder returns an Encoder starting a new zlib stream.
+func NewEncoder() *Encoder {
+	e := &Encoder{}
+	e.zw = zlib.NewWriter(&e.buf)
+	return e
+}
+
+// Reset discards the compression state, so that the next rectangle starts a
+// new zlib stream.
+func (e *Encoder) Reset() {
+	e.buf.Reset()
+	e.zw.Reset(&e.buf)
+}
+
+// Encode tiles a width x height rectangle of row-major CPIXELs, and returns
+// the zlib compressed tile data. The length which precedes the data on the
+// wire is not included.
+func (e *Encoder) Encode(width, height int, pixels []CPixel) ([]byte, error) {
+	if len(pixels) != width*height {
+		return nil, fmt.Errorf("incorrect number of pixels for %dx%d rectangle; got %d", width, height, len(pixels))
+	}
+
+	e.buf.Reset()
+	for _, t := range CreateTiles(width, height) {
+		tilePixels := make([]CPixel, 0, t.Width*t.Height)
+		for y := t.Y; y < t.Y+t.Height; y++ {
+			tilePixels = append(tilePixels, pixels[y*width+t.X:y*width+t.X+t.Width]...)
+		}
+		if _, err := e.zw.Write(EncodeTile(t.Width, t.Height, tilePixels)); err != nil {
+			return nil, err
+		}
+	}
+	if err := e.zw.Flush(); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, e.buf.Len())
+	copy(data, e.buf.Bytes())
+	return data, nil
+}
+
+// EncodeTile returns the uncompressed data of a tile of row-major CPIXELs,
+// using whichever sub-encoding is smallest.
+func EncodeTile(width, height int, pixels []CPixel) []byte {
+	palette, indices := tilePalette(pixels)
+	runs := tileRuns(indices)
+	bytesPerCPixel := 0
+	if len(pixels) > 0 {
+		bytesPerCPixel = len(pixels[0])
+	}
+
+	if len(palette) == 1 {
+		return append([]byte{byte(solid)}, palette[0]...)
+	}
+
+	// Calculate the size of each candidate sub-encoding.
+	subType, size := raw, len(pixels)*bytesPerCPixel
+	rleSize, prleSize := 0, len(palette)*bytesPerCPixel
+	for _, r := range runs {
+		rleSize += bytesPerCPixel + runLengthSize(r.length)
+		prleSize++
+		if r.length > 1 {
+			prleSize += runLengthSize(r.length)
+		}
+	}
+	if rleSize < size {
+		subType, size = rle, rleSize
+	}
+	if len(palette) <= maxPaletteSize && prleSize < size {
+		subType, size = prle, prleSize
+	}
+	if len(palette) <= maxPackedPaletteSize {
+		packedSize := len(palette)*bytesPerCPixel + (width*packedPixelBits(len(palette))+7)/8*height
+		if packedSize <= size {
+			subType, size = packedPalette, packedSize
+		}
+	}
+
+	data := make([]byte, 0, size+1)
+	switch subType {
+	case raw:
+		data = append(data, 0)
+		for _, p := range pixels {
+			data = append(data, p...)
+		}
+	case packedPalette:
+		data = append(data, byte(len(palette)))
+		for _, p := range palette {
+			data = append(data, p...)
+		}
+		bits := uint(packedPixelBits(len(palette)))
+		for y := 0; y < height; y++ {
+			var b byte
+			nb := uint(8)
+			for x := 0; x < width; x++ {
+				nb -= bits
+				b |= byte(indices[y*width+x]) << nb
+				if nb == 0 {
+					data = append(data, b)
+					b, nb = 0, 8
+				}
+			}
+			if nb < 8 {
+				data = append(data, b)
+			}
+		}
+	case rle:
+		data = append(data, 128)
+		for _, r := range runs {
+			data = append(data, palette[r.index]...)
+			data = appendRunLength(data, r.length)
+		}
+	case prle:
+		data = append(data, byte(128+len(palette)))
+		for _, p := range palette {
+			data = append(data, p...)
+		}
+		for _, r := range runs {
+			if r.length == 1 {
+				data = append(data, byte(r.index))
+				continue
+			}
+			data = append(data, byte(128|r.index))
+			data = appendRunLength(data, r.length)
+		}
+	}
+	return data
+}
+
+// tilePalette returns the distinct pixels of a tile in order of appearance,
+// along with the palette index of every pixel. Palette indices are only
+// meaningful while the palette fits a palette RLE tile.
+func tilePalette(pixels []CPixel) ([]CPixel, []int) {
+	var palette []CPixel
+	indices := make([]int, len(pixels))
+	seen := map[string]int{}
+	for i, p := range pixels {
+		idx, ok := seen[string(p)]
+		if !ok {
+			idx = len(palette)
+			seen[string(p)] = idx
+			palette = append(palette, p)
+		}
+		indices[i] = idx
+	}
+	return palette, indices
+}
+
+// run is a run of identical pixels.
+type run struct {
+	index, length int
+}
+
+// tileRuns returns the runs of identical palette indices.
+func tileRuns(indices []int) []run {
+	var runs []run
+	for _, idx := range indices {
+		if n := len(runs); n > 0 && runs[n-1].index == idx {
+			runs[n-1].length++
+			continue
+		}
+		runs = append(runs, run{idx, 1})
+	}
+	return runs
+}
+
+// packedPixelBits returns the number of bits per packed palette index.
+func packedPixelBits(paletteSize int) int {
+	switch {
+	case paletteSize <= 2:
+		return 1
+	case paletteSize <= 4:
+		return 2
+	}
+	return 4
+}
+
+// runLengthSize returns the number of bytes used to encode a run length.
+func runLengthSize(length int) int {
+	return (length-1)/255 + 1
+}
+
+// appendRunLength appends the encoding of a run length, which is the inverse
+// of CalcRuns.
+func appendRunLength(data []byte, length int) []byte {
+	length--
+	for length >= 255 {
+		data = append(data, 255)
+		length -= 255
+	}
+	return append(data, byte(length))
+}
@@ -0,0 +1,98 @@
+package zrle
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeTile(t *testing.T) {
+	// cycle returns n pixels of bytesPerCPixel bytes, cycling through
+	// colours in runs of runLength.
+	cycle := func(n, runLength, colours, bytesPerCPixel int) []CPixel {
+		pixels := make([]CPixel, n)
+		for i := range pixels {
+			c := (i / runLength) % colours
+			pixels[i] = make(CPixel, bytesPerCPixel)
+			for j := range pixels[i] {
+				pixels[i][j] = byte(c >> (8 * uint(j)))
+			}
+		}
+		return pixels
+	}
+
+	for _, tt := range []struct {
+		desc    string
+		w, h    int
+		pixels  []CPixel
+		subType int
+	}{
+		{"solid", 4, 4, cycle(16, 1, 1, 3), 1},
+		{"packed palette", 4, 4, cycle(16, 1, 2, 1), 2},
+		{"packed palette with 3 colours", 5, 3, cycle(15, 1, 3, 1), 3},
+		{"packed palette with 16 colours", 16, 4, cycle(64, 1, 16, 1), 16},
+		{"palette RLE", 64, 64, cycle(4096, 2, 17, 3), 128 + 17},
+		{"plain RLE", 64, 64, cycle(4096, 16, 256, 2), 128},
+		{"raw", 8, 8, cycle(64, 1, 64, 2), 0},
+		{"partial tile", 3, 2, cycle(6, 1, 6, 4), 0},
+	} {
+		data := EncodeTile(tt.w, tt.h, tt.pixels)
+		if got, want := int(data[0]), tt.subType; got != want {
+			t.Errorf("%s: expected sub-encoding %v, got %v", tt.desc, want, got)
+		}
+
+		tiles := []Tile{{Width: tt.w, Height: tt.h}}
+		buf := bytes.NewReader(data)
+		if err := ReadTiles(buf, tiles, len(tt.pixels[0]), GetSubencoding); err != nil {
+			t.Errorf("%s: unexpected error %v", tt.desc, err)
+			continue
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%s: %v bytes left unread", tt.desc, buf.Len())
+		}
+		if !reflect.DeepEqual(tt.pixels, tiles[0].Pixels) {
+			t.Errorf("%s: expected %v, got %v", tt.desc, tt.pixels, tiles[0].Pixels)
+		}
+	}
+}
+
+func TestEncoder_Encode(t *testing.T) {
+	e := NewEncoder()
+	var stream ZlibStream
+	for i, rect := range []struct {
+		w, h int
+	}{
+		{70, 65},
+		{3, 130},
+	} {
+		pixels := make([]CPixel, rect.w*rect.h)
+		for j := range pixels {
+			pixels[j] = CPixel{byte(i), byte(j % 5), byte(j / 50)}
+		}
+		data, err := e.Encode(rect.w, rect.h, pixels)
+		if err != nil {
+			t.Fatalf("%d: unexpected error %v", i, err)
+		}
+
+		// The zlib stream continues from the previous rectangle.
+		stream.Write(data)
+		tiles := CreateTiles(rect.w, rect.h)
+		if err := ReadTiles(&stream, tiles, 3, GetSubencoding); err != nil {
+			t.Fatalf("%d: unexpected error %v", i, err)
+		}
+		if err := stream.Finish(); err != nil {
+			t.Fatalf("%d: unexpected error %v", i, err)
+		}
+		var got []CPixel
+		for _, row := range TilesToPixels(rect.w, rect.h, tiles) {
+			got = append(got, row...)
+		}
+		if !reflect.DeepEqual(pixels, got) {
+			t.Errorf("%d: decoded pixels differ", i)
+		}
+	}
+
+	if _, err := e.Encode(2, 2, make([]CPixel, 3)); err == nil {
+		t.Error("expected error for incorrect number of pixels")
+	}
+}
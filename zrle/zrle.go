@@ -18,6 +18,8 @@ const (
 	packedPalette
 	rle
 	prle
+	packedPaletteReuse
+	prleReuse
 )
 
 const (
@@ -25,8 +27,16 @@ const (
 	TileWidth int = 64
 	// TileHeight is the expected, standard height of a tile
 	TileHeight = 64
+
+	// TRLETileWidth is the width of a TRLE tile
+	TRLETileWidth int = 16
+	// TRLETileHeight is the height of a TRLE tile
+	TRLETileHeight = 16
 )
 
+// maxPackedPaletteSize is the largest palette of a packed palette tile.
+const maxPackedPaletteSize = 16
+
 // TileConfig defines the underlying structure of all tiles
 type TileConfig struct {
 	width, height int
@@ -36,6 +46,10 @@ type TileConfig struct {
 type Tile struct {
 	X, Y, Width, Height, BytesPerCPixel, SubType int
 	Pixels                                       []CPixel
+
+	// Palette is the palette used by the tile. Before the tile is read it
+	// holds the palette of the previous tile, for sub-encodings that reuse it.
+	Palette []CPixel
 }
 
 func (t Tile) String() string {
@@ -66,12 +80,18 @@ func (t Tile) ToPixelGrid() [][]CPixel {
 
 // CreateTiles creates a grid of tiles based on a width and height
 func CreateTiles(width int, height int) (tiles []Tile) {
+	return CreateTilesOfSize(width, height, TileWidth, TileHeight)
+}
+
+// CreateTilesOfSize creates a grid of tiles of at most tileWidth x tileHeight
+// based on a width and height
+func CreateTilesOfSize(width, height, tileWidth, tileHeight int) (tiles []Tile) {
 	x, y := 0, 0
 	for height > 0 {
 		rowWidth := width
 
-		// If row is shorter than TileHeight adjust
-		rowHeight := TileHeight
+		// If row is shorter than tileHeight adjust
+		rowHeight := tileHeight
 		if height < rowHeight {
 			rowHeight = height
 		}
@@ -79,17 +99,17 @@ func CreateTiles(width int, height int) (tiles []Tile) {
 
 		for rowWidth > 0 {
 
-			// If tile is narrower than TileWidth adjust
-			tileWidth := TileWidth
-			if rowWidth < tileWidth {
-				tileWidth = rowWidth
+			// If tile is narrower than tileWidth adjust
+			w := tileWidth
+			if rowWidth < w {
+				w = rowWidth
 			}
-			rowWidth -= tileWidth
+			rowWidth -= w
 
-			newTile := Tile{X: x, Y: y, Width: tileWidth, Height: rowHeight}
+			newTile := Tile{X: x, Y: y, Width: w, Height: rowHeight}
 			tiles = append(tiles, newTile)
 
-			x += tileWidth
+			x += w
 		}
 		x = 0
 		y += rowHeight
@@ -114,6 +134,34 @@ func TilesToPixels(width int, height int, tiles []Tile) [][]CPixel {
 	return pixels
 }
 
+// ReadTiles reads the sub-encoding type and data of each tile in turn. The
+// palette of each tile is passed on to the next, so that sub-encodings which
+// reuse the previous palette can be decoded.
+func ReadTiles(buf io.Reader, tiles []Tile, bytesPerCPixel int, getSubencoding func(byte) (Subencoding, error)) error {
+	var palette []CPixel
+	for i := range tiles {
+		tiles[i].BytesPerCPixel = bytesPerCPixel
+		tiles[i].Palette = palette
+
+		p := make([]byte, 1)
+		if _, err := io.ReadFull(buf, p); err != nil {
+			return fmt.Errorf("unable to read sub-encoding type (tile %d): %s", i, err)
+		}
+
+		se, err := getSubencoding(p[0])
+		if err != nil {
+			return err
+		}
+
+		tiles[i].SubType = int(p[0])
+		if _, err := se.Read(buf, &tiles[i]); err != nil {
+			return err
+		}
+		palette = tiles[i].Palette
+	}
+	return nil
+}
+
 // Subencoding defines a subencoding structure
 type Subencoding interface {
 	SubType() SubType
@@ -126,18 +174,24 @@ type SolidEncoding struct{}
 type PackedPaletteEncoding struct{}
 type RleEncoding struct{}
 type PrleEncoding struct{}
-
-func (RawEncoding) SubType() SubType           { return raw }
-func (SolidEncoding) SubType() SubType         { return solid }
-func (PackedPaletteEncoding) SubType() SubType { return packedPalette }
-func (RleEncoding) SubType() SubType           { return rle }
-func (PrleEncoding) SubType() SubType          { return prle }
-
-func (RawEncoding) String() string           { return "RawEncoding" }
-func (SolidEncoding) String() string         { return "SolidEncoding" }
-func (PackedPaletteEncoding) String() string { return "PackedPaletteEncoding" }
-func (RleEncoding) String() string           { return "RleEncoding" }
-func (PrleEncoding) String() string          { return "PrleEncoding" }
+type PackedPaletteReuseEncoding struct{}
+type PrleReuseEncoding struct{}
+
+func (RawEncoding) SubType() SubType                { return raw }
+func (SolidEncoding) SubType() SubType              { return solid }
+func (PackedPaletteEncoding) SubType() SubType      { return packedPalette }
+func (RleEncoding) SubType() SubType                { return rle }
+func (PrleEncoding) SubType() SubType               { return prle }
+func (PackedPaletteReuseEncoding) SubType() SubType { return packedPaletteReuse }
+func (PrleReuseEncoding) SubType() SubType          { return prleReuse }
+
+func (RawEncoding) String() string                { return "RawEncoding" }
+func (SolidEncoding) String() string              { return "SolidEncoding" }
+func (PackedPaletteEncoding) String() string      { return "PackedPaletteEncoding" }
+func (RleEncoding) String() string                { return "RleEncoding" }
+func (PrleEncoding) String() string               { return "PrleEncoding" }
+func (PackedPaletteReuseEncoding) String() string { return "PackedPaletteReuseEncoding" }
+func (PrleReuseEncoding) String() string          { return "PrleReuseEncoding" }
 
 func (RawEncoding) Read(buf io.Reader, t *Tile) (bytesRead int, err error) {
 	log.Printf("  Raw Subencoding - %v x %v", t.Width, t.Height)
@@ -177,64 +231,81 @@ func (SolidEncoding) Read(buf io.Reader, t *Tile) (int, error) {
 
 func (PackedPaletteEncoding) Read(buf io.Reader, t *Tile) (int, error) {
 	log.Println("  Packed Palette Subencoding")
-	bytesToRead := t.SubType * t.BytesPerCPixel
-	bytesRead := 0
+	bytesRead, err := readPalette(buf, t, t.SubType)
+	if err != nil {
+		return bytesRead, err
+	}
+	n, err := readPackedPixels(buf, t)
+	return bytesRead + n, err
+}
+
+func (PackedPaletteReuseEncoding) Read(buf io.Reader, t *Tile) (int, error) {
+	if len(t.Palette) < 2 {
+		return 0, fmt.Errorf("no previous palette to reuse")
+	}
+	if len(t.Palette) > maxPackedPaletteSize {
+		return 0, fmt.Errorf("previous palette of %d colours is too large to pack", len(t.Palette))
+	}
+	return readPackedPixels(buf, t)
+}
 
-	palette := make([]CPixel, 0)
+// readPalette reads a palette of paletteSize CPIXELs into the tile.
+func readPalette(buf io.Reader, t *Tile, paletteSize int) (int, error) {
+	bytesRead := 0
+	palette := make([]CPixel, paletteSize)
 
-	for bytesToRead > 0 {
+	for x := range palette {
 		pixel := make(CPixel, t.BytesPerCPixel)
-		n, err := io.ReadAtLeast(buf, pixel, len(pixel))
+		n, err := io.ReadFull(buf, pixel)
 		bytesRead += n
 		if err != nil {
-			return bytesRead, err
+			return bytesRead, fmt.Errorf("unable to read palette: %s", err)
 		}
-		palette = append(palette, pixel)
-		bytesToRead -= len(pixel)
+		palette[x] = pixel
 	}
+	t.Palette = palette
 
-	px := uint8(0)
+	return bytesRead, nil
+}
+
+// readPackedPixels reads packed palette indices for the tile's palette. Each
+// row is padded to a whole number of bytes.
+func readPackedPixels(buf io.Reader, t *Tile) (int, error) {
+	bytesRead := 0
+	palette := t.Palette
 
+	var px uint8
 	switch {
-	case t.SubType == 2:
-		bytesToRead = ((t.Width + 7) / 8) * t.Height
-		px = uint8(1)
-	case t.SubType >= 5:
-		bytesToRead = ((t.Width + 1) / 2) * t.Height
-		px = uint8(4)
+	case len(palette) == 2:
+		px = 1
+	case len(palette) <= 4:
+		px = 2
 	default:
-		bytesToRead = ((t.Width + 3) / 4) * t.Height
-		px = uint8(2)
+		px = 4
 	}
 
+	bx := make([]byte, 1)
 	for y := 0; y < t.Height; y++ {
-		bx := make([]byte, 1)
-		var b uint8
-
-		nb := uint8(0)
-
+		var b, nb uint8
 		for x := 0; x < t.Width; x++ {
 			if nb == 0 {
-				n, err := io.ReadAtLeast(buf, bx, 1)
-				b = uint8(bx[0])
-				nb = uint8(8)
-
+				n, err := io.ReadFull(buf, bx)
+				bytesRead += n
 				if err != nil {
-					return bytesRead, err
+					return bytesRead, fmt.Errorf("unable to read packed pixels: %s", err)
 				}
-				bytesRead += n
-
+				b, nb = bx[0], 8
 			}
 
 			nb -= px
-			idx := (b >> nb) & ((1 << px) - 1) & 127
-			pixel := palette[idx]
-
-			t.Pixels = append(t.Pixels, pixel)
+			idx := int((b >> nb) & (1<<px - 1))
+			if idx >= len(palette) {
+				return bytesRead, fmt.Errorf("palette index %d out of range for palette of %d colours", idx, len(palette))
+			}
+			t.Pixels = append(t.Pixels, palette[idx])
 		}
 	}
 
-	log.Print(t.Width*t.Height, len(t.Pixels))
 	return bytesRead, nil
 }
 
@@ -242,22 +313,23 @@ func (RleEncoding) Read(buf io.Reader, t *Tile) (int, error) {
 	log.Println("  RLE Subecoding")
 
 	bytesRead := 0
-	pixelsRead := 0
+	numPixels := t.Width * t.Height
 
-	for pixelsRead < int(t.Width)*int(t.Height) {
+	for len(t.Pixels) < numPixels {
 		pixel := make(CPixel, t.BytesPerCPixel)
-		n, err := io.ReadAtLeast(buf, pixel, len(pixel))
+		n, err := io.ReadFull(buf, pixel)
 		bytesRead += n
 		if err != nil {
-			return bytesRead, err
+			return bytesRead, fmt.Errorf("unable to read run pixel: %s", err)
 		}
 
-		runLength, n := CalcRuns(buf, 255)
+		runLength, n, err := CalcRuns(buf, 255)
 		bytesRead += n
-		rSize := (runLength - 1) / 255
-		for i := 0; i < rSize; i++ {
-			t.Pixels = append(t.Pixels, pixel)
-			pixelsRead++
+		if err != nil {
+			return bytesRead, err
+		}
+		if err := appendRun(t, pixel, runLength, numPixels); err != nil {
+			return bytesRead, err
 		}
 	}
 
@@ -266,63 +338,85 @@ func (RleEncoding) Read(buf io.Reader, t *Tile) (int, error) {
 
 func (PrleEncoding) Read(buf io.Reader, t *Tile) (int, error) {
 	log.Println("  PRLE Subencoding")
+	bytesRead, err := readPalette(buf, t, t.SubType-128)
+	if err != nil {
+		return bytesRead, err
+	}
+	n, err := readPaletteRuns(buf, t)
+	return bytesRead + n, err
+}
 
-	paletteSize := (t.SubType - 128)
+func (PrleReuseEncoding) Read(buf io.Reader, t *Tile) (int, error) {
+	if len(t.Palette) == 0 {
+		return 0, fmt.Errorf("no previous palette to reuse")
+	}
+	return readPaletteRuns(buf, t)
+}
+
+// readPaletteRuns reads palette RLE runs for the tile's palette. An index
+// with the top bit set is followed by a run length, otherwise it is a single
+// pixel.
+func readPaletteRuns(buf io.Reader, t *Tile) (int, error) {
 	bytesRead := 0
-	palette := make([]CPixel, paletteSize)
+	palette := t.Palette
+	numPixels := t.Width * t.Height
 
-	for x, _ := range palette {
-		pixel := make(CPixel, t.BytesPerCPixel)
-		n, err := io.ReadAtLeast(buf, pixel, len(pixel))
+	p := make([]byte, 1)
+	for len(t.Pixels) < numPixels {
+		n, err := io.ReadFull(buf, p)
 		bytesRead += n
 		if err != nil {
-			return bytesRead, err
+			return bytesRead, fmt.Errorf("unable to read palette index: %s", err)
 		}
-		palette[x] = pixel
-	}
 
-	temp := 0
-	runs := 0
-
-	for temp < int(t.Width*t.Height) {
-		runs++
-		paletteIndexArr := make([]byte, 1)
-		n, err := io.ReadAtLeast(buf, paletteIndexArr, 1)
-		if err != nil {
-			return bytesRead, err
+		idx := int(p[0] & 127)
+		if idx >= len(palette) {
+			return bytesRead, fmt.Errorf("palette index %d out of range for palette of %d colours", idx, len(palette))
 		}
-		bytesRead += n
-		index := paletteIndexArr[0]
-
-		var colour CPixel
-		log.Println("    Subencoding:", t.SubType, "RawIndex:", index, "Index:", index&127, "Palette:", len(palette))
-		if index < 128 {
-			colour = palette[index]
-			t.Pixels = append(t.Pixels, colour)
-			temp++
-		} else {
-			colour = palette[index-128]
-			runLength, _ := CalcRuns(buf, 255)
-			for i := 0; i < runLength; i++ {
-				t.Pixels = append(t.Pixels, colour)
-				temp++
+
+		runLength := 1
+		if p[0]&128 != 0 {
+			runLength, n, err = CalcRuns(buf, 255)
+			bytesRead += n
+			if err != nil {
+				return bytesRead, err
 			}
 		}
+		if err := appendRun(t, palette[idx], runLength, numPixels); err != nil {
+			return bytesRead, err
+		}
 	}
 	return bytesRead, nil
 }
 
-// CalcRuns calculates the length of a single-pixel run, in bytes
-func CalcRuns(buffer io.Reader, maxVal int) (int, int) {
+// appendRun appends a run of a pixel to the tile, ensuring the run does not
+// overflow the tile.
+func appendRun(t *Tile, pixel CPixel, runLength, numPixels int) error {
+	if len(t.Pixels)+runLength > numPixels {
+		return fmt.Errorf("run of %d pixels overflows tile with %d pixels remaining", runLength, numPixels-len(t.Pixels))
+	}
+	for i := 0; i < runLength; i++ {
+		t.Pixels = append(t.Pixels, pixel)
+	}
+	return nil
+}
+
+// CalcRuns calculates the length of a single-pixel run, returning the run
+// length and the number of bytes read. The run length is one more than the
+// sum of the bytes read, where every byte but the last is maxVal.
+func CalcRuns(buffer io.Reader, maxVal int) (int, int, error) {
 	bytesRead := 0
 	length := 1
 	p := make([]byte, 1)
 	for {
-		io.ReadAtLeast(buffer, p, 1)
-		bytesRead++
+		n, err := io.ReadFull(buffer, p)
+		bytesRead += n
+		if err != nil {
+			return length, bytesRead, fmt.Errorf("unable to read run length: %s", err)
+		}
 		length += int(p[0])
 		if int(p[0]) != maxVal {
-			return length, bytesRead
+			return length, bytesRead, nil
 		}
 	}
 }
@@ -334,8 +428,7 @@ func GetSubencoding(b byte) (encoding Subencoding, err error) {
 		encoding = RawEncoding{}
 	case b == 1:
 		encoding = SolidEncoding{}
-	// TODO: Decide whether this should cut off at type 17 or type 128
-	case b < 128:
+	case b <= maxPackedPaletteSize:
 		encoding = PackedPaletteEncoding{}
 	case b == 128:
 		encoding = RleEncoding{}
@@ -346,3 +439,15 @@ func GetSubencoding(b byte) (encoding Subencoding, err error) {
 	}
 	return
 }
+
+// GetTRLESubencoding returns the sub-encoding of a TRLE data stream, which
+// adds sub-encodings that reuse the palette of the previous tile
+func GetTRLESubencoding(b byte) (Subencoding, error) {
+	switch b {
+	case 127:
+		return PackedPaletteReuseEncoding{}, nil
+	case 129:
+		return PrleReuseEncoding{}, nil
+	}
+	return GetSubencoding(b)
+}
@@ -56,7 +56,10 @@ func TestTileToPixelGrid_ColumnCase(t *testing.T) {
 func TestZRLEncoding_CalcRuns(t *testing.T) {
 	buf := bytes.NewReader([]byte{0})
 
-	result, n := CalcRuns(buf, 255)
+	result, n, err := CalcRuns(buf, 255)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
 	// Check result
 	exp := 1
 	if result != exp {
@@ -74,7 +77,10 @@ func TestZRLEncoding_CalcRuns(t *testing.T) {
 	}
 
 	buf = bytes.NewReader([]byte{254})
-	result, n = CalcRuns(buf, 255)
+	result, n, err = CalcRuns(buf, 255)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
 	// Check result
 	exp = 255
 	if result != exp {
@@ -92,7 +98,10 @@ func TestZRLEncoding_CalcRuns(t *testing.T) {
 	}
 
 	buf = bytes.NewReader([]byte{255, 0})
-	result, n = CalcRuns(buf, 255)
+	result, n, err = CalcRuns(buf, 255)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
 	// Check result
 	exp = 256
 	if result != exp {
@@ -110,7 +119,10 @@ func TestZRLEncoding_CalcRuns(t *testing.T) {
 	}
 
 	buf = bytes.NewReader([]byte{255, 1})
-	result, n = CalcRuns(buf, 255)
+	result, n, err = CalcRuns(buf, 255)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
 	// Check result
 	exp = 257
 	if result != exp {
@@ -128,7 +140,10 @@ func TestZRLEncoding_CalcRuns(t *testing.T) {
 	}
 
 	buf = bytes.NewReader([]byte{255, 254})
-	result, n = CalcRuns(buf, 255)
+	result, n, err = CalcRuns(buf, 255)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
 	// Check result
 	exp = 510
 	if result != exp {
@@ -146,7 +161,10 @@ func TestZRLEncoding_CalcRuns(t *testing.T) {
 	}
 
 	buf = bytes.NewReader([]byte{255, 255, 0})
-	result, n = CalcRuns(buf, 255)
+	result, n, err = CalcRuns(buf, 255)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
 	// Check result
 	exp = 511
 	if result != exp {
@@ -166,7 +184,10 @@ func TestZRLEncoding_CalcRuns(t *testing.T) {
 	// Check read STOPS correctly
 
 	buf = bytes.NewReader([]byte{255, 255, 0, 255})
-	result, n = CalcRuns(buf, 255)
+	result, n, err = CalcRuns(buf, 255)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
 	// Check result
 	exp = 511
 	if result != exp {
@@ -183,4 +204,235 @@ func TestZRLEncoding_CalcRuns(t *testing.T) {
 		t.Errorf("expected %v, got %v", exp, result)
 	}
 
+	// Check a truncated run is an error
+	for _, data := range [][]byte{{}, {255}, {255, 255}} {
+		if _, _, err := CalcRuns(bytes.NewReader(data), 255); err == nil {
+			t.Errorf("%v: expected error", data)
+		}
+	}
+}
+
+func TestCreateTilesOfSize(t *testing.T) {
+	tiles := CreateTilesOfSize(20, 17, TRLETileWidth, TRLETileHeight)
+	expected := []Tile{
+		Tile{X: 0, Y: 0, Width: 16, Height: 16},
+		Tile{X: 16, Y: 0, Width: 4, Height: 16},
+		Tile{X: 0, Y: 16, Width: 16, Height: 1},
+		Tile{X: 16, Y: 16, Width: 4, Height: 1},
+	}
+	if !reflect.DeepEqual(expected, tiles) {
+		t.Errorf("expected %v, got %v", expected, tiles)
+	}
+}
+
+func TestReadTiles_PaletteReuse(t *testing.T) {
+	repeat := func(p CPixel, n int) []CPixel {
+		pixels := make([]CPixel, n)
+		for i := range pixels {
+			pixels[i] = p
+		}
+		return pixels
+	}
+
+	for _, tt := range []struct {
+		desc     string
+		data     []byte
+		expected []CPixel
+		ok       bool
+	}{
+		{"packed palette reuse",
+			[]byte{
+				2, 10, 20, 0xff, 0x00, // palette of 2, 1 bit per index
+				127, 0x00, 0xff, // reuse palette
+			},
+			append(append(append(repeat(CPixel{20}, 8), repeat(CPixel{10}, 8)...), repeat(CPixel{10}, 8)...), repeat(CPixel{20}, 8)...),
+			true},
+		{"palette RLE reuse",
+			[]byte{
+				130, 1, 2, 0x80, 14, 0x01, // palette of 2, run of 15, single pixel
+				129, 0x81, 15, // reuse palette, run of 16
+			},
+			append(append(repeat(CPixel{1}, 15), CPixel{2}), repeat(CPixel{2}, 16)...),
+			true},
+		{"palette survives solid tile",
+			[]byte{
+				2, 10, 20, 0xff, 0xff,
+				1, 30,
+			},
+			append(repeat(CPixel{20}, 16), repeat(CPixel{30}, 16)...),
+			true},
+		{"packed palette reuse without previous palette",
+			[]byte{127, 0x00, 0xff},
+			nil,
+			false},
+		{"palette RLE reuse without previous palette",
+			[]byte{129, 0x80, 15},
+			nil,
+			false},
+	} {
+		tiles := CreateTilesOfSize(32, 1, TRLETileWidth, TRLETileHeight)
+		err := ReadTiles(bytes.NewReader(tt.data), tiles, 1, GetTRLESubencoding)
+		if err == nil && !tt.ok {
+			t.Errorf("%s: expected error", tt.desc)
+			continue
+		}
+		if err != nil && tt.ok {
+			t.Errorf("%s: unexpected error %v", tt.desc, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		pixels := TilesToPixels(32, 1, tiles)
+		if !reflect.DeepEqual([][]CPixel{tt.expected}, pixels) {
+			t.Errorf("%s: expected %v, got %v", tt.desc, tt.expected, pixels)
+		}
+	}
+}
+
+func TestGetSubencoding_PaletteReuse(t *testing.T) {
+	for _, b := range []byte{127, 129} {
+		if _, err := GetTRLESubencoding(b); err != nil {
+			t.Errorf("TRLE sub-encoding %v: unexpected error %v", b, err)
+		}
+	}
+	if se, _ := GetSubencoding(129); se != nil {
+		t.Errorf("ZRLE sub-encoding 129: expected no sub-encoding, got %v", se)
+	}
+}
+
+// TestReadTiles_Golden decodes tiles encoded by hand following RFC 6143
+// §7.7.6, using single byte CPIXELs.
+func TestReadTiles_Golden(t *testing.T) {
+	pixels := func(ps ...byte) []CPixel {
+		var cpixels []CPixel
+		for _, p := range ps {
+			cpixels = append(cpixels, CPixel{p})
+		}
+		return cpixels
+	}
+	repeat := func(p byte, n int) []CPixel {
+		return pixels(bytes.Repeat([]byte{p}, n)...)
+	}
+
+	for _, tt := range []struct {
+		desc     string
+		w, h     int
+		data     []byte
+		expected []CPixel
+		ok       bool
+	}{
+		{"plain RLE",
+			4, 2,
+			[]byte{128, 5, 2, 6, 4}, // 3 x 5, 5 x 6
+			pixels(5, 5, 5, 6, 6, 6, 6, 6),
+			true},
+		{"plain RLE long run",
+			64, 64,
+			append(append([]byte{128, 9}, bytes.Repeat([]byte{255}, 16)...), 15), // 1 + 16*255 + 15
+			repeat(9, 4096),
+			true},
+		{"palette RLE",
+			4, 2,
+			[]byte{130, 10, 20, 0x81, 2, 0x00, 0x80, 3}, // 3 x 20, 1 x 10, 4 x 10
+			pixels(20, 20, 20, 10, 10, 10, 10, 10),
+			true},
+		{"packed palette with 2 bit indices",
+			3, 2,
+			[]byte{3, 1, 2, 3, 0x18, 0x90}, // rows are padded to a byte
+			pixels(1, 2, 3, 3, 2, 1),
+			true},
+		{"packed palette with 4 bit indices",
+			3, 2,
+			[]byte{5, 1, 2, 3, 4, 5, 0x01, 0x20, 0x34, 0x00},
+			pixels(1, 2, 3, 4, 5, 1),
+			true},
+		{"packed palette index out of range",
+			4, 2,
+			[]byte{3, 1, 2, 3, 0xc0, 0x00},
+			nil,
+			false},
+		{"palette RLE index out of range",
+			4, 2,
+			[]byte{130, 1, 2, 0x02},
+			nil,
+			false},
+		{"palette RLE run index out of range",
+			4, 2,
+			[]byte{130, 1, 2, 0x82, 7},
+			nil,
+			false},
+		{"plain RLE run overflows tile",
+			4, 2,
+			[]byte{128, 5, 8},
+			nil,
+			false},
+		{"plain RLE truncated run",
+			4, 2,
+			[]byte{128, 5, 255},
+			nil,
+			false},
+		{"palette RLE truncated palette",
+			4, 2,
+			[]byte{131, 1, 2},
+			nil,
+			false},
+		{"packed palette truncated",
+			4, 2,
+			[]byte{2, 1, 2, 0xff},
+			nil,
+			false},
+		{"invalid sub-encoding 17", 4, 2, []byte{17}, nil, false},
+		{"invalid sub-encoding 127", 4, 2, []byte{127}, nil, false},
+		{"invalid sub-encoding 129", 4, 2, []byte{129}, nil, false},
+	} {
+		tiles := CreateTiles(tt.w, tt.h)
+		err := ReadTiles(bytes.NewReader(tt.data), tiles, 1, GetSubencoding)
+		if err == nil && !tt.ok {
+			t.Errorf("%s: expected error", tt.desc)
+			continue
+		}
+		if err != nil && tt.ok {
+			t.Errorf("%s: unexpected error %v", tt.desc, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if !reflect.DeepEqual(tt.expected, tiles[0].Pixels) {
+			t.Errorf("%s: expected %v, got %v", tt.desc, tt.expected, tiles[0].Pixels)
+		}
+	}
+}
+
+func TestGetSubencoding(t *testing.T) {
+	for b := 0; b < 256; b++ {
+		var expected Subencoding
+		switch {
+		case b == 0:
+			expected = RawEncoding{}
+		case b == 1:
+			expected = SolidEncoding{}
+		case b <= 16:
+			expected = PackedPaletteEncoding{}
+		case b == 128:
+			expected = RleEncoding{}
+		case b >= 130:
+			expected = PrleEncoding{}
+		}
+		se, err := GetSubencoding(byte(b))
+		if expected == nil {
+			if err == nil {
+				t.Errorf("sub-encoding %v: expected error, got %v", b, se)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("sub-encoding %v: unexpected error %v", b, err)
+			continue
+		}
+		if se != expected {
+			t.Errorf("sub-encoding %v: expected %v, got %v", b, expected, se)
+		}
+	}
 }